@@ -42,7 +42,7 @@ func Benchmark1M(b *testing.B) {
 }
 */
 func BenchmarkTxSize(b *testing.B) {
-	core.Start("127.0.0.1:8888")
+	core.Start(core.Config{Address: "127.0.0.1:8888", DataDir: b.TempDir()})
 	b.ResetTimer()
 	//testCases := []string{"80", "200", "512", strconv.Itoa(1 * 1024), strconv.Itoa(4 * 1024), strconv.Itoa(16 * 1024)} //80b -> 16k
 	testCases := []string{"80"} //80b -> 16k
@@ -25,6 +25,27 @@ func main() {
 		b.Sign(core.GenerateNewKeypair())
 	})
 	fmt.Println("Block took", t2)
+
+	// Signing and verification throughput per signature scheme
+	const n = 1000
+	for _, scheme := range []byte{core.SIGNATURE_SCHEME_P256, core.SIGNATURE_SCHEME_ED25519} {
+
+		kp, _ := core.GenerateKeypair(scheme)
+		hash := core.NewTransaction(kp.Public, nil, nil).Hash()
+		sig, _ := kp.Sign(hash)
+
+		ts := bench(func() {
+			for i := 0; i < n; i++ {
+				kp.Sign(hash)
+			}
+		})
+		tv := bench(func() {
+			for i := 0; i < n; i++ {
+				core.VerifySignature(scheme, kp.Public, sig, hash)
+			}
+		})
+		fmt.Printf("%s: sign %.0f/s, verify %.0f/s\n", core.SignatureSchemeName(scheme), n/ts.Seconds(), n/tv.Seconds())
+	}
 }
 
 func bench(f func()) time.Duration {
@@ -0,0 +1,391 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strings"
+
+	"tps-testing/core"
+)
+
+// blockPow is the proof of work blocks are checked for, none without proof of work consensus
+var blockPow = core.BLOCK_POW
+
+// inspectTypes can be given with -type, auto tries the wire objects
+var inspectTypes = []string{"tx", "block", "message", "pbft", "compact-block", "transactions-request", "block-transactions", "inventory", "get-data", "txs"}
+
+// messageTypes are the types of the payloads of messages
+var messageTypes = map[byte]string{
+	core.MESSAGE_SEND_TRANSACTION:        "tx",
+	core.MESSAGE_SEND_TRANSACTIONS:       "txs",
+	core.MESSAGE_SEND_BLOCK:              "block",
+	core.MESSAGE_PBFT_PRE_PREPARE:        "pbft",
+	core.MESSAGE_PBFT_PREPARE:            "pbft",
+	core.MESSAGE_PBFT_COMMIT:             "pbft",
+	core.MESSAGE_PBFT_VIEW_CHANGE:        "pbft",
+	core.MESSAGE_PBFT_NEW_VIEW:           "pbft",
+	core.MESSAGE_SEND_COMPACT_BLOCK:      "compact-block",
+	core.MESSAGE_GET_BLOCK_TRANSACTIONS:  "transactions-request",
+	core.MESSAGE_SEND_BLOCK_TRANSACTIONS: "block-transactions",
+	core.MESSAGE_INV:                     "inventory",
+	core.MESSAGE_GET_DATA:                "get-data",
+}
+
+type messageInfo struct {
+	Identifier byte   `json:"identifier"`
+	Name       string `json:"name"`
+	Options    string `json:"options"`
+	DataSize   int    `json:"dataSize"`
+}
+
+type decodeFailure struct {
+	Offset  int    `json:"offset"`
+	Field   string `json:"field"`
+	Reason  string `json:"reason"`
+	Context string `json:"context"` // hex dump around the offset
+}
+
+type pbftVoteInfo struct {
+	Phase     string `json:"phase"`
+	View      uint64 `json:"view"`
+	Height    uint64 `json:"height"`
+	Digest    string `json:"digest"`
+	Validator uint32 `json:"validator"`
+	Scheme    string `json:"scheme"`
+	Signature string `json:"signature"`
+}
+
+// pbftInfo is a consensus message, its block goes in the inspection's block
+type pbftInfo struct {
+	Vote        pbftVoteInfo   `json:"vote"`
+	Certificate []pbftVoteInfo `json:"certificate,omitempty"`
+	ViewChanges []pbftInfo     `json:"viewChanges,omitempty"`
+}
+
+// payloadInfo holds the message payloads that aren't a whole transaction or block
+type payloadInfo struct {
+	Block        string                 `json:"block,omitempty"` // hash of the block it's about
+	ShortIDs     []string               `json:"shortIds,omitempty"`
+	Indexes      []int                  `json:"indexes,omitempty"`
+	Hashes       []string               `json:"hashes,omitempty"` // of the transactions announced or asked for
+	Transactions []core.TransactionInfo `json:"transactions,omitempty"`
+}
+
+// inspection is what inspect prints, fields decoded before a failure are kept
+type inspection struct {
+	Type        string                `json:"type"`
+	Encoding    string                `json:"encoding"`
+	Size        int                   `json:"size"`
+	Message     *messageInfo          `json:"message,omitempty"`
+	Transaction *core.TransactionInfo `json:"transaction,omitempty"`
+	Block       *core.BlockInfo       `json:"block,omitempty"`
+	PBFT        *pbftInfo             `json:"pbft,omitempty"`
+	Payload     *payloadInfo          `json:"payload,omitempty"`
+	Checks      []core.Check          `json:"checks,omitempty"`
+	Error       *decodeFailure        `json:"error,omitempty"`
+}
+
+func runInspect(args []string) error {
+
+	fs := newFlagSet("inspect", "[flags] [file]", "Decodes a transaction, block or message in the wire format and prints every field as\nJSON, along with hash, merkle root, proof of work and signature checks. When decoding\nfails it shows the field and byte offset where it stopped. Reads standard input when\nno file is given, exits with an error when decoding or any check fails.")
+	kind := fs.String("type", "auto", "what the input holds (auto, "+strings.Join(inspectTypes, ", ")+")")
+	encoding := fs.String("encoding", "auto", "input encoding (auto, raw, hex, base64)")
+	consensus := fs.String("consensus", core.CONSENSUS_POW, "consensus the blocks come from, proof of work is only checked for pow")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() > 1 {
+		fs.Usage()
+		return fmt.Errorf("Too many arguments")
+	}
+	if *consensus != core.CONSENSUS_POW {
+		blockPow = nil
+	}
+
+	var data []byte
+	var err error
+	if fs.NArg() == 1 && fs.Arg(0) != "-" {
+		data, err = os.ReadFile(fs.Arg(0))
+	} else {
+		data, err = io.ReadAll(os.Stdin)
+	}
+	if err != nil {
+		return err
+	}
+
+	in := &inspection{Encoding: *encoding}
+	if data, err = decodeInput(data, in); err != nil {
+		return err
+	}
+
+	switch {
+	case *kind == "auto":
+		in = inspectAuto(data, in.Encoding)
+	case slices.Contains(inspectTypes, *kind):
+		in.Type = *kind
+		inspect(data, in)
+	default:
+		return fmt.Errorf("Unknown type %q, expected auto, %s", *kind, strings.Join(inspectTypes, ", "))
+	}
+
+	out, _ := json.MarshalIndent(in, "", "  ")
+	fmt.Println(string(out))
+
+	if in.Error != nil {
+		return fmt.Errorf("%s decoding failed at byte %d", in.Type, in.Error.Offset)
+	}
+	failed := []string{}
+	for _, c := range in.Checks {
+		if !c.OK {
+			failed = append(failed, c.Name)
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("%s failed checks: %s", in.Type, strings.Join(failed, ", "))
+	}
+
+	return nil
+}
+
+// decodeInput undoes the text encoding, auto takes hex and base64 text over raw bytes
+func decodeInput(data []byte, in *inspection) ([]byte, error) {
+
+	text := string(bytes.Join(bytes.Fields(data), nil))
+
+	switch in.Encoding {
+	case "raw":
+		return data, nil
+	case "hex":
+		return hex.DecodeString(text)
+	case "base64":
+		return base64.StdEncoding.DecodeString(text)
+	case "auto":
+		if d, err := hex.DecodeString(text); err == nil && len(text) > 0 {
+			in.Encoding = "hex"
+			return d, nil
+		}
+		if d, err := base64.StdEncoding.DecodeString(text); err == nil && len(text) > 0 {
+			in.Encoding = "base64"
+			return d, nil
+		}
+		in.Encoding = "raw"
+		return data, nil
+	}
+
+	return nil, fmt.Errorf("Unknown encoding %q, expected auto, raw, hex or base64", in.Encoding)
+}
+
+// inspectAuto tries every type, when none decodes the one that got furthest is reported
+func inspectAuto(data []byte, encoding string) *inspection {
+
+	var best *inspection
+	for _, kind := range []string{"message", "block", "tx"} {
+		in := &inspection{Type: kind, Encoding: encoding}
+		inspect(data, in)
+		if in.Error == nil {
+			return in
+		}
+		if best == nil || in.Error.Offset > best.Error.Offset {
+			best = in
+		}
+	}
+
+	return best
+}
+
+func inspect(data []byte, in *inspection) {
+
+	in.Size = len(data)
+	if err := inspectObject(in.Type, data, in); err != nil {
+		in.Error = newDecodeFailure(data, err)
+	}
+}
+
+// inspectObject fills in whatever decodes. Errors from message data are shifted
+// to offsets in the whole message.
+func inspectObject(kind string, data []byte, in *inspection) error {
+
+	switch kind {
+	case "tx":
+		t := new(core.Transaction)
+		rem, err := t.UnmarshalBinary(data)
+		info := core.NewTransactionInfo(t, -1)
+		in.Transaction = &info
+		if err != nil {
+			return err
+		}
+		if len(rem) > 0 {
+			return &core.DecodeError{Offset: len(data) - len(rem), Field: "transaction", Err: core.ErrTrailingData}
+		}
+		in.Checks = t.Checks(core.TRANSACTION_POW)
+
+	case "block":
+		b := &core.Block{BlockHeader: new(core.BlockHeader), TransactionSlice: new(core.TransactionSlice)}
+		err := b.UnmarshalBinary(data)
+		info := core.NewBlockInfo(b, -1, true)
+		in.Block = &info
+		if err != nil {
+			return err
+		}
+		in.Checks = b.Checks(blockPow, core.TRANSACTION_POW)
+
+	case "pbft":
+		m := new(core.PBFTMessage)
+		err := m.UnmarshalBinary(data)
+		in.PBFT = newPBFTInfo(m)
+		if m.Block != nil {
+			info := core.NewBlockInfo(m.Block, int(m.Vote.Height), true)
+			in.Block = &info
+		}
+		return err
+
+	case "compact-block":
+		c := new(core.CompactBlock)
+		err := c.UnmarshalBinary(data)
+		if c.BlockHeader != nil {
+			info := core.NewBlockInfo(&core.Block{BlockHeader: c.BlockHeader, Signature: c.Signature, TransactionSlice: &core.TransactionSlice{}}, -1, false)
+			info.TxCount = len(c.ShortIDs)
+			in.Block = &info
+		}
+		in.Payload = &payloadInfo{}
+		for _, id := range c.ShortIDs {
+			in.Payload.ShortIDs = append(in.Payload.ShortIDs, hex.EncodeToString(id))
+		}
+		if err != nil {
+			return err
+		}
+		in.Checks = c.Checks(blockPow)
+
+	case "transactions-request":
+		r := new(core.BlockTransactionsRequest)
+		err := r.UnmarshalBinary(data)
+		in.Payload = &payloadInfo{Block: hex.EncodeToString(r.Block), Indexes: r.Indexes}
+		return err
+
+	case "block-transactions":
+		t := new(core.BlockTransactions)
+		err := t.UnmarshalBinary(data)
+		in.Payload = &payloadInfo{Block: hex.EncodeToString(t.Block), Transactions: transactionInfos(t.Transactions)}
+		if err != nil {
+			return err
+		}
+		in.Checks = []core.Check{t.Transactions.Check(core.TRANSACTION_POW)}
+
+	case "txs":
+		var txs core.TransactionSlice
+		err := txs.UnmarshalBinary(data)
+		in.Payload = &payloadInfo{Transactions: transactionInfos(txs)}
+		if err != nil {
+			return err
+		}
+		in.Checks = []core.Check{txs.Check(core.TRANSACTION_POW)}
+
+	case "inventory", "get-data":
+		var hashes core.InventoryHashes
+		err := hashes.UnmarshalBinary(data)
+		in.Payload = &payloadInfo{}
+		for _, h := range hashes {
+			in.Payload.Hashes = append(in.Payload.Hashes, hex.EncodeToString(h))
+		}
+		return err
+
+	case "message":
+		m := new(core.Message)
+		if err := m.UnmarshalBinary(data); err != nil {
+			return err
+		}
+		in.Message = &messageInfo{Identifier: m.Identifier, Name: core.MessageName(m.Identifier), Options: hex.EncodeToString(m.Options), DataSize: len(m.Data)}
+
+		// Data is the last field of a message
+		start := len(data) - len(m.Data)
+		var err error
+		if kind, ok := messageTypes[m.Identifier]; ok {
+			err = inspectObject(kind, m.Data, in)
+		}
+
+		var decodeErr *core.DecodeError
+		if errors.As(err, &decodeErr) {
+			return &core.DecodeError{Offset: start + decodeErr.Offset, Field: "message data: " + decodeErr.Field, Err: decodeErr.Err}
+		}
+		return err
+	}
+
+	return nil
+}
+
+func transactionInfos(txs core.TransactionSlice) []core.TransactionInfo {
+
+	infos := []core.TransactionInfo{}
+	for i := range txs {
+		infos = append(infos, core.NewTransactionInfo(&txs[i], -1))
+	}
+	return infos
+}
+
+func newPBFTVoteInfo(v *core.PBFTVote) pbftVoteInfo {
+
+	return pbftVoteInfo{Phase: core.MessageName(v.Phase), View: v.View, Height: v.Height, Digest: hex.EncodeToString(v.Digest), Validator: v.Validator, Scheme: core.SignatureSchemeName(v.Scheme), Signature: string(v.Signature)}
+}
+
+func newPBFTInfo(m *core.PBFTMessage) *pbftInfo {
+
+	info := &pbftInfo{Vote: newPBFTVoteInfo(&m.Vote)}
+	for i := range m.Certificate {
+		info.Certificate = append(info.Certificate, newPBFTVoteInfo(&m.Certificate[i]))
+	}
+	for i := range m.ViewChanges {
+		info.ViewChanges = append(info.ViewChanges, *newPBFTInfo(&m.ViewChanges[i]))
+	}
+	return info
+}
+
+func newDecodeFailure(data []byte, err error) *decodeFailure {
+
+	f := &decodeFailure{Offset: len(data), Reason: err.Error()}
+
+	var decodeErr *core.DecodeError
+	if errors.As(err, &decodeErr) {
+		f.Offset, f.Field, f.Reason = decodeErr.Offset, decodeErr.Field, decodeErr.Err.Error()
+	}
+	f.Context = hexContext(data, f.Offset)
+
+	return f
+}
+
+// hexContext dumps the 16 byte rows around offset, marking the failing byte
+func hexContext(data []byte, offset int) string {
+
+	row := offset / 16 * 16
+	from, to := row-32, row+48
+	if from < 0 {
+		from = 0
+	}
+	if to > len(data) {
+		to = len(data)
+	}
+
+	var b strings.Builder
+	for r := from; r < to; r += 16 {
+		fmt.Fprintf(&b, "%08x ", r)
+		for i := r; i < r+16 && i < to; i++ {
+			if i == offset {
+				fmt.Fprintf(&b, "[%02x]", data[i])
+			} else {
+				fmt.Fprintf(&b, " %02x ", data[i])
+			}
+		}
+		b.WriteString("\n")
+	}
+	if offset >= len(data) {
+		fmt.Fprintf(&b, "%08x [end of data]\n", len(data))
+	}
+
+	return b.String()
+}
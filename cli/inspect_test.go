@@ -0,0 +1,198 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"testing"
+
+	"tps-testing/core"
+)
+
+func inspectTestMessage() (*core.Transaction, []byte) {
+
+	tx := CreateTransactionTest("inspect")
+	m := core.NewMessage(core.MESSAGE_SEND_TRANSACTION)
+	m.Data, _ = tx.MarshalBinary()
+	data, _ := m.MarshalBinary()
+
+	return tx, data
+}
+
+func TestInspectMessage(t *testing.T) {
+
+	tx, data := inspectTestMessage()
+
+	in := inspectAuto(data, "raw")
+	if in.Type != "message" || in.Error != nil || in.Message.Name != "sendTransaction" {
+		t.Fatal("Message not decoded", in.Error)
+	}
+	if in.Transaction == nil || in.Transaction.Fee != tx.Header.Fee {
+		t.Error("Transaction in message not decoded")
+	}
+	for _, c := range in.Checks {
+		if !c.OK {
+			t.Error("Check failed", c)
+		}
+	}
+
+	in = &inspection{Type: "tx"}
+	inspect(data, in)
+	if in.Error == nil {
+		t.Error("Message decoded as a transaction")
+	}
+}
+
+func TestInspectFailures(t *testing.T) {
+
+	tx, data := inspectTestMessage()
+
+	// Break the signature, checks run but fail
+	tx.Signature[0] ^= 1
+	m := core.NewMessage(core.MESSAGE_SEND_TRANSACTION)
+	m.Data, _ = tx.MarshalBinary()
+	bad, _ := m.MarshalBinary()
+
+	in := &inspection{Type: "message"}
+	inspect(bad, in)
+	if in.Error != nil || in.Checks[2].Name != "signature" || in.Checks[2].OK {
+		t.Error("Bad signature not caught", in.Checks)
+	}
+
+	// Cut the payload short, the offset points into the whole message
+	m.Data = m.Data[:len(m.Data)-1]
+	bad, _ = m.MarshalBinary()
+
+	in = &inspection{Type: "message"}
+	inspect(bad, in)
+	if in.Error == nil || in.Error.Field != "message data: transaction payload" || in.Error.Offset <= len(bad)-len(m.Data) {
+		t.Fatal("Truncated transaction decoded", in.Error)
+	}
+	if in.Transaction == nil || in.Transaction.Fee != tx.Header.Fee {
+		t.Error("Header decoded before the failure not kept")
+	}
+
+	// A truncated message fails before its data
+	in = &inspection{Type: "message"}
+	inspect(data[:len(data)-1], in)
+	if in.Error == nil || in.Error.Field != "message data" {
+		t.Error("Truncated message decoded", in.Error)
+	}
+}
+
+func TestInspectEncodings(t *testing.T) {
+
+	_, data := inspectTestMessage()
+
+	for encoding, text := range map[string][]byte{
+		"hex":    []byte(hex.EncodeToString(data) + "\n"),
+		"base64": []byte(base64.StdEncoding.EncodeToString(data)),
+		"raw":    data,
+	} {
+		in := &inspection{Encoding: "auto"}
+		d, err := decodeInput(text, in)
+		if err != nil || in.Encoding != encoding || string(d) != string(data) {
+			t.Error("Wrong encoding detected", encoding, in.Encoding, err)
+		}
+	}
+}
+
+func TestInspectPayloads(t *testing.T) {
+
+	tx := CreateTransactionTest("inspect")
+	kp := core.GenerateNewKeypair()
+	b := core.NewBlock(nil)
+	b.AddTransaction(tx)
+
+	pm := &core.PBFTMessage{Vote: core.PBFTVote{Phase: core.MESSAGE_PBFT_PRE_PREPARE, View: 2, Height: 7, Digest: b.Hash()}, Block: &b}
+	pm.Vote.Sign(kp)
+	m := core.NewMessage(core.MESSAGE_PBFT_PRE_PREPARE)
+	m.Data, _ = pm.MarshalBinary()
+	data, _ := m.MarshalBinary()
+
+	in := &inspection{Type: "message"}
+	inspect(data, in)
+	if in.Error != nil || in.PBFT == nil || in.PBFT.Vote.Phase != "pbftPrePrepare" || in.PBFT.Vote.View != 2 || in.Block == nil || in.Block.TxCount != 1 {
+		t.Error("Consensus message not decoded", in.Error, in.PBFT)
+	}
+	in = &inspection{Type: "pbft"}
+	inspect(m.Data, in)
+	if in.Error != nil || in.PBFT == nil || in.PBFT.Vote.Height != 7 {
+		t.Error("Consensus payload not decoded", in.Error)
+	}
+}
+
+func TestInspectCompactBlockPayloads(t *testing.T) {
+
+	tx := CreateTransactionTest("inspect")
+	kp := core.GenerateNewKeypair()
+	b := core.NewBlock(nil)
+	b.AddTransaction(tx)
+	b.BlockHeader.Origin = kp.Public
+	b.BlockHeader.MerkelRoot = b.GenerateMerkelRoot()
+	b.Signature = b.Sign(kp)
+	blockPow = nil
+	defer func() { blockPow = core.BLOCK_POW }()
+
+	m := core.NewMessage(core.MESSAGE_SEND_COMPACT_BLOCK)
+	m.Data, _ = core.NewCompactBlock(&b).MarshalBinary()
+	data, _ := m.MarshalBinary()
+	in := &inspection{Type: "message"}
+	inspect(data, in)
+	if in.Error != nil || in.Block == nil || in.Block.TxCount != 1 || len(in.Payload.ShortIDs) != 1 || len(in.Checks) != 2 || !in.Checks[1].OK {
+		t.Error("Compact block not decoded", in.Error, in.Checks)
+	}
+
+	req := &core.BlockTransactionsRequest{Block: b.Hash(), Indexes: []int{0}}
+	data, _ = req.MarshalBinary()
+	in = &inspection{Type: "transactions-request"}
+	inspect(data, in)
+	if in.Error != nil || in.Payload.Block != hex.EncodeToString(b.Hash()) || len(in.Payload.Indexes) != 1 {
+		t.Error("Transactions request not decoded", in.Error)
+	}
+
+	bt := &core.BlockTransactions{Block: b.Hash(), Transactions: *b.TransactionSlice}
+	data, _ = bt.MarshalBinary()
+	in = &inspection{Type: "block-transactions"}
+	inspect(data, in)
+	if in.Error != nil || len(in.Payload.Transactions) != 1 || in.Payload.Transactions[0].Fee != tx.Header.Fee || !in.Checks[0].OK {
+		t.Error("Block transactions not decoded", in.Error, in.Checks)
+	}
+}
+
+func TestInspectInventory(t *testing.T) {
+
+	tx := CreateTransactionTest("inspect")
+	m := core.NewMessage(core.MESSAGE_GET_DATA)
+	m.Data, _ = core.InventoryHashes{tx.Hash()}.MarshalBinary()
+	data, _ := m.MarshalBinary()
+
+	in := &inspection{Type: "message"}
+	inspect(data, in)
+	if in.Error != nil || in.Message.Name != "getData" || len(in.Payload.Hashes) != 1 || in.Payload.Hashes[0] != hex.EncodeToString(tx.Hash()) {
+		t.Error("Get data not decoded", in.Error)
+	}
+
+	in = &inspection{Type: "inventory"}
+	inspect(m.Data[:len(m.Data)-1], in)
+	if in.Error == nil {
+		t.Error("Truncated inventory decoded")
+	}
+}
+
+func TestInspectTransactions(t *testing.T) {
+
+	a, b := CreateTransactionTest("first"), CreateTransactionTest("second")
+	b.Signature[0] ^= 1
+	m := core.NewMessage(core.MESSAGE_SEND_TRANSACTIONS)
+	m.Data, _ = (&core.TransactionSlice{*a, *b}).MarshalBinary()
+	data, _ := m.MarshalBinary()
+
+	in := &inspection{Type: "message"}
+	inspect(data, in)
+	if in.Error != nil || len(in.Payload.Transactions) != 2 || in.Payload.Transactions[1].Fee != b.Header.Fee {
+		t.Fatal("Transactions not decoded", in.Error)
+	}
+	if len(in.Checks) != 1 || in.Checks[0].OK {
+		t.Error("Forged transaction in the batch not caught", in.Checks)
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"tps-testing/core"
+)
+
+func runKeygen(args []string) error {
+
+	fs := newFlagSet("keygen", "[flags]", "Creates the encrypted keys of a node, or of every node of a local cluster with -n,\nand shows the identity kept in a data directory with -show. The passphrase is\nread from "+core.KEYSTORE_PASSPHRASE_ENV+" or prompted for.")
+	dataDir := fs.String("datadir", "", "data directory of the node, or the one to create the cluster nodes in with -n (default ~/.blockchain)")
+	scheme := fs.String("scheme", "p256", "signature scheme of the keys (p256, ed25519)")
+	n := fs.Int("n", 0, "create identities for a local cluster of n nodes, node<i> listening in -ip port plus i")
+	address := fs.String("ip", fmt.Sprintf("%s:%s", "127.0.0.1", core.BLOCKCHAIN_PORT), "address of the first cluster node")
+	show := fs.Bool("show", false, "print the identity in -datadir instead of creating one")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if *show {
+		keypair, err := core.OpenConfiguration(*dataDir)
+		if err != nil {
+			return err
+		}
+		if keypair == nil {
+			return fmt.Errorf("No keys in %s", core.DataDirectory(*dataDir))
+		}
+		fmt.Printf("%s %s\n", core.SignatureSchemeName(keypair.Scheme()), keypair.Public)
+		return nil
+	}
+
+	s, err := core.ParseSignatureScheme(*scheme)
+	if err != nil {
+		return err
+	}
+
+	if *n > 0 {
+		return createIdentities(*dataDir, *address, *n, s)
+	}
+
+	dir := core.DataDirectory(*dataDir)
+	if _, err := os.Stat(filepath.Join(dir, core.BLOCKHAIN_KEYS_FILENAME)); err == nil {
+		return fmt.Errorf("%s already has keys", dir)
+	}
+
+	keypair, err := core.GenerateKeypair(s)
+	if err != nil {
+		return err
+	}
+	if err := core.WriteConfiguration(dir, keypair); err != nil {
+		return err
+	}
+
+	fmt.Printf("%s %s\n", core.SignatureSchemeName(keypair.Scheme()), keypair.Public)
+	return nil
+}
+
+// createIdentities gives node i of the cluster the port of address plus i
+func createIdentities(dataDir, address string, n int, scheme byte) error {
+
+	if dataDir == "" {
+		return fmt.Errorf("-n needs a -datadir to create the nodes in")
+	}
+
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	first, err := strconv.Atoi(port)
+	if err != nil {
+		return err
+	}
+
+	addresses := make([]string, n)
+	for i := range addresses {
+		addresses[i] = net.JoinHostPort(host, strconv.Itoa(first+i))
+	}
+
+	dirs, err := core.CreateIdentities(dataDir, addresses, scheme)
+	if err != nil {
+		return err
+	}
+	for i, d := range dirs {
+		fmt.Printf("-ip %s -datadir %s\n", addresses[i], d)
+	}
+
+	return nil
+}
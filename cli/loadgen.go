@@ -0,0 +1,113 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"tps-testing/core"
+)
+
+var loadScheme byte
+
+func runLoadgen(args []string) error {
+
+	fs := newFlagSet("loadgen", "[flags]", "Signs transactions with throwaway keys and submits them to a node over JSON-RPC.")
+	target := fs.String("target", fmt.Sprintf("http://127.0.0.1:%s", core.RPC_PORT), "JSON-RPC endpoint of the node")
+	scheme := fs.String("scheme", "p256", "signature scheme of generated transactions (p256, ed25519)")
+	count := fs.Int("count", 0, "transactions to submit, 0 for no limit")
+	rate := fs.Int("rate", 0, "transactions per second, 0 for as fast as possible")
+	workers := fs.Int("workers", 4, "concurrent submitters")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	var err error
+	if loadScheme, err = core.ParseSignatureScheme(*scheme); err != nil {
+		return err
+	}
+	if *workers < 1 {
+		return fmt.Errorf("-workers must be at least 1")
+	}
+
+	// Every transaction is unique, the mempool drops duplicates
+	txs := make(chan *core.Transaction, *workers)
+	go func() {
+		var tick <-chan time.Time
+		if *rate > 0 {
+			tick = time.Tick(time.Second / time.Duration(*rate))
+		}
+		for i := 0; *count == 0 || i < *count; i++ {
+			if tick != nil {
+				<-tick
+			}
+			txs <- CreateTransactionTest(fmt.Sprintf("%d-0.0001BTC", i))
+		}
+		close(txs)
+	}()
+
+	var accepted, rejected, failed uint64
+	var wg sync.WaitGroup
+	for w := 0; w < *workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			client := core.NewRPCClient(*target)
+			for tx := range txs {
+				data, _ := tx.MarshalBinary()
+				_, err := client.Call("submitTransaction", map[string]string{"transaction": hex.EncodeToString(data)}, nil)
+				if err == nil {
+					atomic.AddUint64(&accepted, 1)
+				} else if rpcErr, ok := err.(*core.RPCError); ok && rpcErr.Code == core.RPC_REJECTED {
+					atomic.AddUint64(&rejected, 1)
+				} else {
+					if atomic.AddUint64(&failed, 1) == 1 {
+						fmt.Println("Submitting to", *target, "failed:", err)
+					}
+				}
+			}
+		}()
+	}
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	start := time.Now()
+	report := func() {
+		a := atomic.LoadUint64(&accepted)
+		fmt.Printf("accepted=%d rejected=%d failed=%d tps=%.2f\n", a, atomic.LoadUint64(&rejected), atomic.LoadUint64(&failed), float64(a)/time.Since(start).Seconds())
+	}
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			report()
+		case <-done:
+			report()
+			return nil
+		}
+	}
+}
+
+func CreateTransactionTest(txt string) *core.Transaction {
+	fromKey, _ := core.GenerateKeypair(loadScheme)
+	toKey, _ := core.GenerateKeypair(loadScheme)
+
+	tx := core.NewTransaction(fromKey.Public, toKey.Public, []byte(txt))
+	tx.Header.Scheme = loadScheme
+	// Random multiple of the minimum relay fee to exercise fee ordering
+	tx.Header.Fee = tx.MinRelayFee() * uint64(1+rand.Intn(10))
+	tx.Header.Nonce = tx.GenerateNonce(core.TRANSACTION_POW)
+
+	tx.Signature = tx.Sign(fromKey)
+
+	return tx
+}
@@ -1,102 +1,82 @@
 package main
 
 import (
-	"bufio"
 	"flag"
 	"fmt"
-	//_ "net/http/pprof"
 	"os"
-	"os/signal"
-	"syscall"
-	"time"
-
-	"tps-testing/core"
+	"sort"
 )
 
-//var address = flag.String("ip", fmt.Sprintf("%s:%s", core.GetIpAddress()[0], core.BLOCKCHAIN_PORT), "")
-var address = flag.String("ip", fmt.Sprintf("%s:%s", "127.0.0.1", core.BLOCKCHAIN_PORT), "")
-
+type command struct {
+	summary string
+	run     func(args []string) error
+}
 
-func init() {
-	flag.Parse()
+var commands = map[string]command{
+	"node":    {"run a blockchain node", runNode},
+	"loadgen": {"submit generated transactions to a node", runLoadgen},
+	"keygen":  {"create and show node identities", runKeygen},
+	"inspect": {"decode transactions, blocks and messages", runInspect},
 }
 
 func main() {
 
-	core.Start(*address)
-	//ReadStdin
-	/*
-		for {
-			str := <-ReadStdin()
-			core.Core.Blockchain.TransactionsQueue <- core.CreateTransaction(str)
-		}
-	*/
-	tx := CreateTransactionTest("0.0001BTC")
-	// if tx.VerifyTransaction(core.TRANSACTION_POW){
-	// 	fmt.Println("Sig verify success!")
-	// }
-	go func() {
-		for {
-			for i := 0; i < core.TXPOOL_SIZE; i++ {
-				core.Core.Blockchain.TransactionsQueue <- tx
+	if len(os.Args) < 2 {
+		usage()
+		os.Exit(2)
+	}
+
+	name := os.Args[1]
+	if name == "help" || name == "-h" || name == "-help" || name == "--help" {
+		if len(os.Args) > 2 {
+			if c, ok := commands[os.Args[2]]; ok {
+				c.run([]string{"-h"})
+				return
 			}
-			fmt.Printf(".................................................pre-generating %d transactions........................................\n", core.TXPOOL_SIZE)
-			time.Sleep(time.Second * 1)
 		}
-	}()
-	//http.ListenAndServe("0.0.0.0:6060", nil)
-	// Setup signal handler to dump report on exit
-	sig := make(chan os.Signal, 1)
-	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
-	go func() {
-		<-sig
-		fmt.Println("Received interrupt; dumping TPS report and exiting...")
-		core.DumpReport()
-		os.Exit(0)
-	}()
-	for {
-		<-ReadStdin()
+		usage()
+		return
 	}
-	// N := 500
-	// txCh := RandomNTx(N)
-	// for i := 0; i < N; i++ {
-	// 	//time.Sleep(time.Microsecond * 30)
-	// 	time.Sleep(time.Second * 1)
-	// 	core.Core.Blockchain.TransactionsQueue <- <-txCh
-	// }
-	core.Wg.Wait()
-}
 
-func ReadStdin() chan string {
-
-	cb := make(chan string)
-	sc := bufio.NewScanner(os.Stdin)
+	c, ok := commands[name]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "Unknown command %q\n\n", name)
+		usage()
+		os.Exit(2)
+	}
 
-	go func() {
-		if sc.Scan() {
-			cb <- sc.Text()
+	if err := c.run(os.Args[2:]); err != nil {
+		if err != flag.ErrHelp {
+			fmt.Fprintln(os.Stderr, err)
 		}
-	}()
-
-	return cb
+		os.Exit(1)
+	}
 }
 
-func RandomNTx(N int) chan *core.Transaction {
-	txCh := make(chan *core.Transaction, N)
-	for i := 0; i < N; i++ {
-		signedTx := CreateTransactionTest("0.00001BTC")
-		txCh <- signedTx
+func usage() {
+
+	fmt.Fprintf(os.Stderr, "usage: %s <command> [flags]\n\ncommands:\n", os.Args[0])
+
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(os.Stderr, "  %-8s %s\n", name, commands[name].summary)
 	}
-	return txCh
-}
 
-func CreateTransactionTest(txt string) *core.Transaction {
-	fromKey, toKey := core.GenerateNewKeypair(), core.GenerateNewKeypair()
+	fmt.Fprintf(os.Stderr, "\nRun '%s help <command>' for its flags.\n", os.Args[0])
+}
 
-	tx := core.NewTransaction(fromKey.Public, toKey.Public, []byte(txt))
-	tx.Header.Nonce = tx.GenerateNonce(core.TRANSACTION_POW)
+// newFlagSet returns flags for a command, printing description and defaults on -h
+func newFlagSet(name, args, description string) *flag.FlagSet {
 
-	tx.Signature = tx.Sign(fromKey)
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: %s %s %s\n\n%s\n\nflags:\n", os.Args[0], name, args, description)
+		fs.PrintDefaults()
+	}
 
-	return tx
+	return fs
 }
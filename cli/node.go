@@ -0,0 +1,45 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"tps-testing/core"
+)
+
+func runNode(args []string) error {
+
+	fs := newFlagSet("node", "[flags]", "Runs a node, transactions come from peers and the JSON-RPC server.")
+	address := fs.String("ip", fmt.Sprintf("%s:%s", "127.0.0.1", core.BLOCKCHAIN_PORT), "address to listen for peers in")
+	rpcAddress := fs.String("rpc", fmt.Sprintf("%s:%s", "127.0.0.1", core.RPC_PORT), "JSON-RPC listen address, empty to disable")
+	dataDir := fs.String("datadir", "", "directory holding the node keys, blocks, peers and reports (default ~/.blockchain)")
+	consensus := fs.String("consensus", core.CONSENSUS_POW, "block production: pow, poa taking turns between the validators in <datadir>/"+core.BLOCKCHAIN_VALIDATORS_FILENAME+", or pbft agreeing on every block with them")
+	fanout := fs.Int("fanout", core.GOSSIP_FANOUT, "peers each broadcast is sent to, 0 floods every peer")
+	ttl := fs.Int("ttl", core.GOSSIP_TTL, "hops a broadcast travels, relaying stops at 1")
+	plaintext := fs.Bool("plaintext", false, "authenticate peers but send frames unencrypted, to measure what encryption costs; all nodes must agree")
+	chainID := fs.Uint("chainid", core.DEFAULT_CHAIN_ID, "chain the node is on, peers on other chains are rejected")
+	pushTxs := fs.Bool("pushtxs", false, "gossip transactions whole instead of announcing their hashes, to compare the bandwidth")
+	compress := fs.Bool("compress", false, "deflate large frames to peers that compress too, see getPeers for the ratio and time")
+	singleTxs := fs.Bool("singletxs", false, "send every transaction in a message of its own instead of batching them")
+	fullBlocks := fs.Bool("fullblocks", false, "send blocks whole instead of as short transaction IDs, to compare the bandwidth")
+	faults := fs.String("faults", "", "JSON scenario of latency, jitter, loss, bandwidth and partitions to inject into the traffic to peers")
+	rateLimits := fs.String("ratelimits", "", "JSON limits in messages and bytes per second on what each peer sends, in all and by message type")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	core.Start(core.Config{Address: *address, DataDir: *dataDir, Consensus: *consensus, Fanout: *fanout, TTL: *ttl, Faults: *faults, Plaintext: *plaintext, ChainID: uint32(*chainID), FullBlocks: *fullBlocks, PushTxs: *pushTxs, SingleTxs: *singleTxs, Compress: *compress, RateLimits: *rateLimits})
+	if *rpcAddress != "" {
+		core.Core.RPC = core.StartRPC(*rpcAddress)
+	}
+
+	// Dump the report on exit
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	<-sig
+
+	fmt.Println("Received interrupt; dumping TPS report and exiting...")
+	return core.DumpReport()
+}
@@ -0,0 +1,232 @@
+package core
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"path"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+)
+
+const BLOCKCHAIN_BANS_FILENAME = "bans.json"
+
+type Ban struct {
+	Address string    `json:"address"`
+	ID      string    `json:"id,omitempty"` // public key the peer authenticated with, when it did
+	Until   time.Time `json:"until"`
+	Reason  string    `json:"reason"`
+}
+
+// PeerScores adds up the penalties of misbehaving peers over PEER_SCORE_WINDOW
+// and bans the ones reaching PEER_BAN_SCORE. Peers are told apart by host,
+// except on loopback where the nodes of a local cluster share one, and by
+// the public key they authenticated with, which they can't claim another
+// port to get away from.
+type PeerScores struct {
+	Dir string // bans are saved in, not saved when empty
+
+	lock   sync.Mutex
+	scores map[string]*peerScore // by address key and by public key
+	bans   map[string]Ban        // by address key
+	ids    map[string]string     // address key of the ban of each public key
+}
+
+type peerScore struct {
+	score int
+	since time.Time
+}
+
+// NewPeerScores starts with the bans saved in dir that haven't expired
+func NewPeerScores(dir string) (*PeerScores, error) {
+
+	s := &PeerScores{Dir: dir, scores: map[string]*peerScore{}, bans: map[string]Ban{}, ids: map[string]string{}}
+	if dir == "" {
+		return s, nil
+	}
+
+	bans, err := LoadBans(dir)
+	for _, b := range bans {
+		if time.Now().Before(b.Until) {
+			s.ban(b)
+		}
+	}
+	return s, err
+}
+
+// Penalize adds penalty to the score of the peer at address with public key
+// id, empty before it authenticated, true when that got it banned
+func (s *PeerScores) Penalize(address, id string, penalty int, reason string) bool {
+
+	key := peerKey(address)
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	score := 0
+	for _, k := range scoreKeys(key, id) {
+		ps := s.scores[k]
+		if ps == nil || time.Since(ps.since) > time.Second*PEER_SCORE_WINDOW {
+			ps = &peerScore{since: time.Now()}
+			s.scores[k] = ps
+		}
+		ps.score += penalty
+		score = max(score, ps.score)
+	}
+	fmt.Printf("Peer %s misbehaved (%s), score %d\n", address, reason, score)
+
+	if score < PEER_BAN_SCORE {
+		return false
+	}
+
+	for _, k := range scoreKeys(key, id) {
+		delete(s.scores, k)
+	}
+	s.ban(Ban{Address: key, ID: id, Until: time.Now().Add(time.Second * PEER_BAN_DURATION), Reason: reason})
+	fmt.Printf("Banned peer %s until %s\n", key, s.bans[key].Until.Format(time.RFC3339))
+
+	if s.Dir != "" {
+		logOnError(SaveBans(s.Dir, s.list()))
+	}
+	return true
+}
+
+func (s *PeerScores) ban(b Ban) {
+
+	s.bans[b.Address] = b
+	if b.ID != "" {
+		s.ids[b.ID] = b.Address
+	}
+}
+
+// Banned tells if the peer at address or with public key id is banned, id
+// is empty before the peer authenticated
+func (s *PeerScores) Banned(address, id string) bool {
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	keys := []string{peerKey(address)}
+	if k, ok := s.ids[id]; ok && id != "" {
+		keys = append(keys, k)
+	}
+	for _, key := range keys {
+		b, ok := s.bans[key]
+		if ok && time.Now().After(b.Until) {
+			delete(s.bans, key)
+			if s.ids[b.ID] == key {
+				delete(s.ids, b.ID)
+			}
+			continue
+		}
+		if ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Score is the highest of the scores of the peer's address and public key
+func (s *PeerScores) Score(address, id string) int {
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	score := 0
+	for _, k := range scoreKeys(peerKey(address), id) {
+		if ps := s.scores[k]; ps != nil && time.Since(ps.since) <= time.Second*PEER_SCORE_WINDOW {
+			score = max(score, ps.score)
+		}
+	}
+	return score
+}
+
+// scoreKeys are the keys a peer is scored under, its public key once it authenticated
+func scoreKeys(key, id string) []string {
+
+	if id == "" {
+		return []string{key}
+	}
+	return []string{key, id}
+}
+
+// Bans lists the bans in force, the ones ending first go first
+func (s *PeerScores) Bans() []Ban {
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.list()
+}
+
+func (s *PeerScores) list() []Ban {
+
+	bans := []Ban{}
+	for _, b := range s.bans {
+		if time.Now().Before(b.Until) {
+			bans = append(bans, b)
+		}
+	}
+	sort.Slice(bans, func(i, j int) bool { return bans[i].Until.Before(bans[j].Until) })
+
+	return bans
+}
+
+// peerKey is what bans and scores apply to
+func peerKey(address string) string {
+
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return address
+	}
+	if ip := net.ParseIP(host); ip != nil && ip.IsLoopback() {
+		return address
+	}
+	return host
+}
+
+// checksPenalty is the penalty for the failed checks of a transaction or
+// block, forged signatures costing more than penalty
+func checksPenalty(failed []string, penalty int) int {
+
+	if slices.Contains(failed, "signature") {
+		return PEER_PENALTY_INVALID_SIGNATURE
+	}
+	return penalty
+}
+
+func LoadBans(dir string) ([]Ban, error) {
+
+	data, err := os.ReadFile(path.Join(dir, BLOCKCHAIN_BANS_FILENAME))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	bans := []Ban{}
+	return bans, json.Unmarshal(data, &bans)
+}
+
+func SaveBans(dir string, bans []Ban) error {
+
+	data, err := json.MarshalIndent(bans, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+
+	file := path.Join(dir, BLOCKCHAIN_BANS_FILENAME)
+	if err := os.WriteFile(file+".tmp", data, 0600); err != nil {
+		return err
+	}
+
+	return os.Rename(file+".tmp", file)
+}
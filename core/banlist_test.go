@@ -0,0 +1,116 @@
+package core
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestPeerScoresBan(t *testing.T) {
+
+	dir := t.TempDir()
+	s, err := NewPeerScores(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 3; i++ {
+		if s.Penalize("10.0.0.1:1992", "", PEER_PENALTY_MALFORMED, "undecodable message") {
+			t.Fatal("Banned before reaching the score")
+		}
+	}
+	if s.Score("10.0.0.1:40000", "") != 3*PEER_PENALTY_MALFORMED {
+		t.Error("Score not kept by host", s.Score("10.0.0.1:40000", ""))
+	}
+	if !s.Penalize("10.0.0.1:1992", "", PEER_PENALTY_MALFORMED, "undecodable message") {
+		t.Fatal("Not banned on reaching the score")
+	}
+	if !s.Banned("10.0.0.1:5555", "") || s.Banned("10.0.0.2:1992", "") || s.Score("10.0.0.1:1992", "") != 0 {
+		t.Error("Ban not applied to the host only")
+	}
+
+	// Nodes of a local cluster share the loopback address
+	s.Penalize("127.0.0.1:19921", "", PEER_BAN_SCORE, "bad block")
+	if !s.Banned("127.0.0.1:19921", "") || s.Banned("127.0.0.1:19922", "") {
+		t.Error("Loopback peers not told apart by port")
+	}
+
+	// Nor by the port they claim, once they authenticated
+	s.Penalize("127.0.0.1:19923", "key", PEER_BAN_SCORE, "bad block")
+	if !s.Banned("127.0.0.1:19924", "key") || s.Banned("127.0.0.1:19924", "other key") {
+		t.Error("Peer got away from its ban on another port")
+	}
+
+	// Bans survive a restart
+	reloaded, err := NewPeerScores(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bans := reloaded.Bans()
+	if len(bans) != 3 || !reloaded.Banned("10.0.0.1:1992", "") || !reloaded.Banned("127.0.0.1:19925", "key") || bans[1].Reason != "bad block" {
+		t.Error("Bans not saved", bans)
+	}
+}
+
+func TestPeerScoresExpire(t *testing.T) {
+
+	dir := t.TempDir()
+	SaveBans(dir, []Ban{
+		{Address: "10.0.0.1", Until: time.Now().Add(-time.Minute), Reason: "old"},
+		{Address: "10.0.0.2", Until: time.Now().Add(time.Minute), Reason: "new"},
+	})
+
+	s, _ := NewPeerScores(dir)
+	if s.Banned("10.0.0.1:1992", "") || !s.Banned("10.0.0.2:1992", "") || len(s.Bans()) != 1 {
+		t.Error("Expired ban still in force", s.Bans())
+	}
+
+	if checksPenalty([]string{"proof of work", "signature"}, PEER_PENALTY_INVALID_TRANSACTION) != PEER_PENALTY_INVALID_SIGNATURE {
+		t.Error("Forged signature not penalized as such")
+	}
+}
+
+func TestMalformedMessagesBanPeer(t *testing.T) {
+
+	Core.Network = SetupNetwork("127.0.0.1:0", BLOCKCHAIN_PORT)
+
+	l, err := net.ListenTCP("tcp4", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	client, err := net.DialTCP("tcp4", nil, l.Addr().(*net.TCPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	server, err := l.AcceptTCP()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !Core.Nodes.AddNode(&Node{TCPConn: server, lastSeen: int(time.Now().Unix()), inbound: true}) {
+		t.Fatal("Node not added")
+	}
+
+	// Frames that arrive whole but aren't messages
+	for i := 0; i < PEER_BAN_SCORE/PEER_PENALTY_MALFORMED; i++ {
+		WriteFrame(client, []byte{CODEC_VERSION, MESSAGE_SEND_TRANSACTION, 0xff})
+	}
+
+	deadline := time.Now().Add(time.Second * 5)
+	for len(Core.Network.Peers()) != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("Peer not disconnected", Core.Network.Peers())
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+
+	if !Core.Network.Scores.Banned(client.LocalAddr().String(), "") {
+		t.Error("Peer not banned")
+	}
+	if Core.Nodes.AddNode(&Node{TCPConn: server, lastSeen: int(time.Now().Unix()), inbound: true}) {
+		t.Error("Banned peer added again")
+	}
+}
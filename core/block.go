@@ -1,8 +1,6 @@
 package core
 
 import (
-	"bytes"
-	"encoding/binary"
 	"reflect"
 
 	"github.com/izqui/functional"
@@ -47,6 +45,7 @@ type BlockHeader struct {
 	MerkelRoot []byte
 	Timestamp  uint32
 	Nonce      uint32
+	Scheme     byte
 }
 
 func NewBlock(previousBlock []byte) Block {
@@ -61,9 +60,9 @@ func (b *Block) AddTransaction(t *Transaction) {
 	b.TransactionSlice = &newSlice
 }
 
-func (b *Block) Sign(keypair *Keypair) []byte {
+func (b *Block) Sign(signer Signer) []byte {
 
-	s, _ := keypair.Sign(b.Hash())
+	s, _ := signer.Sign(b.Hash())
 	return s
 }
 
@@ -72,7 +71,7 @@ func (b *Block) VerifyBlock(prefix []byte) bool {
 	headerHash := b.Hash()
 	merkel := b.GenerateMerkelRoot()
 
-	return reflect.DeepEqual(merkel, b.BlockHeader.MerkelRoot) && CheckProofOfWork(prefix, headerHash) && SignatureVerify(b.BlockHeader.Origin, b.Signature, headerHash)
+	return reflect.DeepEqual(merkel, b.BlockHeader.MerkelRoot) && CheckProofOfWork(prefix, headerHash) && VerifySignature(b.BlockHeader.Scheme, b.BlockHeader.Origin, b.Signature, headerHash)
 }
 
 func (b *Block) Hash() []byte {
@@ -121,67 +120,75 @@ func (b *Block) GenerateMerkelRoot() []byte {
 		}
 	}
 
+	// No transactions hash to the zero hash, which is how an empty root is marshalled
+	if b.TransactionSlice.Len() == 0 {
+		return make([]byte, HASH_SIZE)
+	}
+
 	ts := functional.Map(func(t Transaction) []byte { return t.Hash() }, []Transaction(*b.TransactionSlice)).([][]byte)
 	return merkell(ts)
 
 }
 func (b *Block) MarshalBinary() ([]byte, error) {
 
-	bhb, err := b.BlockHeader.MarshalBinary()
-	if err != nil {
-		return nil, err
-	}
-	sig := helpers.FitBytesInto(b.Signature, NETWORK_KEY_SIZE)
-	tsb, err := b.TransactionSlice.MarshalBinary()
-	if err != nil {
-		return nil, err
-	}
+	e := NewEncoder()
+	e.Byte(CODEC_VERSION)
+	b.BlockHeader.encode(e)
+	e.Bytes(b.Signature)
+	b.TransactionSlice.encode(e)
 
-	return append(append(bhb, sig...), tsb...), nil
+	return e.Result()
 }
 
 func (b *Block) UnmarshalBinary(d []byte) error {
-	buf := bytes.NewBuffer(d)
 
-	header := new(BlockHeader)
-	err := header.UnmarshalBinary(buf.Next(BLOCK_HEADER_SIZE))
-	if err != nil {
-		return err
-	}
+	dec := NewDecoder(d)
+	dec.Version("block version")
 
+	header := new(BlockHeader)
+	header.decode(dec)
 	b.BlockHeader = header
-	b.Signature = buf.Next(NETWORK_KEY_SIZE)
+	b.Signature = dec.Bytes("block signature", NETWORK_KEY_SIZE)
 
 	ts := new(TransactionSlice)
-	err = ts.UnmarshalBinary(buf.Next(helpers.MaxInt))
-	if err != nil {
-		return err
-	}
-
+	ts.decode(dec)
 	b.TransactionSlice = ts
 
-	return nil
+	return dec.Finish("block")
 }
 
 func (h *BlockHeader) MarshalBinary() ([]byte, error) {
 
-	buf := new(bytes.Buffer)
+	e := NewEncoder()
+	h.encode(e)
 
-	buf.Write(helpers.FitBytesInto(h.Origin, NETWORK_KEY_SIZE))
-	binary.Write(buf, binary.LittleEndian, h.Timestamp)
-	buf.Write(helpers.FitBytesInto(h.PrevBlock, 32))
-	buf.Write(helpers.FitBytesInto(h.MerkelRoot, 32))
-	binary.Write(buf, binary.LittleEndian, h.Nonce)
-
-	return buf.Bytes(), nil
+	return e.Result()
 }
 
 func (h *BlockHeader) UnmarshalBinary(d []byte) error {
-	buf := bytes.NewBuffer(d)
-	h.Origin = helpers.StripByte(buf.Next(NETWORK_KEY_SIZE), 0) // Strip leading zeros
-	binary.Read(bytes.NewBuffer(buf.Next(4)), binary.LittleEndian, &h.Timestamp)
-	h.PrevBlock = helpers.StripByte(buf.Next(32), 0) // Strip leading zeros
-	h.MerkelRoot = helpers.StripByte(buf.Next(32), 0) // Strip leading zeros
-	binary.Read(bytes.NewBuffer(buf.Next(4)), binary.LittleEndian, &h.Nonce)
-	return nil
+
+	dec := NewDecoder(d)
+	h.decode(dec)
+
+	return dec.Finish("block header")
+}
+
+func (h *BlockHeader) encode(e *Encoder) {
+
+	e.Bytes(h.Origin)
+	e.Uint32(h.Timestamp)
+	e.Fixed("prev block hash", h.PrevBlock, HASH_SIZE)
+	e.Fixed("merkel root", h.MerkelRoot, HASH_SIZE)
+	e.Uint32(h.Nonce)
+	e.Byte(h.Scheme)
+}
+
+func (h *BlockHeader) decode(d *Decoder) {
+
+	h.Origin = d.Bytes("block origin", NETWORK_KEY_SIZE)
+	h.Timestamp = d.Uint32("block timestamp")
+	h.PrevBlock = d.Fixed("block prev block hash", HASH_SIZE)
+	h.MerkelRoot = d.Fixed("block merkel root", HASH_SIZE)
+	h.Nonce = d.Uint32("block nonce")
+	h.Scheme = d.Byte("block scheme")
 }
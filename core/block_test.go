@@ -33,7 +33,7 @@ func TestBlockMarshalling(t *testing.T) {
 	tr.Signature = tr.Sign(kp)
 
 	// Create a block with the transaction
-	block := NewBlock([]byte("previous block hash"))
+	block := NewBlock(helpers.SHA256([]byte("previous block hash")))
 	block.AddTransaction(tr)
 	block.BlockHeader.Origin = kp.Public
 	block.BlockHeader.MerkelRoot = block.GenerateMerkelRoot()
@@ -65,13 +65,8 @@ func TestBlockMarshalling(t *testing.T) {
 	t.Logf("Original origin len: %d, origin: %v", len(block.BlockHeader.Origin), block.BlockHeader.Origin)
 	t.Logf("Unmarshalled origin len: %d, origin: %v", len(newBlock.BlockHeader.Origin), newBlock.BlockHeader.Origin)
 
-	// Check individual fields since signature might be padded and fields might have leading zeros stripped
-	originalHeader := *block.BlockHeader
-	originalHeader.PrevBlock = helpers.StripByte(originalHeader.PrevBlock, 0)
-	originalHeader.MerkelRoot = helpers.StripByte(originalHeader.MerkelRoot, 0)
-	
-	if !reflect.DeepEqual(*newBlock.BlockHeader, originalHeader) {
-		t.Errorf("Block headers don't match: original=%v, unmarshalled=%v", originalHeader, newBlock.BlockHeader)
+	if !reflect.DeepEqual(*newBlock.BlockHeader, *block.BlockHeader) {
+		t.Errorf("Block headers don't match: original=%v, unmarshalled=%v", block.BlockHeader, newBlock.BlockHeader)
 	}
 
 	// Check transaction slice
@@ -83,10 +78,7 @@ func TestBlockMarshalling(t *testing.T) {
 		}
 	}
 
-	// Check signature - since it's padded to NETWORK_KEY_SIZE, we need to compare the relevant portion
-	sig1 := helpers.FitBytesInto(block.Signature, NETWORK_KEY_SIZE)
-	sig2 := helpers.FitBytesInto(newBlock.Signature, NETWORK_KEY_SIZE)
-	if !reflect.DeepEqual(sig1, sig2) {
+	if !reflect.DeepEqual(newBlock.Signature, block.Signature) {
 		t.Errorf("Signatures don't match")
 	}
 }
@@ -100,7 +92,7 @@ func TestBlockVerification(t *testing.T) {
 	tr.Header.Nonce = tr.GenerateNonce(helpers.ArrayOfBytes(TEST_TRANSACTION_POW_COMPLEXITY, TEST_POW_PREFIX))
 	tr.Signature = tr.Sign(kp)
 
-	block := NewBlock([]byte("previous block hash"))
+	block := NewBlock(helpers.SHA256([]byte("previous block hash")))
 	block.AddTransaction(tr)
 	block.BlockHeader.Origin = kp.Public
 	block.BlockHeader.MerkelRoot = block.GenerateMerkelRoot()
@@ -2,11 +2,13 @@ package core
 
 import (
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"reflect"
 	"sync"
 	"time"
 	"os"
+	"path"
 )
 
 type TransactionsQueue chan *Transaction
@@ -18,12 +20,59 @@ type Blockchain struct {
 
 	TransactionsQueue
 	BlocksQueue
+
+	Mempool *Mempool
+	Store   *BlockStore // nil keeps the chain in memory only
+	Relay   *CompactRelay
+
+	Consensus  Consensus
+	acceptLock sync.Mutex // one block at a time through validation and finalization
+
+	lock       sync.RWMutex
+	blockIndex map[string]int // block hash -> height
+	txIndex    map[string]int // transaction hash -> height of the block including it
 }
 
-var beginTime map[string]time.Time
+var (
+	ErrInvalidTransaction = errors.New("Invalid transaction")
+	ErrTxInChain          = errors.New("Transaction already in a block")
+)
+
+var beginTime = startTimes{times: map[string]time.Time{}}
 var validTxQueue chan *Transaction
 var Wg sync.WaitGroup
 
+const BLOCKCHAIN_REPORT_FILENAME = "tps_report.log"
+
+// ReportFile is where the TPS report of this node is written
+func ReportFile() string {
+
+	return path.Join(Core.DataDir, BLOCKCHAIN_REPORT_FILENAME)
+}
+
+// startTimes are when our transactions and blocks were made, read by the message handlers
+type startTimes struct {
+	lock  sync.Mutex
+	times map[string]time.Time
+}
+
+func (s *startTimes) set(hash string, t time.Time) {
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.times[hash] = t
+}
+
+func (s *startTimes) get(hash string) (time.Time, bool) {
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	t, ok := s.times[hash]
+	return t, ok
+}
+
 // Reporter holds running metrics accessible across the package
 var Reporter = struct {
 	TotalBlocks int
@@ -36,7 +85,6 @@ var Reporter = struct {
 }
 
 func init() {
-	beginTime = make(map[string]time.Time)
 	validTxQueue = make(chan *Transaction, TXPOOL_SIZE)
 	Wg.Add(4)
 }
@@ -45,8 +93,11 @@ func SetupBlockchan() *Blockchain {
 
 	bl := new(Blockchain)
 	bl.TransactionsQueue, bl.BlocksQueue = make(TransactionsQueue, TXPOOL_SIZE), make(BlocksQueue)
+	bl.Mempool = NewMempool(TXPOOL_SIZE, MIN_RELAY_FEE_RATE)
+	bl.Relay = NewCompactRelay(COMPACT_TX_CACHE_SIZE)
+	bl.blockIndex, bl.txIndex = map[string]int{}, map[string]int{}
 
-	//Read blockchain from file and stuff...
+	bl.Consensus = NewProofOfWork(bl, BLOCK_POW)
 
 	bl.CurrentBlock = bl.CreateNewBlock()
 
@@ -55,7 +106,7 @@ func SetupBlockchan() *Blockchain {
 
 func (bl *Blockchain) CreateNewBlock() Block {
 
-	prevBlock := bl.BlockSlice.PreviousBlock()
+	prevBlock, _ := bl.Head()
 	prevBlockHash := []byte{}
 	if prevBlock != nil {
 
@@ -64,6 +115,18 @@ func (bl *Blockchain) CreateNewBlock() Block {
 
 	b := NewBlock(prevBlockHash)
 	b.BlockHeader.Origin = Core.Keypair.Public
+	b.BlockHeader.Scheme = Core.Keypair.Scheme()
+
+	return b
+}
+
+// AssembleBlock builds the next block out of the highest fee rate transactions in the mempool
+func (bl *Blockchain) AssembleBlock() Block {
+
+	b := bl.CreateNewBlock()
+	slice := bl.Mempool.Select(BLOCK_TX_NUM)
+	b.TransactionSlice = &slice
+	b.BlockHeader.MerkelRoot = b.GenerateMerkelRoot()
 
 	return b
 }
@@ -71,14 +134,120 @@ func (bl *Blockchain) CreateNewBlock() Block {
 func (bl *Blockchain) AddBlock(b Block) {
 	fmt.Printf("Create a new block, tx number [%d]\n", b.TransactionSlice.Len())
 
+	bl.lock.Lock()
+	defer bl.lock.Unlock()
+
+	if bl.Store != nil {
+		logOnError(bl.Store.Append(&b))
+	}
+	bl.addBlock(b)
+}
+
+// LoadBlocks restores blocks read back from the block store
+func (bl *Blockchain) LoadBlocks(blocks []Block) {
+
+	bl.lock.Lock()
+	defer bl.lock.Unlock()
+
+	for _, b := range blocks {
+		bl.addBlock(b)
+	}
+}
+
+func (bl *Blockchain) addBlock(b Block) {
+
+	height := len(bl.BlockSlice)
 	bl.BlockSlice = append(bl.BlockSlice, b)
+	bl.blockIndex[hex.EncodeToString(b.Hash())] = height
+	for _, t := range *b.TransactionSlice {
+		bl.txIndex[hex.EncodeToString(t.Hash())] = height
+	}
+}
+
+// Head returns the last block and its height, nil and -1 for an empty chain
+func (bl *Blockchain) Head() (*Block, int) {
+
+	bl.lock.RLock()
+	defer bl.lock.RUnlock()
+
+	return bl.BlockSlice.PreviousBlock(), len(bl.BlockSlice) - 1
 }
 
-var cnt = 0
+func (bl *Blockchain) BlockByHeight(height int) *Block {
+
+	bl.lock.RLock()
+	defer bl.lock.RUnlock()
+
+	if height < 0 || height >= len(bl.BlockSlice) {
+		return nil
+	}
+	return &bl.BlockSlice[height]
+}
+
+func (bl *Blockchain) BlockByHash(hash []byte) (*Block, int) {
+
+	bl.lock.RLock()
+	defer bl.lock.RUnlock()
+
+	height, ok := bl.blockIndex[hex.EncodeToString(hash)]
+	if !ok {
+		return nil, -1
+	}
+	return &bl.BlockSlice[height], height
+}
+
+// FindTransaction looks in the mempool and then in the chain. The height is -1
+// for transactions still waiting in the mempool.
+func (bl *Blockchain) FindTransaction(hash []byte) (*Transaction, int) {
+
+	if t := bl.Mempool.Get(hash); t != nil {
+		return t, -1
+	}
+
+	bl.lock.RLock()
+	defer bl.lock.RUnlock()
+
+	height, ok := bl.txIndex[hex.EncodeToString(hash)]
+	if !ok {
+		return nil, -1
+	}
+	for _, t := range *bl.BlockSlice[height].TransactionSlice {
+		if reflect.DeepEqual(t.Hash(), hash) {
+			return &t, height
+		}
+	}
+	return nil, -1
+}
+
+// inChain tells if a transaction is already in a block
+func (bl *Blockchain) inChain(tr *Transaction) bool {
+
+	bl.lock.RLock()
+	defer bl.lock.RUnlock()
+
+	_, ok := bl.txIndex[hex.EncodeToString(tr.Hash())]
+	return ok
+}
+
+// SubmitTransaction verifies a transaction, adds it to the mempool and queues it for broadcast
+func (bl *Blockchain) SubmitTransaction(tr *Transaction) error {
+
+	if !tr.VerifyTransaction(TRANSACTION_POW) {
+		return ErrInvalidTransaction
+	}
+	if _, height := bl.FindTransaction(tr.Hash()); height >= 0 {
+		return ErrTxInChain
+	}
+	if err := bl.Mempool.Add(tr); err != nil {
+		return err
+	}
+
+	validTxQueue <- tr
+	return nil
+}
 
 func (bl *Blockchain) Run() {
 
-	CurrentBlock := NewBlock(nil)
 	interruptBlockGen := bl.GenerateBlocks()
 	for {
 		select {
@@ -105,13 +274,8 @@ func (bl *Blockchain) Run() {
 				}()
 			*/
 			go func() {
-				defer Wg.Done()
-				for {
-					if !tr.VerifyTransaction(TRANSACTION_POW) {
-						fmt.Println("Recieved non valid transaction", tr)
-					} else {
-						validTxQueue <- tr
-					}
+				if bl.SubmitTransaction(tr) == ErrInvalidTransaction {
+					fmt.Println("Recieved non valid transaction", tr)
 				}
 			}()
 
@@ -148,29 +312,23 @@ func (bl *Blockchain) Run() {
 		case tr := <-validTxQueue:
 
 			// Broadcast transaction to peers and record timing
-			mes := NewMessage(MESSAGE_SEND_TRANSACTION)
-			mes.Data, _ = tr.MarshalBinary()
-			beginTime[hex.EncodeToString(tr.Hash())] = time.Now()
-			Core.Network.BroadcastQueue <- *mes
+			bl.Relay.Add(tr)
+			beginTime.set(hex.EncodeToString(tr.Hash()), time.Now())
+			Core.Network.AnnounceTransaction(tr)
 
-			cnt++
-			CurrentBlock.AddTransaction(tr)
-			if cnt >= BLOCK_TX_NUM {
+			// Enough transactions waiting for a full block, take the best paying ones
+			if bl.Mempool.Len() >= BLOCK_TX_NUM {
 
-				interruptBlockGen <- CurrentBlock
-				slice := make(TransactionSlice, BLOCK_TX_NUM, BLOCK_TX_NUM)
-				CurrentBlock.TransactionSlice = &slice
-				cnt = 0
+				interruptBlockGen <- struct{}{}
 			}
 			//Part II ------
 		case <-time.After(time.Second * BLOCK_GEN_TIMEOUT):
-			interruptBlockGen <- CurrentBlock
-			slice := make(TransactionSlice, BLOCK_TX_NUM)
-			CurrentBlock.TransactionSlice = &slice
-			cnt = 0
+			interruptBlockGen <- struct{}{}
 
 		case b := <-bl.BlocksQueue:
-			_ = b
+			if err := bl.AcceptBlock(&b); err != nil && err != ErrBlockInChain && err != ErrAwaitingQuorum {
+				fmt.Printf("Rejected block [%x]: %v\n", b.Hash(), err)
+			}
 			/*
 				if bl.BlockSlice.Exists(b) {
 					fmt.Println("block exists")
@@ -237,34 +395,48 @@ func DiffTransactionSlices(a, b TransactionSlice) (diff TransactionSlice) {
 }
 var total int = 0
 
-func (bl *Blockchain) GenerateBlocks() chan Block {
+// GenerateBlocks proposes a block through the consensus engine every time it's signalled
+func (bl *Blockchain) GenerateBlocks() chan struct{} {
 
-	interrupt := make(chan Block)
+	interrupt := make(chan struct{})
 
 	// Metrics
 	var lastBlockTime time.Time
 
 	// Ensure report file exists
 	go func() {
-		f, _ := os.OpenFile("tps_report.log", os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+		f, _ := os.OpenFile(ReportFile(), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
 		defer f.Close()
-		f.WriteString("--- TPS Reporter Started at " + time.Now().String() + " ---\n")
+		f.WriteString("--- TPS Reporter Started at " + time.Now().String() + " (consensus " + bl.Consensus.Name() + ") ---\n")
 	}()
 
 	go func() {
-		for {
-			block := <-interrupt
+		for range interrupt {
 
-			if total == 0{
+			if total == 0 {
 				total += 1
 				continue
 
 			}
 
-			block.BlockHeader.Timestamp = uint32(time.Now().Unix())
+			// Time spent by the engine counts, so consensus styles can be compared
+			start := time.Now()
+			block, err := bl.ProposeBlock(func() Block {
+				b := bl.AssembleBlock()
+				b.BlockHeader.Timestamp = uint32(time.Now().Unix())
+				return b
+			})
+			if err == ErrNotProposer {
+				continue
+			}
+			if err != nil {
+				fmt.Println("Block not proposed:", err)
+				continue
+			}
+
 			blockHash := hex.EncodeToString(block.Hash())
 			fmt.Printf("Generate a Block [%s]\n", blockHash)
-			beginTime[blockHash] = time.Now()
+			beginTime.set(blockHash, start)
 
 			// Per-block TPS calculation
 			now := time.Now()
@@ -277,45 +449,42 @@ func (bl *Blockchain) GenerateBlocks() chan Block {
 			lastBlockTime = now
 
 			n := block.TransactionSlice.Len()
-	Reporter.TotalBlocks += 1
-	Reporter.TotalTxs += n
-
-	var perBlockTPS float64
-	if delta > 0 {
-		perBlockTPS = float64(n) / delta
-	} else {
-		perBlockTPS = 0
-	}
+			Reporter.TotalBlocks += 1
+			Reporter.TotalTxs += n
 
-	// Aggregate
-	used := 0.0
-	if bt, ok := beginTime[blockHash]; ok {
-		used = time.Now().Sub(bt).Seconds()
-		Reporter.TotalTime += used
-	}
+			var perBlockTPS float64
+			if delta > 0 {
+				perBlockTPS = float64(n) / delta
+			} else {
+				perBlockTPS = 0
+			}
 
-	avgTPS := 0.0
-	if Reporter.TotalTime > 0 {
-		avgTPS = float64(Reporter.TotalTxs) / Reporter.TotalTime
-	}
+			// Aggregate
+			used := 0.0
+			if bt, ok := beginTime.get(blockHash); ok {
+				used = time.Now().Sub(bt).Seconds()
+				Reporter.TotalTime += used
+			}
 
-	// Log to stdout and file
-	logLine := fmt.Sprintf("[%s] Block %d: tx=%d, per_block_tps=%.2f, total_tx=%d, avg_tps=%.2f\n", now.Format(time.RFC3339), Reporter.TotalBlocks, n, perBlockTPS, Reporter.TotalTxs, avgTPS)
-	fmt.Print(logLine)
-	f, err := os.OpenFile("tps_report.log", os.O_APPEND|os.O_WRONLY, 0644)
-	if err == nil {
-		f.WriteString(logLine)
-		f.Close()
-	}
+			avgTPS := 0.0
+			if Reporter.TotalTime > 0 {
+				avgTPS = float64(Reporter.TotalTxs) / Reporter.TotalTime
+			}
 
-	print("Send a block contains " , n, " tx\n")
-	mes := NewMessage(MESSAGE_SEND_BLOCK)
-	mes.Data, _ = block.MarshalBinary()
+			// Log to stdout and file
+			logLine := fmt.Sprintf("[%s] Block %d: tx=%d, per_block_tps=%.2f, total_tx=%d, avg_tps=%.2f, hash=%s\n", now.Format(time.RFC3339), Reporter.TotalBlocks, n, perBlockTPS, Reporter.TotalTxs, avgTPS, blockHash)
+			fmt.Print(logLine)
+			f, err := os.OpenFile(ReportFile(), os.O_APPEND|os.O_WRONLY, 0644)
+			if err == nil {
+				f.WriteString(logLine)
+				f.Close()
+			}
 
-	Core.Network.BroadcastQueue <- *mes
+			print("Send a block contains ", n, " tx\n")
+			Core.Network.BroadcastQueue <- *bl.Relay.BlockMessage(block)
 
-	time.Sleep(time.Second * BLOCK_BROADCAST_INTERVAL)
-	}
+			time.Sleep(time.Second * BLOCK_BROADCAST_INTERVAL)
+		}
 	}()
 
 	return interrupt
@@ -323,7 +492,7 @@ func (bl *Blockchain) GenerateBlocks() chan Block {
 
 // DumpReport writes current reporter summary to disk
 func DumpReport() error {
-	f, err := os.OpenFile("tps_report.log", os.O_APPEND|os.O_WRONLY, 0644)
+	f, err := os.OpenFile(ReportFile(), os.O_APPEND|os.O_WRONLY, 0644)
 	if err != nil {
 		return err
 	}
@@ -333,6 +502,13 @@ func DumpReport() error {
 		avg = float64(Reporter.TotalTxs) / Reporter.TotalTime
 	}
 	line := fmt.Sprintf("--- Dump at %s: total_blocks=%d total_txs=%d total_time=%.3f avg_tps=%.2f ---\n", time.Now().Format(time.RFC3339), Reporter.TotalBlocks, Reporter.TotalTxs, Reporter.TotalTime, avg)
+
+	// Round trip times explain part of the differences between nodes
+	if Core.Network != nil {
+		for _, p := range Core.Network.Peers() {
+			line += fmt.Sprintf("peer=%s inbound=%t rtt_ms=%.3f\n", p.Address, p.Inbound, float64(p.RTT.Microseconds())/1000)
+		}
+	}
 	_, err = f.WriteString(line)
 	return err
 }
@@ -0,0 +1,87 @@
+package core
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+)
+
+const BLOCKCHAIN_STORE_FILENAME = "blocks.dat"
+
+// BlockStore appends blocks to a file as frames of their wire encoding
+type BlockStore struct {
+	file *os.File
+	lock sync.Mutex
+}
+
+// OpenBlockStore returns the store and the blocks already in it. A frame cut
+// short by a crash is dropped from the end of the file.
+func OpenBlockStore(file string) (*BlockStore, []Block, error) {
+
+	f, err := os.OpenFile(file, os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	blocks := []Block{}
+	r := bufio.NewReader(f)
+	offset := int64(0)
+	for {
+		d, err := ReadFrame(r, MAX_FRAME_SIZE)
+		if err == io.EOF {
+			break
+		}
+		if errors.Is(err, io.ErrUnexpectedEOF) {
+			fmt.Printf("Dropping truncated block at offset %d of %s\n", offset, file)
+			break
+		}
+		if err != nil {
+			f.Close()
+			return nil, nil, err
+		}
+
+		b := Block{}
+		if err := b.UnmarshalBinary(d); err != nil {
+			f.Close()
+			return nil, nil, fmt.Errorf("Block %d in %s: %w", len(blocks), file, err)
+		}
+
+		blocks = append(blocks, b)
+		offset += int64(bytesSize(d))
+	}
+
+	if err := f.Truncate(offset); err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+
+	return &BlockStore{file: f}, blocks, nil
+}
+
+func (s *BlockStore) Append(b *Block) error {
+
+	d, err := b.MarshalBinary()
+	if err != nil {
+		return err
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return WriteFrame(s.file, d)
+}
+
+func (s *BlockStore) Close() error {
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.file.Close()
+}
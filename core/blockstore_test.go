@@ -0,0 +1,53 @@
+package core
+
+import (
+	"os"
+	"path"
+	"reflect"
+	"testing"
+)
+
+func TestBlockStore(t *testing.T) {
+
+	file := path.Join(t.TempDir(), BLOCKCHAIN_STORE_FILENAME)
+
+	s, blocks, err := OpenBlockStore(file)
+	if err != nil || len(blocks) != 0 {
+		t.Fatal("New block store not empty", err)
+	}
+
+	b := codecTestBlock(2)
+	s.Append(b)
+	s.Append(b)
+	s.Close()
+
+	// Simulate a crash in the middle of the third block
+	d, _ := os.ReadFile(file)
+	os.WriteFile(file, append(d, d[:len(d)/4]...), 0600)
+
+	s, blocks, err = OpenBlockStore(file)
+	if err != nil || len(blocks) != 2 {
+		t.Fatal("Blocks not read back", len(blocks), err)
+	}
+	if !reflect.DeepEqual(blocks[1].Hash(), b.Hash()) {
+		t.Error("Stored block changed")
+	}
+
+	s.Append(b)
+	s.Close()
+
+	_, blocks, err = OpenBlockStore(file)
+	if err != nil || len(blocks) != 3 {
+		t.Error("Truncated block not dropped", len(blocks), err)
+	}
+}
+
+func TestBlockStoreCorrupted(t *testing.T) {
+
+	file := path.Join(t.TempDir(), BLOCKCHAIN_STORE_FILENAME)
+	os.WriteFile(file, []byte{3, 0xff, 0xff, 0xff}, 0600)
+
+	if _, _, err := OpenBlockStore(file); err == nil {
+		t.Error("Corrupted block store opened")
+	}
+}
@@ -0,0 +1,329 @@
+package core
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Wire format shared by transactions, blocks and messages. Every top level
+// object starts with CODEC_VERSION, variable length fields are prefixed with
+// their length as a minimal uvarint and fixed fields (integers, hashes) are
+// written with their exact length, so decoding and re-encoding any accepted
+// input gives back the same bytes.
+
+const FRAME_READ_CHUNK = 64 * 1024 // bytes a frame buffer starts at, it grows as the data arrives
+
+var (
+	ErrShortBuffer      = errors.New("Unexpected end of data")
+	ErrNonCanonical     = errors.New("Non canonical varint")
+	ErrFieldTooLong     = errors.New("Field exceeds maximum length")
+	ErrTrailingData     = errors.New("Trailing data after object")
+	ErrUnknownVersion   = errors.New("Unknown codec version")
+	ErrFixedFieldLength = errors.New("Wrong length for fixed size field")
+)
+
+// DecodeError points at the field and byte offset where decoding stopped
+type DecodeError struct {
+	Offset int
+	Field  string
+	Err    error
+}
+
+func (e *DecodeError) Error() string {
+
+	return fmt.Sprintf("decoding %s at byte %d: %v", e.Field, e.Offset, e.Err)
+}
+
+func (e *DecodeError) Unwrap() error {
+
+	return e.Err
+}
+
+type Encoder struct {
+	buf []byte
+	err error
+}
+
+func NewEncoder() *Encoder {
+
+	return &Encoder{}
+}
+
+func (e *Encoder) Byte(b byte) {
+
+	e.buf = append(e.buf, b)
+}
+
+func (e *Encoder) Uint32(v uint32) {
+
+	var b [4]byte
+	binary.LittleEndian.PutUint32(b[:], v)
+	e.buf = append(e.buf, b[:]...)
+}
+
+func (e *Encoder) Uint64(v uint64) {
+
+	var b [8]byte
+	binary.LittleEndian.PutUint64(b[:], v)
+	e.buf = append(e.buf, b[:]...)
+}
+
+func (e *Encoder) Uvarint(v uint64) {
+
+	var b [binary.MaxVarintLen64]byte
+	e.buf = append(e.buf, b[:binary.PutUvarint(b[:], v)]...)
+}
+
+// Bytes writes a length prefixed byte string
+func (e *Encoder) Bytes(b []byte) {
+
+	e.Uvarint(uint64(len(b)))
+	e.buf = append(e.buf, b...)
+}
+
+// Fixed writes exactly size bytes. An empty value is written as zeros,
+// anything else must already have the right length.
+func (e *Encoder) Fixed(field string, b []byte, size int) {
+
+	switch len(b) {
+	case size:
+		e.buf = append(e.buf, b...)
+	case 0:
+		e.buf = append(e.buf, make([]byte, size)...)
+	default:
+		if e.err == nil {
+			e.err = fmt.Errorf("encoding %s: %w (%d, expected %d)", field, ErrFixedFieldLength, len(b), size)
+		}
+	}
+}
+
+// Raw appends already encoded bytes
+func (e *Encoder) Raw(b []byte) {
+
+	e.buf = append(e.buf, b...)
+}
+
+func (e *Encoder) Result() ([]byte, error) {
+
+	if e.err != nil {
+		return nil, e.err
+	}
+	return e.buf, nil
+}
+
+// Decoder reads the format written by Encoder. The first error sticks and
+// later reads return zero values, so callers check Err once at the end.
+type Decoder struct {
+	data []byte
+	off  int
+	err  error
+}
+
+func NewDecoder(d []byte) *Decoder {
+
+	return &Decoder{data: d}
+}
+
+func (d *Decoder) fail(field string, err error) {
+
+	if d.err == nil {
+		d.err = &DecodeError{Offset: d.off, Field: field, Err: err}
+	}
+}
+
+func (d *Decoder) next(field string, n int) []byte {
+
+	if d.err != nil {
+		return nil
+	}
+	if n > len(d.data)-d.off {
+		d.fail(field, ErrShortBuffer)
+		return nil
+	}
+
+	b := d.data[d.off : d.off+n]
+	d.off += n
+
+	return b
+}
+
+func (d *Decoder) Byte(field string) byte {
+
+	if b := d.next(field, 1); b != nil {
+		return b[0]
+	}
+	return 0
+}
+
+func (d *Decoder) Uint32(field string) uint32 {
+
+	if b := d.next(field, 4); b != nil {
+		return binary.LittleEndian.Uint32(b)
+	}
+	return 0
+}
+
+func (d *Decoder) Uint64(field string) uint64 {
+
+	if b := d.next(field, 8); b != nil {
+		return binary.LittleEndian.Uint64(b)
+	}
+	return 0
+}
+
+func (d *Decoder) Uvarint(field string) uint64 {
+
+	if d.err != nil {
+		return 0
+	}
+
+	v, n := binary.Uvarint(d.data[d.off:])
+	if n == 0 {
+		d.fail(field, ErrShortBuffer)
+		return 0
+	}
+	if n < 0 || n != uvarintSize(v) {
+		d.fail(field, ErrNonCanonical)
+		return 0
+	}
+	d.off += n
+
+	return v
+}
+
+// Bytes reads a length prefixed byte string of at most max bytes, empty strings decode as nil
+func (d *Decoder) Bytes(field string, max int) []byte {
+
+	start := d.off
+	l := d.Uvarint(field)
+	if d.err != nil {
+		return nil
+	}
+	if l > uint64(max) {
+		d.off = start
+		d.fail(field, ErrFieldTooLong)
+		return nil
+	}
+	if l == 0 {
+		return nil
+	}
+
+	return copyBytes(d.next(field, int(l)))
+}
+
+// count reads the length of a list of items taking more than one byte each
+func (d *Decoder) count(field string) int {
+
+	start := d.Offset()
+	n := d.Uvarint(field)
+	if n > uint64(len(d.Remaining())) {
+		d.off = start
+		d.fail(field, ErrShortBuffer)
+		return 0
+	}
+	return int(n)
+}
+
+func (d *Decoder) Fixed(field string, size int) []byte {
+
+	return copyBytes(d.next(field, size))
+}
+
+// Version reads and checks the leading codec version byte
+func (d *Decoder) Version(field string) {
+
+	start := d.off
+	if v := d.Byte(field); d.err == nil && v != CODEC_VERSION {
+		d.off = start
+		d.fail(field, ErrUnknownVersion)
+	}
+}
+
+// Offset of the next unread byte
+func (d *Decoder) Offset() int {
+
+	return d.off
+}
+
+func (d *Decoder) Remaining() []byte {
+
+	return d.data[d.off:]
+}
+
+// Finish fails if anything is left after the decoded object
+func (d *Decoder) Finish(field string) error {
+
+	if d.err == nil && d.off != len(d.data) {
+		d.fail(field, ErrTrailingData)
+	}
+	return d.err
+}
+
+func (d *Decoder) Err() error {
+
+	return d.err
+}
+
+func copyBytes(b []byte) []byte {
+
+	if b == nil {
+		return nil
+	}
+	return append([]byte(nil), b...)
+}
+
+func uvarintSize(v uint64) int {
+
+	n := 1
+	for v >= 0x80 {
+		v >>= 7
+		n++
+	}
+	return n
+}
+
+// Size of a length prefixed byte string
+func bytesSize(b []byte) int {
+
+	return uvarintSize(uint64(len(b))) + len(b)
+}
+
+// WriteFrame writes a length prefixed frame to a stream
+func WriteFrame(w io.Writer, payload []byte) error {
+
+	_, err := w.Write(AppendFrame(nil, payload))
+	return err
+}
+
+// AppendFrame appends the length prefixed frame of payload to b
+func AppendFrame(b, payload []byte) []byte {
+
+	b = binary.AppendUvarint(b, uint64(len(payload)))
+	return append(b, payload...)
+}
+
+// ReadFrame reads one frame written by WriteFrame
+func ReadFrame(r *bufio.Reader, max int) ([]byte, error) {
+
+	l, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, err
+	}
+	if l > uint64(max) {
+		return nil, fmt.Errorf("Frame of %d bytes: %w", l, ErrFieldTooLong)
+	}
+
+	// Memory follows what arrives, not what the peer declared
+	buf := bytes.NewBuffer(make([]byte, 0, min(l, FRAME_READ_CHUNK)))
+	if _, err := io.CopyN(buf, r, int64(l)); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,192 @@
+package core
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"reflect"
+	"runtime"
+	"testing"
+
+	"github.com/izqui/helpers"
+)
+
+func codecTestTransaction() *Transaction {
+
+	kp := GenerateNewKeypair()
+	tr := NewTransaction(kp.Public, nil, []byte(helpers.RandomString(helpers.RandomInt(1, 256))))
+	tr.Header.Fee = tr.MinRelayFee()
+	tr.Header.Nonce = tr.GenerateNonce(helpers.ArrayOfBytes(TEST_TRANSACTION_POW_COMPLEXITY, TEST_POW_PREFIX))
+	tr.Signature = tr.Sign(kp)
+
+	return tr
+}
+
+// codecTestBlock holds n transactions
+func codecTestBlock(n int) *Block {
+
+	kp := GenerateNewKeypair()
+	b := NewBlock(helpers.SHA256([]byte("previous block hash")))
+	for i := 0; i < n; i++ {
+		b.AddTransaction(codecTestTransaction())
+	}
+	b.BlockHeader.Origin = kp.Public
+	b.BlockHeader.MerkelRoot = b.GenerateMerkelRoot()
+	b.Signature = b.Sign(kp)
+
+	return &b
+}
+
+func TestLeadingZeroHashesRoundTrip(t *testing.T) {
+
+	b := NewBlock(append([]byte{0, 0}, helpers.ArrayOfBytes(HASH_SIZE-2, 7)...))
+	b.BlockHeader.MerkelRoot = append([]byte{0}, helpers.ArrayOfBytes(HASH_SIZE-1, 9)...)
+	b.Signature = []byte{0, 1, 2}
+
+	data, err := b.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	newB := new(Block)
+	if err := newB.UnmarshalBinary(data); err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(newB.BlockHeader, b.BlockHeader) || !bytes.Equal(newB.Signature, b.Signature) {
+		t.Error("Leading zeros were stripped")
+	}
+}
+
+func TestFixedFieldLength(t *testing.T) {
+
+	b := NewBlock([]byte("not a hash"))
+	if _, err := b.MarshalBinary(); !errors.Is(err, ErrFixedFieldLength) {
+		t.Error("Marshalled a short prev block hash")
+	}
+}
+
+func TestDecodeErrorOffset(t *testing.T) {
+
+	data, _ := codecTestTransaction().MarshalBinary()
+	data[1] = 0x80 // make the From length a truncated varint
+
+	_, err := new(Transaction).UnmarshalBinary(data[:2])
+
+	var decodeErr *DecodeError
+	if !errors.As(err, &decodeErr) || decodeErr.Offset != 1 || decodeErr.Field != "transaction from" {
+		t.Error("Wrong decode error", err)
+	}
+}
+
+func TestNonCanonicalVarint(t *testing.T) {
+
+	// Data length 1 written as two varint bytes
+	data := []byte{CODEC_VERSION, MESSAGE_GET_NODES, 0, 0x81, 0x00, 'a'}
+
+	if err := new(Message).UnmarshalBinary(data); !errors.Is(err, ErrNonCanonical) {
+		t.Error("Accepted non canonical varint", err)
+	}
+}
+
+func TestMessageFraming(t *testing.T) {
+
+	buf := new(bytes.Buffer)
+	m1 := Message{Identifier: MESSAGE_SEND_BLOCK, Data: []byte("first")}
+	m2 := Message{Identifier: MESSAGE_SEND_TRANSACTION, Options: []byte{1}, Data: []byte("second")}
+
+	WriteMessage(buf, m1)
+	WriteMessage(buf, m2)
+
+	r := bufio.NewReader(buf)
+	for _, expected := range []Message{m1, m2} {
+		m, err := ReadMessage(r)
+		if err != nil || !reflect.DeepEqual(*m, expected) {
+			t.Error("Framed message doesn't match", err)
+		}
+	}
+}
+
+func TestReadFrameTruncated(t *testing.T) {
+
+	// A frame declared at the limit that stops early
+	b := binary.AppendUvarint(nil, MAX_FRAME_SIZE)
+	b = append(b, make([]byte, 100)...)
+
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	if _, err := ReadFrame(bufio.NewReader(bytes.NewReader(b)), MAX_FRAME_SIZE); err != io.ErrUnexpectedEOF {
+		t.Error("Truncated frame accepted", err)
+	}
+	runtime.ReadMemStats(&after)
+	if allocated := after.TotalAlloc - before.TotalAlloc; allocated > MAX_FRAME_SIZE/16 {
+		t.Error("Allocated the declared length before the data arrived", allocated)
+	}
+	if f, err := ReadFrame(bufio.NewReader(bytes.NewReader([]byte{0})), MAX_FRAME_SIZE); err != nil || f == nil || len(f) != 0 {
+		t.Error("Empty frame not read", f, err)
+	}
+}
+
+func fuzzRoundTrip(t *testing.T, data []byte, decode func([]byte) ([]byte, error)) {
+
+	consumed, err := decode(data)
+	if err != nil {
+		return
+	}
+	if !bytes.Equal(consumed, data) {
+		t.Errorf("Round trip changed bytes:\n%x\n%x", data, consumed)
+	}
+}
+
+func FuzzTransactionUnmarshal(f *testing.F) {
+
+	data, _ := codecTestTransaction().MarshalBinary()
+	f.Add(data)
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		fuzzRoundTrip(t, data, func(d []byte) ([]byte, error) {
+			tr := new(Transaction)
+			rem, err := tr.UnmarshalBinary(d)
+			if err != nil {
+				return nil, err
+			}
+			b, err := tr.MarshalBinary()
+			return append(b, rem...), err
+		})
+	})
+}
+
+func FuzzBlockUnmarshal(f *testing.F) {
+
+	data, _ := codecTestBlock(2).MarshalBinary()
+	f.Add(data)
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		fuzzRoundTrip(t, data, func(d []byte) ([]byte, error) {
+			b := new(Block)
+			if err := b.UnmarshalBinary(d); err != nil {
+				return nil, err
+			}
+			return b.MarshalBinary()
+		})
+	})
+}
+
+func FuzzMessageUnmarshal(f *testing.F) {
+
+	block, _ := codecTestBlock(2).MarshalBinary()
+	data, _ := (&Message{Identifier: MESSAGE_SEND_BLOCK, Options: []byte{1, 2}, Data: block}).MarshalBinary()
+	f.Add(data)
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		fuzzRoundTrip(t, data, func(d []byte) ([]byte, error) {
+			m := new(Message)
+			if err := m.UnmarshalBinary(d); err != nil {
+				return nil, err
+			}
+			return m.MarshalBinary()
+		})
+	})
+}
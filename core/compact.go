@@ -0,0 +1,434 @@
+package core
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"math"
+	"sync"
+	"time"
+)
+
+// Blocks go to peers as their header and a short ID per transaction, the
+// first bytes of its hash. Peers rebuild them out of the transactions they
+// have seen lately and ask the sender only for the ones they're missing.
+// Peers' transactions don't enter our mempool, so the relay keeps its own
+// cache of them.
+
+const (
+	COMPACT_SHORT_ID_SIZE   = 6
+	COMPACT_TX_CACHE_SIZE   = TXPOOL_SIZE // transactions kept to rebuild blocks with
+	COMPACT_RECENT_BLOCKS   = 8           // whole blocks kept to serve their transactions
+	COMPACT_MAX_PENDING     = 8           // blocks waiting for missing transactions
+	COMPACT_PENDING_TIMEOUT = 30          // seconds a block waits for its transactions
+)
+
+var (
+	ErrUnknownBlock            = errors.New("Block not known")
+	ErrUnrequestedTransactions = errors.New("Transactions for a block not waiting for them")
+	ErrBlockTransactions       = errors.New("Transactions don't complete the block")
+)
+
+type CompactBlock struct {
+	*BlockHeader
+	Signature []byte
+	ShortIDs  [][]byte // one per transaction, in block order
+}
+
+func NewCompactBlock(b *Block) *CompactBlock {
+
+	c := &CompactBlock{BlockHeader: b.BlockHeader, Signature: b.Signature}
+	for _, t := range *b.TransactionSlice {
+		c.ShortIDs = append(c.ShortIDs, shortID(t.Hash()))
+	}
+	return c
+}
+
+func shortID(hash []byte) []byte {
+
+	return hash[:COMPACT_SHORT_ID_SIZE]
+}
+
+func (c *CompactBlock) Hash() []byte {
+
+	return (&Block{BlockHeader: c.BlockHeader}).Hash()
+}
+
+func (c *CompactBlock) MarshalBinary() ([]byte, error) {
+
+	e := NewEncoder()
+	e.Byte(CODEC_VERSION)
+	c.BlockHeader.encode(e)
+	e.Bytes(c.Signature)
+	e.Uvarint(uint64(len(c.ShortIDs)))
+	for _, id := range c.ShortIDs {
+		e.Fixed("short id", id, COMPACT_SHORT_ID_SIZE)
+	}
+
+	return e.Result()
+}
+
+func (c *CompactBlock) UnmarshalBinary(b []byte) error {
+
+	d := NewDecoder(b)
+	d.Version("compact block version")
+	c.BlockHeader = new(BlockHeader)
+	c.BlockHeader.decode(d)
+	c.Signature = d.Bytes("compact block signature", NETWORK_KEY_SIZE)
+
+	n := d.Uvarint("short id count")
+	switch {
+	case n > BLOCK_TX_NUM:
+		d.fail("short id count", ErrFieldTooLong)
+	case n > uint64(len(d.Remaining())/COMPACT_SHORT_ID_SIZE):
+		d.fail("short id count", ErrShortBuffer)
+	}
+	c.ShortIDs = nil
+	for i := uint64(0); i < n && d.Err() == nil; i++ {
+		c.ShortIDs = append(c.ShortIDs, d.Fixed("short id", COMPACT_SHORT_ID_SIZE))
+	}
+
+	return d.Finish("compact block")
+}
+
+// BlockTransactionsRequest asks for the transactions of a block at the indexes
+type BlockTransactionsRequest struct {
+	Block   []byte
+	Indexes []int
+}
+
+func (r *BlockTransactionsRequest) MarshalBinary() ([]byte, error) {
+
+	e := NewEncoder()
+	e.Byte(CODEC_VERSION)
+	e.Fixed("block hash", r.Block, HASH_SIZE)
+	e.Uvarint(uint64(len(r.Indexes)))
+	for _, i := range r.Indexes {
+		e.Uvarint(uint64(i))
+	}
+
+	return e.Result()
+}
+
+func (r *BlockTransactionsRequest) UnmarshalBinary(b []byte) error {
+
+	d := NewDecoder(b)
+	d.Version("transactions request version")
+	r.Block = d.Fixed("transactions request block", HASH_SIZE)
+
+	n := d.Uvarint("transactions request count")
+	switch {
+	case n > BLOCK_TX_NUM:
+		d.fail("transactions request count", ErrFieldTooLong)
+	case n > uint64(len(d.Remaining())):
+		d.fail("transactions request count", ErrShortBuffer)
+	}
+	r.Indexes = nil
+	for i := uint64(0); i < n && d.Err() == nil; i++ {
+		index := d.Uvarint("transactions request index")
+		if index > math.MaxInt32 {
+			d.fail("transactions request index", ErrFieldTooLong)
+		}
+		r.Indexes = append(r.Indexes, int(index))
+	}
+
+	return d.Finish("transactions request")
+}
+
+// BlockTransactions answers a BlockTransactionsRequest, in the order asked
+type BlockTransactions struct {
+	Block        []byte
+	Transactions TransactionSlice
+}
+
+func (t *BlockTransactions) MarshalBinary() ([]byte, error) {
+
+	e := NewEncoder()
+	e.Byte(CODEC_VERSION)
+	e.Fixed("block hash", t.Block, HASH_SIZE)
+	t.Transactions.encode(e)
+
+	return e.Result()
+}
+
+func (t *BlockTransactions) UnmarshalBinary(b []byte) error {
+
+	d := NewDecoder(b)
+	d.Version("block transactions version")
+	t.Block = d.Fixed("block transactions block", HASH_SIZE)
+	t.Transactions.decode(d)
+
+	return d.Finish("block transactions")
+}
+
+type CompactRelay struct {
+	FullBlocks bool // blocks are sent whole, to compare the bytes it takes
+
+	lock    sync.Mutex
+	txs     map[string]*Transaction // short ID -> transaction, nil when two share it
+	ring    []string                // cached short IDs in arrival order, the oldest go first
+	next    int
+	limit   int
+	recent  []*Block
+	pending map[string]*pendingBlock // block hash -> block waiting for transactions
+	stats   CompactStats
+}
+
+type pendingBlock struct {
+	*CompactBlock
+	txs     TransactionSlice // with holes at missing
+	missing []int
+	peer    string // the one asked for them
+	since   time.Time
+	waiting []waitingRequest // peers that asked us for transactions before we had them
+}
+
+type waitingRequest struct {
+	*BlockTransactionsRequest
+	reply func(Message)
+}
+
+type CompactStats struct {
+	Sent         int `json:"sent"`
+	Received     int `json:"received"`
+	Rebuilt      int `json:"rebuilt"`      // out of cached transactions alone
+	Completed    int `json:"completed"`    // after asking for the missing ones
+	TxsRequested int `json:"txsRequested"` // by us
+	TxsServed    int `json:"txsServed"`    // to peers
+	CompactBytes int `json:"compactBytes"` // of the compact blocks sent and the transactions served
+	FullBytes    int `json:"fullBytes"`    // the same blocks would have taken whole
+}
+
+func NewCompactRelay(limit int) *CompactRelay {
+
+	return &CompactRelay{txs: map[string]*Transaction{}, limit: limit, pending: map[string]*pendingBlock{}}
+}
+
+// Add caches a transaction to rebuild blocks with
+func (r *CompactRelay) Add(t *Transaction) {
+
+	hash := t.Hash()
+	id := string(shortID(hash))
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if cached, ok := r.txs[id]; ok {
+		if cached != nil && !bytes.Equal(cached.Hash(), hash) {
+			r.txs[id] = nil
+		}
+		return
+	}
+	r.txs[id] = t
+
+	if len(r.ring) < r.limit {
+		r.ring = append(r.ring, id)
+		return
+	}
+	delete(r.txs, r.ring[r.next])
+	r.ring[r.next] = id
+	r.next = (r.next + 1) % r.limit
+}
+
+// Transaction looks up a cached transaction by hash
+func (r *CompactRelay) Transaction(hash []byte) *Transaction {
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if t := r.txs[string(shortID(hash))]; t != nil && bytes.Equal(t.Hash(), hash) {
+		return t
+	}
+	return nil
+}
+
+// BlockMessage is the message a block of ours goes to peers in
+func (r *CompactRelay) BlockMessage(b *Block) *Message {
+
+	full, _ := b.MarshalBinary()
+	if r.FullBlocks {
+		return &Message{Identifier: MESSAGE_SEND_BLOCK, Data: full}
+	}
+	data, _ := NewCompactBlock(b).MarshalBinary()
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.keep(b)
+	r.stats.Sent++
+	r.stats.CompactBytes += len(data)
+	r.stats.FullBytes += len(full)
+
+	return &Message{Identifier: MESSAGE_SEND_COMPACT_BLOCK, Data: data}
+}
+
+// keep holds a whole block to serve its transactions from
+func (r *CompactRelay) keep(b *Block) {
+
+	r.recent = append(r.recent, b)
+	if len(r.recent) > COMPACT_RECENT_BLOCKS {
+		r.recent = r.recent[1:]
+	}
+}
+
+// Receive rebuilds a compact block from peer, its header checked already.
+// When transactions are missing it returns the request for them to send back
+// instead, and nothing for blocks already waiting.
+func (r *CompactRelay) Receive(c *CompactBlock, peer string) (*Block, *BlockTransactionsRequest) {
+
+	hash := c.Hash()
+	key := hex.EncodeToString(hash)
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.stats.Received++
+	r.expire()
+	if _, ok := r.pending[key]; ok {
+		return nil, nil
+	}
+
+	p := &pendingBlock{CompactBlock: c, txs: make(TransactionSlice, len(c.ShortIDs)), peer: peer, since: time.Now()}
+	for i, id := range c.ShortIDs {
+		if t := r.txs[string(id)]; t != nil {
+			p.txs[i] = *t
+		} else {
+			p.missing = append(p.missing, i)
+		}
+	}
+
+	if len(p.missing) == 0 {
+		// Empty blocks are left to the block checks like whole ones
+		if b, ok := p.block(); ok || len(c.ShortIDs) == 0 {
+			r.stats.Rebuilt++
+			r.keep(b)
+			return b, nil
+		}
+		// A short ID matched another transaction, ask for them all
+		for i := range c.ShortIDs {
+			p.missing = append(p.missing, i)
+		}
+	}
+
+	if len(r.pending) >= COMPACT_MAX_PENDING {
+		r.dropOldest()
+	}
+	r.pending[key] = p
+	r.stats.TxsRequested += len(p.missing)
+
+	return nil, &BlockTransactionsRequest{Block: hash, Indexes: p.missing}
+}
+
+// Fill completes a waiting block with the transactions its peer sent. Peers
+// that asked us for transactions of it meanwhile get them on their reply.
+func (r *CompactRelay) Fill(bt *BlockTransactions, peer string) (*Block, error) {
+
+	key := hex.EncodeToString(bt.Block)
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	p, ok := r.pending[key]
+	if !ok || p.peer != peer {
+		return nil, ErrUnrequestedTransactions
+	}
+	delete(r.pending, key)
+
+	if len(bt.Transactions) != len(p.missing) {
+		return nil, ErrBlockTransactions
+	}
+	for i, index := range p.missing {
+		p.txs[index] = bt.Transactions[i]
+	}
+	b, ok := p.block()
+	if !ok {
+		return nil, ErrBlockTransactions
+	}
+	r.stats.Completed++
+	r.keep(b)
+
+	for _, w := range p.waiting {
+		if answer, err := r.serve(b, w.BlockTransactionsRequest); err == nil {
+			go w.reply(*answer)
+		}
+	}
+	return b, nil
+}
+
+// Serve answers a peer's request for transactions out of the blocks we
+// keep or chain. Requests for blocks still waiting here are answered when
+// they're complete, with a nil message now.
+func (r *CompactRelay) Serve(req *BlockTransactionsRequest, chain *Blockchain, reply func(Message)) (*Message, error) {
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	for _, b := range r.recent {
+		if bytes.Equal(b.Hash(), req.Block) {
+			return r.serve(b, req)
+		}
+	}
+	if p, ok := r.pending[hex.EncodeToString(req.Block)]; ok {
+		p.waiting = append(p.waiting, waitingRequest{req, reply})
+		return nil, nil
+	}
+	if b, _ := chain.BlockByHash(req.Block); b != nil {
+		return r.serve(b, req)
+	}
+	return nil, ErrUnknownBlock
+}
+
+func (r *CompactRelay) serve(b *Block, req *BlockTransactionsRequest) (*Message, error) {
+
+	bt := &BlockTransactions{Block: req.Block}
+	for _, i := range req.Indexes {
+		if i >= b.TransactionSlice.Len() {
+			return nil, ErrBlockTransactions
+		}
+		bt.Transactions = append(bt.Transactions, (*b.TransactionSlice)[i])
+	}
+	data, err := bt.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	r.stats.TxsServed += len(bt.Transactions)
+	r.stats.CompactBytes += len(data)
+
+	return &Message{Identifier: MESSAGE_SEND_BLOCK_TRANSACTIONS, Data: data}, nil
+}
+
+// expire drops blocks that waited too long for their transactions
+func (r *CompactRelay) expire() {
+
+	for key, p := range r.pending {
+		if time.Since(p.since) > time.Second*COMPACT_PENDING_TIMEOUT {
+			delete(r.pending, key)
+		}
+	}
+}
+
+func (r *CompactRelay) dropOldest() {
+
+	oldest := ""
+	for key, p := range r.pending {
+		if oldest == "" || p.since.Before(r.pending[oldest].since) {
+			oldest = key
+		}
+	}
+	delete(r.pending, oldest)
+}
+
+func (r *CompactRelay) Stats() CompactStats {
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	return r.stats
+}
+
+// block is the rebuilt block, not ok when the transactions don't match its merkel root
+func (p *pendingBlock) block() (*Block, bool) {
+
+	b := &Block{BlockHeader: p.BlockHeader, Signature: p.Signature, TransactionSlice: &p.txs}
+	return b, bytes.Equal(b.GenerateMerkelRoot(), p.MerkelRoot)
+}
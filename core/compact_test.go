@@ -0,0 +1,200 @@
+package core
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestCompactBlockRoundTrip(t *testing.T) {
+
+	b := codecTestBlock(3)
+
+	c := NewCompactBlock(b)
+	data, err := c.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded := new(CompactBlock)
+	if err := decoded.UnmarshalBinary(data); err != nil || !reflect.DeepEqual(c, decoded) || !bytes.Equal(decoded.Hash(), b.Hash()) {
+		t.Error("Compact block changed in a round trip", err)
+	}
+	if err := decoded.UnmarshalBinary(data[:len(data)-1]); err == nil {
+		t.Error("Truncated compact block decoded")
+	}
+
+	req := &BlockTransactionsRequest{Block: b.Hash(), Indexes: []int{0, 2}}
+	data, _ = req.MarshalBinary()
+	decodedReq := new(BlockTransactionsRequest)
+	if err := decodedReq.UnmarshalBinary(data); err != nil || !reflect.DeepEqual(req, decodedReq) {
+		t.Error("Request changed in a round trip", err)
+	}
+
+	bt := &BlockTransactions{Block: b.Hash(), Transactions: *b.TransactionSlice}
+	data, _ = bt.MarshalBinary()
+	decodedTxs := new(BlockTransactions)
+	if err := decodedTxs.UnmarshalBinary(data); err != nil || !reflect.DeepEqual(bt, decodedTxs) {
+		t.Error("Block transactions changed in a round trip", err)
+	}
+}
+
+func TestCompactBlockLimits(t *testing.T) {
+
+	b := codecTestBlock(1)
+	c := NewCompactBlock(b)
+	if failed := failedChecks(c.Checks(nil)); len(failed) > 0 {
+		t.Error("Header checks failed", failed)
+	}
+	c.Signature = codecTestBlock(1).Signature
+	if failed := failedChecks(c.Checks(nil)); len(failed) != 1 || failed[0] != "signature" {
+		t.Error("Forged header passed", failed)
+	}
+
+	// More short IDs than a block holds are refused before they're read
+	for i := 0; i < BLOCK_TX_NUM; i++ {
+		c.ShortIDs = append(c.ShortIDs, c.ShortIDs[0])
+	}
+	data, _ := c.MarshalBinary()
+	if err := new(CompactBlock).UnmarshalBinary(data); !errors.Is(err, ErrFieldTooLong) {
+		t.Error("Oversized compact block decoded", err)
+	}
+
+	req := &BlockTransactionsRequest{Block: b.Hash(), Indexes: make([]int, BLOCK_TX_NUM+1)}
+	data, _ = req.MarshalBinary()
+	if err := new(BlockTransactionsRequest).UnmarshalBinary(data); !errors.Is(err, ErrFieldTooLong) {
+		t.Error("Oversized request decoded", err)
+	}
+}
+
+func TestCompactRelayRebuild(t *testing.T) {
+
+	b := codecTestBlock(100)
+	sender, receiver := NewCompactRelay(1000), NewCompactRelay(1000)
+
+	m := sender.BlockMessage(b)
+	if m.Identifier != MESSAGE_SEND_COMPACT_BLOCK {
+		t.Fatal("Block not sent compact", MessageName(m.Identifier))
+	}
+	if s := sender.Stats(); s.FullBytes < 10*s.CompactBytes {
+		t.Errorf("Compact block of %d bytes for %d whole", s.CompactBytes, s.FullBytes)
+	}
+
+	// Two transactions never reached the receiver
+	txs := *b.TransactionSlice
+	for i := range txs {
+		if i != 10 && i != 50 {
+			receiver.Add(&txs[i])
+		}
+	}
+	c := new(CompactBlock)
+	c.UnmarshalBinary(m.Data)
+
+	rebuilt, req := receiver.Receive(c, "sender")
+	if rebuilt != nil || req == nil || !reflect.DeepEqual(req.Indexes, []int{10, 50}) {
+		t.Fatal("Missing transactions not requested", req)
+	}
+	if again, req := receiver.Receive(c, "other"); again != nil || req != nil {
+		t.Error("Waiting block requested twice")
+	}
+
+	reply, err := sender.Serve(req, &Blockchain{}, nil)
+	if err != nil || reply == nil || reply.Identifier != MESSAGE_SEND_BLOCK_TRANSACTIONS {
+		t.Fatal("Request not served", err)
+	}
+	bt := new(BlockTransactions)
+	bt.UnmarshalBinary(reply.Data)
+
+	if _, err := receiver.Fill(bt, "other"); err != ErrUnrequestedTransactions {
+		t.Error("Transactions accepted from a peer not asked", err)
+	}
+	rebuilt, err = receiver.Fill(bt, "sender")
+	if err != nil || !bytes.Equal(rebuilt.Hash(), b.Hash()) || !reflect.DeepEqual(*rebuilt.TransactionSlice, txs) {
+		t.Fatal("Block not completed", err)
+	}
+	if s := receiver.Stats(); s.Received != 2 || s.Completed != 1 || s.TxsRequested != 2 {
+		t.Error("Wrong stats", s)
+	}
+
+	// With every transaction cached nothing is asked
+	other := NewCompactRelay(1000)
+	for i := range txs {
+		other.Add(&txs[i])
+	}
+	if rebuilt, req := other.Receive(c, "sender"); rebuilt == nil || req != nil || !bytes.Equal(rebuilt.MerkelRoot, b.MerkelRoot) {
+		t.Error("Block not rebuilt from the cache", req)
+	}
+}
+
+func TestCompactRelayBadTransactions(t *testing.T) {
+
+	b := codecTestBlock(3)
+	c := NewCompactBlock(b)
+	txs := *b.TransactionSlice
+
+	// Another transaction under the short ID of the first, the whole block is asked for
+	r := NewCompactRelay(10)
+	r.Add(&txs[1])
+	r.Add(&txs[2])
+	r.txs[string(c.ShortIDs[0])] = codecTestTransaction()
+
+	_, req := r.Receive(c, "sender")
+	if req == nil || len(req.Indexes) != 3 {
+		t.Fatal("Collision not noticed", req)
+	}
+	wrong := &BlockTransactions{Block: b.Hash(), Transactions: TransactionSlice{txs[1], txs[0], txs[2]}}
+	if _, err := r.Fill(wrong, "sender"); err != ErrBlockTransactions {
+		t.Error("Transactions not matching the merkel root accepted", err)
+	}
+
+	r = NewCompactRelay(10)
+	_, req = r.Receive(c, "sender")
+	if _, err := r.Fill(&BlockTransactions{Block: b.Hash(), Transactions: txs[:1]}, "sender"); err != ErrBlockTransactions {
+		t.Error("Too few transactions accepted", err)
+	}
+
+	r.BlockMessage(b)
+	if _, err := r.Serve(&BlockTransactionsRequest{Block: b.Hash(), Indexes: []int{3}}, &Blockchain{}, nil); err != ErrBlockTransactions {
+		t.Error("Request past the block served", err)
+	}
+	if _, err := r.Serve(&BlockTransactionsRequest{Block: make([]byte, HASH_SIZE)}, &Blockchain{}, nil); err != ErrUnknownBlock {
+		t.Error("Unknown block served", err)
+	}
+}
+
+func TestCompactRelayAnswersWaitingRequests(t *testing.T) {
+
+	b := codecTestBlock(2)
+	c := NewCompactBlock(b)
+
+	// A peer we relayed the block to asks before we have its transactions
+	r := NewCompactRelay(10)
+	_, req := r.Receive(c, "sender")
+	reply := make(chan Message, 1)
+	if m, err := r.Serve(&BlockTransactionsRequest{Block: b.Hash(), Indexes: []int{1}}, &Blockchain{}, func(m Message) { reply <- m }); m != nil || err != nil {
+		t.Fatal("Request for a waiting block not held", err)
+	}
+
+	if _, err := r.Fill(&BlockTransactions{Block: b.Hash(), Transactions: *b.TransactionSlice}, "sender"); err != nil || len(req.Indexes) != 2 {
+		t.Fatal(err)
+	}
+	select {
+	case m := <-reply:
+		bt := new(BlockTransactions)
+		if err := bt.UnmarshalBinary(m.Data); err != nil || len(bt.Transactions) != 1 || !bytes.Equal(bt.Transactions[0].Hash(), (*b.TransactionSlice)[1].Hash()) {
+			t.Error("Wrong transactions sent", err)
+		}
+	case <-time.After(time.Second * 5):
+		t.Error("Waiting request not answered")
+	}
+}
+
+func TestCompactRelayFullBlocks(t *testing.T) {
+
+	r := NewCompactRelay(10)
+	r.FullBlocks = true
+	if m := r.BlockMessage(codecTestBlock(1)); m.Identifier != MESSAGE_SEND_BLOCK {
+		t.Error("Block not sent whole", MessageName(m.Identifier))
+	}
+}
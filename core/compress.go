@@ -0,0 +1,139 @@
+package core
+
+import (
+	"bytes"
+	"compress/flate"
+	"errors"
+	"io"
+	"sync"
+	"time"
+)
+
+// Frames of COMPRESS_MIN_SIZE or more can go to peers deflated, wrapped in a
+// compressed message. Nodes started with compression list the compressed
+// message in their version, and only frames to peers that listed it are
+// compressed, so a connection compresses when both ends agree. Compressed
+// messages from peers we didn't offer compression to aren't inflated and
+// count as malformed. Each peer's writer compresses what it sends, which
+// the peer's stats show the ratio and time of.
+
+const (
+	COMPRESS_MIN_SIZE = 1024            // bytes of the smallest frame compressed
+	COMPRESS_LEVEL    = flate.BestSpeed // blocks take long to deflate at higher levels
+)
+
+var (
+	ErrNestedCompression = errors.New("Compressed message inside another")
+	ErrNotCompressing    = errors.New("Compressed message without compression offered")
+)
+
+type CompressionStats struct {
+	Frames          int           `json:"frames"` // compressed by us
+	Bytes           int           `json:"bytes"`  // of those frames before compression
+	CompressedBytes int           `json:"compressedBytes"`
+	Ratio           float64       `json:"ratio"` // compressed over original bytes, 0 before the first
+	CompressTime    time.Duration `json:"compressTime"`
+
+	Received       int           `json:"received"`      // compressed frames from the peer
+	ReceivedBytes  int           `json:"receivedBytes"` // of those frames once decompressed
+	DecompressTime time.Duration `json:"decompressTime"`
+}
+
+var flateWriters = sync.Pool{New: func() any {
+
+	w, _ := flate.NewWriter(nil, COMPRESS_LEVEL)
+	return w
+}}
+
+func deflate(b []byte) []byte {
+
+	var buf bytes.Buffer
+	w := flateWriters.Get().(*flate.Writer)
+	defer flateWriters.Put(w)
+
+	w.Reset(&buf)
+	w.Write(b)
+	w.Close()
+
+	return buf.Bytes()
+}
+
+// inflate decompresses b, failing past max bytes
+func inflate(b []byte, max int) ([]byte, error) {
+
+	r := flate.NewReader(bytes.NewReader(b))
+	defer r.Close()
+
+	out, err := io.ReadAll(io.LimitReader(r, int64(max)+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(out) > max {
+		return nil, ErrFieldTooLong
+	}
+	return out, nil
+}
+
+// compressed is the payload of the frame to write for payload, deflated when
+// the node takes compressed frames and it's worth it
+func (node *Node) compressed(payload []byte) []byte {
+
+	if !node.compress || len(payload) < COMPRESS_MIN_SIZE {
+		return payload
+	}
+
+	start := time.Now()
+	m := Message{Identifier: MESSAGE_COMPRESSED, Data: deflate(payload)}
+	b, err := m.MarshalBinary()
+	elapsed := time.Since(start)
+	if err != nil || len(b) >= len(payload) {
+		return payload
+	}
+
+	node.lock.Lock()
+	defer node.lock.Unlock()
+
+	node.compression.Frames++
+	node.compression.Bytes += len(payload)
+	node.compression.CompressedBytes += len(b)
+	node.compression.CompressTime += elapsed
+	return b
+}
+
+// decompress replaces a compressed message from the node with the one inside,
+// returning its size
+func (node *Node) decompress(m *Message) (int, error) {
+
+	start := time.Now()
+	b, err := inflate(m.Data, MAX_FRAME_SIZE)
+	if err != nil {
+		return 0, err
+	}
+	*m = Message{}
+	if err := m.UnmarshalBinary(b); err != nil {
+		return 0, err
+	}
+	if m.Identifier == MESSAGE_COMPRESSED {
+		return 0, ErrNestedCompression
+	}
+
+	node.lock.Lock()
+	defer node.lock.Unlock()
+
+	node.compression.Received++
+	node.compression.ReceivedBytes += len(b)
+	node.compression.DecompressTime += time.Since(start)
+	return len(b), nil
+}
+
+func (node *Node) CompressionStats() CompressionStats {
+
+	node.lock.Lock()
+	defer node.lock.Unlock()
+
+	stats := node.compression
+	if stats.Bytes > 0 {
+		stats.Ratio = float64(stats.CompressedBytes) / float64(stats.Bytes)
+	}
+	return stats
+}
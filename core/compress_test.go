@@ -0,0 +1,132 @@
+package core
+
+import (
+	"bytes"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestCompressRoundTrip(t *testing.T) {
+
+	m := Message{Identifier: MESSAGE_SEND_BLOCK}
+	m.Data, _ = codecTestBlock(100).MarshalBinary()
+	payload, _ := m.MarshalBinary()
+
+	sender, receiver := &Node{compress: true}, &Node{}
+	b := sender.compressed(payload)
+	if len(b) >= len(payload) {
+		t.Fatal("Block not compressed", len(b), len(payload))
+	}
+
+	got := new(Message)
+	if err := got.UnmarshalBinary(b); err != nil || got.Identifier != MESSAGE_COMPRESSED {
+		t.Fatal("Not a compressed message", err)
+	}
+	if size, err := receiver.decompress(got); err != nil || size != len(payload) || got.Identifier != MESSAGE_SEND_BLOCK || !bytes.Equal(got.Data, m.Data) {
+		t.Error("Message changed through compression", err)
+	}
+
+	if s := sender.CompressionStats(); s.Frames != 1 || s.Bytes != len(payload) || s.Ratio <= 0 || s.Ratio >= 1 || s.CompressTime <= 0 {
+		t.Error("Wrong sender stats", s)
+	}
+	if s := receiver.CompressionStats(); s.Received != 1 || s.ReceivedBytes != len(payload) {
+		t.Error("Wrong receiver stats", s)
+	}
+
+	// Small frames and peers that didn't agree go as they are
+	if small := payload[:COMPRESS_MIN_SIZE-1]; !bytes.Equal(sender.compressed(small), small) {
+		t.Error("Frame under the threshold compressed")
+	}
+	if !bytes.Equal((&Node{}).compressed(payload), payload) {
+		t.Error("Frame compressed to a peer without compression")
+	}
+}
+
+func TestDecompressRejects(t *testing.T) {
+
+	if _, err := inflate(deflate(make([]byte, 2000)), 1000); err != ErrFieldTooLong {
+		t.Error("Inflated past the limit", err)
+	}
+
+	inner, _ := (&Message{Identifier: MESSAGE_COMPRESSED, Data: deflate([]byte("data"))}).MarshalBinary()
+	m := &Message{Identifier: MESSAGE_COMPRESSED, Data: deflate(inner)}
+	if _, err := (&Node{}).decompress(m); err != ErrNestedCompression {
+		t.Error("Nested compression accepted", err)
+	}
+}
+
+func TestCompressionNegotiated(t *testing.T) {
+
+	Core.Network = SetupNetwork("127.0.0.1:0", BLOCKCHAIN_PORT)
+	if slices.Contains(LocalVersion().Capabilities, MESSAGE_COMPRESSED) {
+		t.Error("Compression offered while disabled")
+	}
+
+	Core.Network.Compress = true
+	if !slices.Contains(LocalVersion().Capabilities, MESSAGE_COMPRESSED) {
+		t.Error("Compression not offered")
+	}
+
+	// Both ends in one network, the one without compressed messages gets them whole
+	l := netTestListener(t)
+	client, server := netTestPair(t, l)
+	defer client.Close()
+	out := &Node{TCPConn: client, version: &PeerVersion{Capabilities: requiredMessages}}
+	in := &Node{TCPConn: server, inbound: true}
+	Core.Nodes.AddNode(in)
+	Core.Nodes.AddNode(out)
+
+	m := Message{Identifier: MESSAGE_SEND_BLOCK}
+	m.Data, _ = codecTestBlock(50).MarshalBinary()
+	in.Send(m, QUEUE_BLOCK)
+	out.Send(m, QUEUE_BLOCK)
+
+	for range 2 {
+		select {
+		case got := <-Core.Network.incoming[LANE_BLOCK]:
+			if !bytes.Equal(got.Data, m.Data) {
+				t.Error("Message changed through compression")
+			}
+		case <-time.After(time.Second * 5):
+			t.Fatal("Message not received")
+		}
+	}
+	if in.CompressionStats().Frames != 1 || out.CompressionStats().Frames != 0 || in.CompressionStats().Received != 0 || out.CompressionStats().Received != 1 {
+		t.Error("Compressed to a peer that didn't agree", in.CompressionStats(), out.CompressionStats())
+	}
+}
+
+func TestCompressionNotOffered(t *testing.T) {
+
+	Core.Network = SetupNetwork("127.0.0.1:0", BLOCKCHAIN_PORT)
+	l := netTestListener(t)
+	client, server := netTestPair(t, l)
+	defer client.Close()
+	in := &Node{TCPConn: server, inbound: true}
+	Core.Nodes.AddNode(in)
+
+	m := Message{Identifier: MESSAGE_SEND_BLOCK}
+	m.Data, _ = codecTestBlock(50).MarshalBinary()
+	payload, _ := m.MarshalBinary()
+	WriteFrame(client, (&Node{compress: true}).compressed(payload))
+
+	netTestWait(t, "penalty", func() bool { return Core.Network.Scores.Score(in.Address(), in.ID) == PEER_PENALTY_MALFORMED })
+	if in.CompressionStats().Received != 0 {
+		t.Error("Inflated a message without compression offered")
+	}
+}
+
+func BenchmarkCompressBlock(b *testing.B) {
+
+	m := Message{Identifier: MESSAGE_SEND_BLOCK}
+	m.Data, _ = codecTestBlock(1000).MarshalBinary()
+	payload, _ := m.MarshalBinary()
+	node := &Node{compress: true}
+
+	b.SetBytes(int64(len(payload)))
+	for i := 0; i < b.N; i++ {
+		node.compressed(payload)
+	}
+	b.ReportMetric(node.CompressionStats().Ratio, "ratio")
+}
@@ -1,8 +1,10 @@
 package core
 
 import (
+	"bytes"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"os"
 	"os/user"
 	"path"
@@ -13,63 +15,169 @@ const (
 	BLOCKCHAIN_DIRECTORY  = ".blockchain/"
 
 	BLOCKHAIN_KEYS_FILENAME = "keys.json"
+
+	REJECTED_DIRECTORY = "rejected" // undecodable data from peers
+	MAX_REJECTED_FILES = 100        // per run
 )
 
-func getDirectoryWithBaseDir(dir string) string {
+// DataDirectory resolves a node data directory, which holds its keys, block
+// store, peers and reports. Empty means the shared one in the home directory.
+func DataDirectory(dir string) string {
 
-	if dir == HOME_DIRECTORY_CONFIG {
+	if dir == "" || dir == HOME_DIRECTORY_CONFIG {
 
 		usr, err := user.Current()
 		logOnError(err)
-		dir = usr.HomeDir
+		return path.Join(usr.HomeDir, BLOCKCHAIN_DIRECTORY)
 	}
 
-	return path.Join(dir, BLOCKCHAIN_DIRECTORY)
+	return dir
 }
 
+// OpenConfiguration returns nil and no error when there are no keys yet.
+// Plaintext keys written by older versions are encrypted in place.
 func OpenConfiguration(dir string) (*Keypair, error) {
 
-	dir = getDirectoryWithBaseDir(dir)
-
-	//Create ~/.blockchain directory
-	err := os.MkdirAll(dir, 0777)
-	logOnError(err)
-
-	//Search for keys file inside directory
-	f, err := os.OpenFile(path.Join(dir, BLOCKHAIN_KEYS_FILENAME), os.O_RDWR|os.O_CREATE, 0660)
-	defer f.Close()
+	dir = DataDirectory(dir)
 
+	data, err := os.ReadFile(path.Join(dir, BLOCKHAIN_KEYS_FILENAME))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
 	if err != nil {
+		return nil, err
+	}
+	if len(bytes.TrimSpace(data)) == 0 {
+		return nil, nil
+	}
 
+	encrypted, err := isEncryptedKeystore(data)
+	if err != nil {
 		return nil, err
 	}
 
-	k := &Keypair{}
-	json.NewDecoder(f).Decode(k)
+	if !encrypted {
 
-	if k == nil || k.Public == nil || k.Private == nil {
-		return nil, nil
+		k := &Keypair{}
+		if err := json.Unmarshal(data, k); err != nil {
+			return nil, err
+		}
+		if k.Public == nil || k.Private == nil {
+			return nil, nil
+		}
+
+		fmt.Println("Encrypting plaintext keys in", dir)
+		if err := writeKeystore(dir, k); err != nil {
+			fmt.Println("Keys left unencrypted:", err)
+		}
+
+		return k, nil
 	}
 
-	return k, f.Close()
+	ek := new(EncryptedKey)
+	if err := json.Unmarshal(data, ek); err != nil {
+		return nil, err
+	}
+
+	passphrase, err := KeystorePassphrase(false)
+	if err != nil {
+		return nil, err
+	}
+
+	return ek.Decrypt(passphrase)
 }
 
 func WriteConfiguration(dir string, keypair *Keypair) error {
 
 	if keypair != nil {
 
-		dir = getDirectoryWithBaseDir(dir)
+		return writeKeystore(DataDirectory(dir), keypair)
+	}
 
-		err := os.MkdirAll(dir, 0777)
-		logOnError(err)
+	return errors.New("No keypair provided to save")
+}
 
-		f, err := os.OpenFile(path.Join(dir, BLOCKHAIN_KEYS_FILENAME), os.O_RDWR|os.O_CREATE, 0660)
+func writeKeystore(dir string, keypair *Keypair) error {
 
-		err = json.NewEncoder(f).Encode(keypair)
-		logOnError(err)
+	passphrase, err := KeystorePassphrase(true)
+	if err != nil {
+		return err
+	}
+
+	return saveKeystore(dir, keypair, passphrase)
+}
 
-		return f.Close()
+func saveKeystore(dir string, keypair *Keypair, passphrase []byte) error {
+
+	ek, err := EncryptKeypair(keypair, passphrase)
+	if err != nil {
+		return err
 	}
 
-	return errors.New("No keypair provided to save")
+	data, err := json.MarshalIndent(ek, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	// Keys are only readable by the owner, including directories created by older versions
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	logOnError(os.Chmod(dir, 0700))
+
+	// Write next to the keystore and rename, so a crash can't leave a truncated file
+	file := path.Join(dir, BLOCKHAIN_KEYS_FILENAME)
+	if err := os.WriteFile(file+".tmp", data, 0600); err != nil {
+		return err
+	}
+
+	return os.Rename(file+".tmp", file)
+}
+
+// CreateIdentities sets up a data directory with its own keys for every
+// address of a local cluster, each node listing the others as peers and all
+// of them as proof of authority validators
+func CreateIdentities(base string, addresses []string, scheme byte) ([]string, error) {
+
+	passphrase, err := KeystorePassphrase(true)
+	if err != nil {
+		return nil, err
+	}
+
+	dirs := make([]string, len(addresses))
+	validators := make([][]byte, len(addresses))
+	for i := range addresses {
+
+		dirs[i] = path.Join(base, fmt.Sprintf("node%d", i))
+		if _, err := os.Stat(path.Join(dirs[i], BLOCKHAIN_KEYS_FILENAME)); err == nil {
+			return nil, fmt.Errorf("%s already has keys", dirs[i])
+		}
+
+		keypair, err := GenerateKeypair(scheme)
+		if err != nil {
+			return nil, err
+		}
+		if err := saveKeystore(dirs[i], keypair, passphrase); err != nil {
+			return nil, err
+		}
+		validators[i] = keypair.Public
+
+		peers := []string{}
+		for j, a := range addresses {
+			if j != i {
+				peers = append(peers, a)
+			}
+		}
+		if err := SavePeers(dirs[i], peers); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, d := range dirs {
+		if err := SaveValidators(d, validators); err != nil {
+			return nil, err
+		}
+	}
+
+	return dirs, nil
 }
@@ -0,0 +1,187 @@
+package core
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+)
+
+// Consensus decides who produces the next block and which blocks join the chain
+type Consensus interface {
+	Name() string
+
+	// Propose builds the block at height with assemble and seals it, or
+	// returns ErrNotProposer when another node produces that block
+	Propose(height int, assemble func() Block) (*Block, error)
+
+	// Validate checks a sealed block, ours or a peer's, before it's finalized
+	Validate(b *Block, height int) error
+
+	// Finalize makes a validated block part of the chain
+	Finalize(b *Block, height int) error
+}
+
+// FinalityWaiter is implemented by engines that make blocks final on their
+// own, which can take view changes. AcceptBlock waits for it after Finalize,
+// without holding up other blocks.
+type FinalityWaiter interface {
+	WaitFinal(b *Block, height int) error
+}
+
+const (
+	CONSENSUS_POW  = "pow"
+	CONSENSUS_POA  = "poa"
+	CONSENSUS_PBFT = "pbft"
+)
+
+var (
+	ErrNotProposer   = errors.New("Not this node's turn to propose")
+	ErrBlockInChain  = errors.New("Block already in the chain")
+	ErrUnknownParent = errors.New("Block doesn't extend the chain head")
+)
+
+// NewConsensus returns the engine called name, engines that need a
+// configuration read it from the data directory
+func NewConsensus(name string, bl *Blockchain, dataDir string) (Consensus, error) {
+
+	switch name {
+	case "", CONSENSUS_POW:
+		return NewProofOfWork(bl, BLOCK_POW), nil
+
+	case CONSENSUS_POA:
+		validators, err := LoadValidators(dataDir)
+		if err != nil {
+			return nil, err
+		}
+		return NewProofOfAuthority(bl, validators)
+
+	case CONSENSUS_PBFT:
+		validators, err := LoadValidators(dataDir)
+		if err != nil {
+			return nil, err
+		}
+		return NewPBFT(bl, validators, Core.Keypair, NetworkTransport{})
+	}
+
+	return nil, fmt.Errorf("Unknown consensus %q, expected %s, %s or %s", name, CONSENSUS_POW, CONSENSUS_POA, CONSENSUS_PBFT)
+}
+
+// ProposeBlock asks the consensus engine for the next block and adds it to the
+// chain. Transactions of a block that doesn't make it go back to the mempool,
+// unless the engine got the block into the chain on its own.
+func (bl *Blockchain) ProposeBlock(assemble func() Block) (*Block, error) {
+
+	_, height := bl.Head()
+	b, err := bl.Consensus.Propose(height+1, assemble)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := bl.AcceptBlock(b); err != nil {
+		if existing, _ := bl.BlockByHash(b.Hash()); existing != nil {
+			return b, nil
+		}
+		for i := range *b.TransactionSlice {
+			if t := &(*b.TransactionSlice)[i]; !bl.inChain(t) {
+				bl.Mempool.Add(t)
+			}
+		}
+		return nil, err
+	}
+
+	return b, nil
+}
+
+// AcceptBlock validates a block extending the chain head and finalizes it
+func (bl *Blockchain) AcceptBlock(b *Block) error {
+
+	height, err := bl.finalize(b)
+	if err != nil {
+		return err
+	}
+	if w, ok := bl.Consensus.(FinalityWaiter); ok {
+		return w.WaitFinal(b, height)
+	}
+	return nil
+}
+
+// finalize runs a block through the engine one at a time, returning its height
+func (bl *Blockchain) finalize(b *Block) (int, error) {
+
+	bl.acceptLock.Lock()
+	defer bl.acceptLock.Unlock()
+
+	if existing, _ := bl.BlockByHash(b.Hash()); existing != nil {
+		return 0, ErrBlockInChain
+	}
+
+	head, height := bl.Head()
+	if !extendsBlock(b, head) {
+		return 0, ErrUnknownParent
+	}
+
+	if err := bl.Consensus.Validate(b, height+1); err != nil {
+		return 0, err
+	}
+
+	return height + 1, bl.Consensus.Finalize(b, height+1)
+}
+
+// CommitBlock adds a final block to the chain and drops its transactions from the mempool
+func (bl *Blockchain) CommitBlock(b *Block) {
+
+	bl.AddBlock(*b)
+	for i := range *b.TransactionSlice {
+		bl.Mempool.Remove((*b.TransactionSlice)[i].Hash())
+	}
+}
+
+// extendsBlock tells if b comes right after parent, nil parent being the empty chain
+func extendsBlock(b *Block, parent *Block) bool {
+
+	if parent == nil {
+		return bytes.Equal(b.PrevBlock, make([]byte, HASH_SIZE)) || len(b.PrevBlock) == 0
+	}
+	return bytes.Equal(b.PrevBlock, parent.Hash())
+}
+
+// ProofOfWork lets any node propose, blocks carry a nonce meeting Difficulty
+type ProofOfWork struct {
+	Chain      *Blockchain
+	Difficulty []byte // prefix of the block hash
+}
+
+func NewProofOfWork(bl *Blockchain, difficulty []byte) *ProofOfWork {
+
+	return &ProofOfWork{Chain: bl, Difficulty: difficulty}
+}
+
+func (c *ProofOfWork) Name() string { return CONSENSUS_POW }
+
+func (c *ProofOfWork) Propose(height int, assemble func() Block) (*Block, error) {
+
+	b := assemble()
+	b.BlockHeader.Nonce = b.GenerateNonce(c.Difficulty)
+
+	sig, err := Core.Keypair.Sign(b.Hash())
+	if err != nil {
+		return nil, err
+	}
+	b.Signature = sig
+
+	return &b, nil
+}
+
+func (c *ProofOfWork) Validate(b *Block, height int) error {
+
+	if !b.VerifyBlock(c.Difficulty) {
+		return errors.New("Block fails merkle root, proof of work or signature")
+	}
+	return nil
+}
+
+func (c *ProofOfWork) Finalize(b *Block, height int) error {
+
+	c.Chain.CommitBlock(b)
+	return nil
+}
@@ -0,0 +1,94 @@
+package core
+
+import (
+	"testing"
+)
+
+func TestProofOfWorkConsensus(t *testing.T) {
+
+	Core.Keypair = GenerateNewKeypair()
+	bl := SetupBlockchan()
+	bl.Consensus = NewProofOfWork(bl, TEST_BLOCK_POW)
+
+	tr := codecTestTransaction()
+	bl.Mempool.Add(tr)
+
+	b, err := bl.ProposeBlock(bl.AssembleBlock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !CheckProofOfWork(TEST_BLOCK_POW, b.Hash()) || bl.Mempool.Len() != 0 {
+		t.Error("Block not mined or transactions left in the mempool")
+	}
+	if _, height := bl.FindTransaction(tr.Hash()); height != 0 {
+		t.Error("Transaction not in the chain")
+	}
+
+	if err := bl.AcceptBlock(b); err != ErrBlockInChain {
+		t.Error("Block accepted twice", err)
+	}
+
+	// A block on top of an older head
+	stale := bl.CreateNewBlock()
+	stale.BlockHeader.PrevBlock = make([]byte, HASH_SIZE)
+	if err := bl.AcceptBlock(&stale); err != ErrUnknownParent {
+		t.Error("Block not extending the head accepted", err)
+	}
+
+	next := bl.CreateNewBlock()
+	next.BlockHeader.MerkelRoot = next.GenerateMerkelRoot()
+	next.Signature = next.Sign(Core.Keypair)
+	if err := bl.AcceptBlock(&next); err == nil {
+		t.Error("Block without proof of work accepted")
+	}
+}
+
+func TestProofOfAuthorityConsensus(t *testing.T) {
+
+	validators := []*Keypair{GenerateNewKeypair(), GenerateNewKeypair(), GenerateNewKeypair()}
+	keys := [][]byte{}
+	for _, v := range validators {
+		keys = append(keys, v.Public)
+	}
+
+	Core.Keypair = validators[1]
+	bl := SetupBlockchan()
+	poa, _ := NewProofOfAuthority(bl, keys)
+	bl.Consensus = poa
+
+	tr := codecTestTransaction()
+	bl.Mempool.Add(tr)
+
+	if _, err := bl.ProposeBlock(bl.AssembleBlock); err != ErrNotProposer || bl.Mempool.Len() != 1 {
+		t.Fatal("Proposed out of turn", err)
+	}
+
+	// Validator 0 signs the first block
+	first := bl.CreateNewBlock()
+	first.BlockHeader.Origin = validators[0].Public
+	first.BlockHeader.MerkelRoot = first.GenerateMerkelRoot()
+	first.Signature = first.Sign(validators[0])
+	if err := bl.AcceptBlock(&first); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := bl.ProposeBlock(bl.AssembleBlock)
+	if err != nil || string(b.Origin) != string(validators[1].Public) {
+		t.Fatal("Validator 1 didn't propose the second block", err)
+	}
+	if _, height := bl.FindTransaction(tr.Hash()); height != 1 {
+		t.Error("Transaction not in the second block")
+	}
+
+	// Validator 1 again instead of 2
+	third := bl.CreateNewBlock()
+	third.BlockHeader.MerkelRoot = third.GenerateMerkelRoot()
+	third.Signature = third.Sign(validators[1])
+	if err := bl.AcceptBlock(&third); err == nil {
+		t.Error("Block out of turn accepted")
+	}
+
+	if _, err := NewProofOfAuthority(bl, nil); err == nil {
+		t.Error("Empty validator set accepted")
+	}
+}
@@ -3,13 +3,21 @@ package core
 import _ "fmt"
 
 	const (
-	BLOCKCHAIN_PORT      = "1992"
-	MAX_NODE_CONNECTIONS = 400
+	BLOCKCHAIN_PORT          = "1992"
+	RPC_PORT                 = "1993"
+	MAX_NODE_CONNECTIONS     = 400
+	MAX_OUTBOUND_CONNECTIONS = 32 // dialed by us, the rest of MAX_NODE_CONNECTIONS are inbound
 
-	NETWORK_KEY_SIZE = 88
+	NETWORK_KEY_SIZE = 88 // max length of base58 keys and signatures
+	HASH_SIZE        = 32
 
-	TRANSACTION_HEADER_SIZE = NETWORK_KEY_SIZE /* from key */ + NETWORK_KEY_SIZE /* to key */ + 4 /* int32 timestamp */ + 32 /* sha256 payload hash */ + 4 /* int32 payload length */ + 4 /* int32 nonce */
-	BLOCK_HEADER_SIZE       = NETWORK_KEY_SIZE /* origin key */ + 4 /* int32 timestamp */ + 32 /* prev block hash */ + 32 /* merkel tree hash */ + 4                                      /* int32 nonce */
+	CODEC_VERSION    = 1
+	MAX_PAYLOAD_SIZE = 1024 * 1024 * 4
+	MAX_FRAME_SIZE   = 1024 * 1024 * 64
+
+	PROTOCOL_VERSION     = 1 // of the messages, bumped on changes older peers can't follow
+	MIN_PROTOCOL_VERSION = 1 // oldest peers still accepted
+	DEFAULT_CHAIN_ID     = 1 // peers on other chains are rejected
 
 	KEY_POW_COMPLEXITY      = 0
 	TEST_KEY_POW_COMPLEXITY = 0
@@ -20,13 +28,15 @@ import _ "fmt"
 	BLOCK_POW_COMPLEXITY      = 2
 	TEST_BLOCK_POW_COMPLEXITY = 2
 
-	KEY_SIZE = 28
+	KEY_SIZE = 32 // P-256 coordinates are padded to this length when joined
+
+	SIGNATURE_SCHEME_P256    = 0
+	SIGNATURE_SCHEME_ED25519 = 1
 
 	POW_PREFIX      = 0
 	TEST_POW_PREFIX = 0
 
-	MESSAGE_TYPE_SIZE    = 1
-	MESSAGE_OPTIONS_SIZE = 4
+	MESSAGE_OPTIONS_SIZE = 4 // max length of message options
 )
 
 const (
@@ -38,6 +48,29 @@ const (
 
 	MESSAGE_GET_BLOCK
 	MESSAGE_SEND_BLOCK
+
+	MESSAGE_PBFT_PRE_PREPARE
+	MESSAGE_PBFT_PREPARE
+	MESSAGE_PBFT_COMMIT
+	MESSAGE_PBFT_VIEW_CHANGE
+	MESSAGE_PBFT_NEW_VIEW
+
+	MESSAGE_PING
+	MESSAGE_PONG
+
+	MESSAGE_VERSION
+	MESSAGE_REJECT
+
+	MESSAGE_SEND_COMPACT_BLOCK
+	MESSAGE_GET_BLOCK_TRANSACTIONS
+	MESSAGE_SEND_BLOCK_TRANSACTIONS
+
+	MESSAGE_INV
+	MESSAGE_GET_DATA
+
+	MESSAGE_SEND_TRANSACTIONS
+
+	MESSAGE_COMPRESSED
 )
 
 func SEED_NODES() []string {
@@ -59,4 +92,34 @@ const (
 	//BLOCK_WINDOWN_SIZE = 10
 	//BLOCK_WINDOWN_OMIT       = 5
 	BLOCK_BROADCAST_INTERVAL = 6
+
+	MIN_RELAY_FEE_RATE = 1 // fee units per byte of marshalled transaction
+
+	PBFT_VIEW_TIMEOUT = 20   // seconds replicas wait on a leader, doubled on every view change
+	PBFT_QUEUE_SIZE   = 4096 // consensus messages waiting to be handled or sent
+	PBFT_MAX_PENDING  = 4096 // messages kept for a later view or height
+	PBFT_CERTIFICATES = 1024 // commit certificates kept for the latest heights
+
+	GOSSIP_FANOUT          = 0      // peers a broadcast goes to, 0 for all of them
+	GOSSIP_TTL             = 1      // hops a broadcast travels, 1 for direct peers only
+	GOSSIP_SEEN_CACHE_SIZE = 100000 // message hashes remembered to drop copies
+	GOSSIP_OPTIONS_SIZE    = 4      // hops left and 24 bits of send time
+
+	PEER_BAN_SCORE    = 100  // banned on reaching it
+	PEER_BAN_DURATION = 3600 // seconds
+	PEER_SCORE_WINDOW = 600  // seconds penalties add up over
+
+	PEER_RECONNECT_INTERVAL = 10 // seconds between dialing the preferred peers we lost
+	PEER_HANDSHAKE_TIMEOUT  = 5  // seconds a new connection has to authenticate
+	PEER_PING_INTERVAL      = 15 // seconds between pings measuring round trip time
+	PEER_PING_TIMEOUT       = 20 // seconds a ping waits for its pong before the peer is evicted
+	PEER_IDLE_TIMEOUT       = 90 // seconds without traffic before the peer is evicted
+
+	PEER_PENALTY_MALFORMED           = 25 // undecodable message, transaction or block
+	PEER_PENALTY_INVALID_SIGNATURE   = 50
+	PEER_PENALTY_INVALID_TRANSACTION = 10
+	PEER_PENALTY_BAD_BLOCK           = 50
+	PEER_PENALTY_REPEATED_MESSAGE    = 5
+
+	FAULT_QUEUE_SIZE = 10000 // messages held back per peer by injected latency, more are dropped
 )
@@ -2,68 +2,253 @@ package core
 
 import (
 	"crypto/ecdsa"
+	"crypto/ed25519"
 	"crypto/elliptic"
 	"crypto/rand"
+	"errors"
+	"fmt"
 	"math/big"
+	"strings"
 
 	"github.com/izqui/helpers"
 	"github.com/tv42/base58"
 )
 
+// Signer signs hashes under a given signature scheme
+type Signer interface {
+	Scheme() byte
+	Sign(hash []byte) ([]byte, error)
+}
+
+// Verifier checks signatures produced by a Signer of the same scheme
+type Verifier interface {
+	Scheme() byte
+	Verify(publicKey, sig, hash []byte) bool
+}
+
+type signatureScheme interface {
+	Verifier
+	Name() string
+	GenerateKeypair() (*Keypair, error)
+	Sign(k *Keypair, hash []byte) ([]byte, error)
+}
+
+var signatureSchemes = map[byte]signatureScheme{
+	SIGNATURE_SCHEME_P256:    p256Scheme{},
+	SIGNATURE_SCHEME_ED25519: ed25519Scheme{},
+}
+
 // Key generation with proof of work
 type Keypair struct {
-	Public  []byte `json:"public"`  // base58 (x y)
-	Private []byte `json:"private"` // d (base58 encoded)
+	Public          []byte `json:"public"`           // base58 (x y)
+	Private         []byte `json:"private"`          // d (base58 encoded)
+	SignatureScheme byte   `json:"scheme,omitempty"` // P-256 if missing
 }
 
 func GenerateNewKeypair() *Keypair {
 
-	pk, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	kp, _ := GenerateKeypair(SIGNATURE_SCHEME_P256)
+	return kp
+}
+
+func GenerateKeypair(scheme byte) (*Keypair, error) {
+
+	s, err := getSignatureScheme(scheme)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.GenerateKeypair()
+}
+
+func (k *Keypair) Scheme() byte {
+
+	return k.SignatureScheme
+}
+
+func (k *Keypair) Sign(hash []byte) ([]byte, error) {
+
+	s, err := getSignatureScheme(k.SignatureScheme)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.Sign(k, hash)
+}
+
+// SignatureVerify checks a P-256 signature, kept for callers that predate signature schemes
+func SignatureVerify(publicKey, sig, hash []byte) bool {
+
+	return p256Scheme{}.Verify(publicKey, sig, hash)
+}
+
+func VerifySignature(scheme byte, publicKey, sig, hash []byte) bool {
+
+	v, err := VerifierForScheme(scheme)
+	if err != nil {
+		return false
+	}
+
+	return v.Verify(publicKey, sig, hash)
+}
+
+func VerifierForScheme(scheme byte) (Verifier, error) {
+
+	return getSignatureScheme(scheme)
+}
+
+func SignatureSchemeName(scheme byte) string {
+
+	if s, err := getSignatureScheme(scheme); err == nil {
+		return s.Name()
+	}
+	return fmt.Sprintf("unknown(%d)", scheme)
+}
+
+func ParseSignatureScheme(name string) (byte, error) {
+
+	for b, s := range signatureSchemes {
+		if strings.EqualFold(s.Name(), name) {
+			return b, nil
+		}
+	}
+	return 0, fmt.Errorf("Unknown signature scheme %q", name)
+}
+
+func getSignatureScheme(scheme byte) (signatureScheme, error) {
+
+	s, ok := signatureSchemes[scheme]
+	if !ok {
+		return nil, fmt.Errorf("Unknown signature scheme %d", scheme)
+	}
+	return s, nil
+}
+
+// ECDSA over P-256, public key and signature are base58 encoded joined big integers
+type p256Scheme struct{}
+
+func (p256Scheme) Scheme() byte { return SIGNATURE_SCHEME_P256 }
+
+func (p256Scheme) Name() string { return "p256" }
+
+func (p256Scheme) GenerateKeypair() (*Keypair, error) {
+
+	pk, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
 
 	b := bigJoin(KEY_SIZE, pk.PublicKey.X, pk.PublicKey.Y)
 
 	public := base58.EncodeBig([]byte{}, b)
 	private := base58.EncodeBig([]byte{}, pk.D)
 
-	kp := Keypair{Public: public, Private: private}
-
-	return &kp
+	return &Keypair{Public: public, Private: private, SignatureScheme: SIGNATURE_SCHEME_P256}, nil
 }
 
-func (k *Keypair) Sign(hash []byte) ([]byte, error) {
+func (p256Scheme) Sign(k *Keypair, hash []byte) ([]byte, error) {
 
 	d, err := base58.DecodeToBig(k.Private)
 	if err != nil {
 		return nil, err
 	}
 
-	b, _ := base58.DecodeToBig(k.Public)
+	b, err := base58.DecodeToBig(k.Public)
+	if err != nil {
+		return nil, err
+	}
 
-	pub := splitBig(b, 2)
-	x, y := pub[0], pub[1]
+	x, y := splitJoined(b, KEY_SIZE)
 
-	key := ecdsa.PrivateKey{ecdsa.PublicKey{elliptic.P256(), x, y}, d}
+	key := ecdsa.PrivateKey{PublicKey: ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}, D: d}
 
-	r, s, _ := ecdsa.Sign(rand.Reader, &key, hash)
+	r, s, err := ecdsa.Sign(rand.Reader, &key, hash)
+	if err != nil {
+		return nil, err
+	}
 
 	return base58.EncodeBig([]byte{}, bigJoin(KEY_SIZE, r, s)), nil
 }
 
-func SignatureVerify(publicKey, sig, hash []byte) bool {
+func (p256Scheme) Verify(publicKey, sig, hash []byte) bool {
 
-	b, _ := base58.DecodeToBig(publicKey)
-	publ := splitBig(b, 2)
-	x, y := publ[0], publ[1]
+	b, err := base58.DecodeToBig(publicKey)
+	if err != nil {
+		return false
+	}
+	x, y := splitJoined(b, KEY_SIZE)
 
-	b, _ = base58.DecodeToBig(sig)
-	sigg := splitBig(b, 2)
-	r, s := sigg[0], sigg[1]
+	b, err = base58.DecodeToBig(sig)
+	if err != nil {
+		return false
+	}
+	r, s := splitJoined(b, KEY_SIZE)
 
-	pub := ecdsa.PublicKey{elliptic.P256(), x, y}
+	pub := ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}
 
 	return ecdsa.Verify(&pub, hash, r, s)
 }
 
+// Ed25519, public key, private seed and signature are base58 encoded fixed size byte strings
+type ed25519Scheme struct{}
+
+func (ed25519Scheme) Scheme() byte { return SIGNATURE_SCHEME_ED25519 }
+
+func (ed25519Scheme) Name() string { return "ed25519" }
+
+func (ed25519Scheme) GenerateKeypair() (*Keypair, error) {
+
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Keypair{Public: encodeBase58Bytes(pub), Private: encodeBase58Bytes(priv.Seed()), SignatureScheme: SIGNATURE_SCHEME_ED25519}, nil
+}
+
+func (ed25519Scheme) Sign(k *Keypair, hash []byte) ([]byte, error) {
+
+	seed, err := decodeBase58Bytes(k.Private, ed25519.SeedSize)
+	if err != nil {
+		return nil, err
+	}
+
+	return encodeBase58Bytes(ed25519.Sign(ed25519.NewKeyFromSeed(seed), hash)), nil
+}
+
+func (ed25519Scheme) Verify(publicKey, sig, hash []byte) bool {
+
+	pub, err := decodeBase58Bytes(publicKey, ed25519.PublicKeySize)
+	if err != nil {
+		return false
+	}
+	s, err := decodeBase58Bytes(sig, ed25519.SignatureSize)
+	if err != nil {
+		return false
+	}
+
+	return ed25519.Verify(pub, hash, s)
+}
+
+func encodeBase58Bytes(b []byte) []byte {
+
+	return base58.EncodeBig([]byte{}, new(big.Int).SetBytes(b))
+}
+
+// decodeBase58Bytes restores the leading zeros a big integer encoding drops
+func decodeBase58Bytes(d []byte, size int) ([]byte, error) {
+
+	b, err := base58.DecodeToBig(d)
+	if err != nil {
+		return nil, err
+	}
+	if b.BitLen() > size*8 {
+		return nil, errors.New("Base58 value too long")
+	}
+
+	return b.FillBytes(make([]byte, size)), nil
+}
+
 func bigJoin(expectedLen int, bigs ...*big.Int) *big.Int {
 
 	bs := []byte{}
@@ -84,6 +269,20 @@ func bigJoin(expectedLen int, bigs ...*big.Int) *big.Int {
 	return b
 }
 
+// splitJoined undoes bigJoin for two values, taking the second from the
+// right so leading zeros of the first one don't shift the split
+func splitJoined(b *big.Int, size int) (*big.Int, *big.Int) {
+
+	if b.BitLen() > 2*size*8 {
+		parts := splitBig(b, 2)
+		return parts[0], parts[1]
+	}
+
+	bs := b.FillBytes(make([]byte, 2*size))
+
+	return new(big.Int).SetBytes(bs[:size]), new(big.Int).SetBytes(bs[size:])
+}
+
 func splitBig(b *big.Int, parts int) []*big.Int {
 
 	bs := b.Bytes()
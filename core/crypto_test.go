@@ -36,3 +36,98 @@ func TestKeySigning(t *testing.T) {
 	}
 
 }
+
+func TestEd25519Signing(t *testing.T) {
+
+	for i := 0; i < 5; i++ {
+		keypair, err := GenerateKeypair(SIGNATURE_SCHEME_ED25519)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		hash := helpers.SHA256(helpers.ArrayOfBytes(i, 'a'))
+		signature, err := keypair.Sign(hash)
+
+		if err != nil {
+
+			t.Error(err)
+
+		} else if !VerifySignature(SIGNATURE_SCHEME_ED25519, keypair.Public, signature, hash) {
+
+			t.Error("Ed25519 signing and verifying error")
+
+		} else if VerifySignature(SIGNATURE_SCHEME_P256, keypair.Public, signature, hash) {
+
+			t.Error("Ed25519 signature verified as P-256")
+		}
+	}
+}
+
+func TestEd25519TransactionVerification(t *testing.T) {
+
+	pow := helpers.ArrayOfBytes(TEST_TRANSACTION_POW_COMPLEXITY, TEST_POW_PREFIX)
+
+	kp, _ := GenerateKeypair(SIGNATURE_SCHEME_ED25519)
+	tr := NewTransaction(kp.Public, nil, []byte(helpers.RandomString(helpers.RandomInt(0, 1024))))
+	tr.Header.Scheme = kp.Scheme()
+	tr.Header.Nonce = tr.GenerateNonce(pow)
+	tr.Signature = tr.Sign(kp)
+
+	if len(tr.Signature) > NETWORK_KEY_SIZE || !tr.VerifyTransaction(pow) {
+		t.Error("Ed25519 transaction validation failing")
+	}
+}
+
+func TestParseSignatureScheme(t *testing.T) {
+
+	for _, scheme := range []byte{SIGNATURE_SCHEME_P256, SIGNATURE_SCHEME_ED25519} {
+		if s, err := ParseSignatureScheme(SignatureSchemeName(scheme)); err != nil || s != scheme {
+			t.Error("Signature scheme name doesn't round trip", scheme)
+		}
+	}
+	if _, err := GenerateKeypair(0xff); err == nil {
+		t.Error("Generated keypair for unknown scheme")
+	}
+}
+
+func benchmarkSign(b *testing.B, scheme byte) {
+
+	kp, _ := GenerateKeypair(scheme)
+	hash := helpers.SHA256([]byte("benchmark"))
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		kp.Sign(hash)
+	}
+}
+
+func benchmarkVerify(b *testing.B, scheme byte) {
+
+	kp, _ := GenerateKeypair(scheme)
+	hash := helpers.SHA256([]byte("benchmark"))
+	sig, _ := kp.Sign(hash)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		VerifySignature(scheme, kp.Public, sig, hash)
+	}
+}
+
+func BenchmarkSignP256(b *testing.B)      { benchmarkSign(b, SIGNATURE_SCHEME_P256) }
+func BenchmarkSignEd25519(b *testing.B)   { benchmarkSign(b, SIGNATURE_SCHEME_ED25519) }
+func BenchmarkVerifyP256(b *testing.B)    { benchmarkVerify(b, SIGNATURE_SCHEME_P256) }
+func BenchmarkVerifyEd25519(b *testing.B) { benchmarkVerify(b, SIGNATURE_SCHEME_ED25519) }
+
+func TestP256KeysWithLeadingZeros(t *testing.T) {
+
+	// Roughly one in a hundred keys has a coordinate or signature half starting with a zero byte
+	hash := helpers.SHA256([]byte("leading zeros"))
+	for i := 0; i < 500; i++ {
+		keypair := GenerateNewKeypair()
+		signature, err := keypair.Sign(hash)
+
+		if err != nil || !SignatureVerify(keypair.Public, signature, hash) {
+			t.Fatal("Signing and verifying error", err)
+		}
+	}
+}
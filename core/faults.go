@@ -0,0 +1,264 @@
+package core
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net"
+	"os"
+	"slices"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Faults injected into the traffic to peers, so a cluster on one machine can
+// be benchmarked over a slow, lossy or split network. Latency, jitter, loss
+// and the bandwidth cap apply to every message a node sends. Partitions drop
+// the messages between nodes of different groups both ways and keep them from
+// dialing each other. Inbound peers on loopback come from ports no group
+// lists, the side that dialed cuts those connections.
+
+// FaultRules are the faults in force, the zero value injects none
+type FaultRules struct {
+	At        int        `json:"at,omitempty"`        // seconds into the scenario the step starts
+	Latency   int        `json:"latency,omitempty"`   // milliseconds every message is held back
+	Jitter    int        `json:"jitter,omitempty"`    // up to this many milliseconds more, at random
+	Loss      float64    `json:"loss,omitempty"`      // share of messages dropped, 0 to 1
+	Bandwidth int        `json:"bandwidth,omitempty"` // bytes per second sent to each peer, 0 for no cap
+	Partition [][]string `json:"partition,omitempty"` // groups of addresses, or hosts, cut off from each other
+}
+
+// FaultScenario is read from a scenario file or the setFaults RPC. Its rules
+// apply from the start, or its steps replace each other at their times.
+type FaultScenario struct {
+	FaultRules
+	Steps []FaultRules `json:"steps,omitempty"`
+}
+
+type FaultsInfo struct {
+	Elapsed int          `json:"elapsed"` // seconds since the scenario started
+	Rules   FaultRules   `json:"rules"`   // in force
+	Steps   []FaultRules `json:"steps"`
+	Dropped uint64       `json:"dropped"` // messages lost, cut off or over FAULT_QUEUE_SIZE
+	Delayed uint64       `json:"delayed"`
+}
+
+type Faults struct {
+	Self string // our listening address, finds our partition group
+
+	lock  sync.Mutex
+	steps []FaultRules
+	start time.Time
+
+	dropped atomic.Uint64
+	delayed atomic.Uint64
+}
+
+func NewFaults(self string) *Faults {
+
+	return &Faults{Self: self, start: time.Now()}
+}
+
+func LoadFaultScenario(file string) (FaultScenario, error) {
+
+	s := FaultScenario{}
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return s, err
+	}
+	if err := json.Unmarshal(data, &s); err != nil {
+		return s, err
+	}
+	return s, s.Validate()
+}
+
+func (s FaultScenario) Validate() error {
+
+	for _, r := range append([]FaultRules{s.FaultRules}, s.Steps...) {
+		if r.Loss < 0 || r.Loss > 1 {
+			return fmt.Errorf("Loss of %g, must be between 0 and 1", r.Loss)
+		}
+		if r.At < 0 || r.Latency < 0 || r.Jitter < 0 || r.Bandwidth < 0 {
+			return errors.New("Fault times and bandwidth can't be negative")
+		}
+	}
+	return nil
+}
+
+// Set replaces the faults with the scenario, starting it over
+func (f *Faults) Set(s FaultScenario) {
+
+	steps := slices.Clone(s.Steps)
+	if len(steps) == 0 {
+		steps = []FaultRules{s.FaultRules}
+	}
+	sort.SliceStable(steps, func(i, j int) bool { return steps[i].At < steps[j].At })
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	f.steps, f.start = steps, time.Now()
+}
+
+// Rules gives the latest step started
+func (f *Faults) Rules() FaultRules {
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	return f.rules(time.Since(f.start))
+}
+
+func (f *Faults) rules(elapsed time.Duration) FaultRules {
+
+	rules := FaultRules{}
+	for _, s := range f.steps {
+		if time.Duration(s.At)*time.Second > elapsed {
+			break
+		}
+		rules = s
+	}
+	return rules
+}
+
+func (f *Faults) Info() FaultsInfo {
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	elapsed := time.Since(f.start)
+	return FaultsInfo{Elapsed: int(elapsed.Seconds()), Rules: f.rules(elapsed), Steps: slices.Clone(f.steps), Dropped: f.dropped.Load(), Delayed: f.delayed.Load()}
+}
+
+// Partitioned tells if the peer at address is in another group than us
+func (f *Faults) Partitioned(address string) bool {
+
+	return f.Rules().partitioned(f.Self, address)
+}
+
+func (r FaultRules) partitioned(self, address string) bool {
+
+	ours := slices.IndexFunc(r.Partition, func(g []string) bool { return faultGroupHas(g, self) })
+	theirs := slices.IndexFunc(r.Partition, func(g []string) bool { return faultGroupHas(g, address) })
+	return ours >= 0 && theirs >= 0 && ours != theirs
+}
+
+// faultGroupHas matches addresses, and hosts given without a port
+func faultGroupHas(group []string, address string) bool {
+
+	host, _, _ := net.SplitHostPort(address)
+	for _, a := range group {
+		if a == address || a == host {
+			return true
+		}
+	}
+	return false
+}
+
+// delay is the latency with its jitter
+func (r FaultRules) delay() time.Duration {
+
+	d := time.Duration(r.Latency) * time.Millisecond
+	if r.Jitter > 0 {
+		d += time.Duration(rand.Int64N(int64(r.Jitter) * int64(time.Millisecond)))
+	}
+	return d
+}
+
+// Wrap puts the faults in front of writes to the peer at address
+func (f *Faults) Wrap(conn net.Conn, address string) net.Conn {
+
+	return &faultConn{Conn: conn, faults: f, address: address}
+}
+
+// faultConn takes every Write as one message, a frame or the frames a
+// peer's writer batched
+type faultConn struct {
+	net.Conn
+	faults  *Faults
+	address string
+
+	lock    sync.Mutex
+	queue   []faultWrite
+	sending bool      // a goroutine is writing the queue
+	busy    time.Time // when the bandwidth cap lets the next message out
+}
+
+type faultWrite struct {
+	data []byte
+	at   time.Time
+}
+
+func (c *faultConn) Write(b []byte) (int, error) {
+
+	rules := c.faults.Rules()
+	if rules.partitioned(c.faults.Self, c.address) || rules.Loss > 0 && rand.Float64() < rules.Loss {
+		c.faults.dropped.Add(1)
+		return len(b), nil
+	}
+
+	now := time.Now()
+	at := now
+
+	c.lock.Lock()
+	if len(c.queue) >= FAULT_QUEUE_SIZE {
+		c.lock.Unlock()
+		c.faults.dropped.Add(1)
+		return len(b), nil
+	}
+	if rules.Bandwidth > 0 {
+		if c.busy.After(at) {
+			at = c.busy
+		}
+		c.busy = at.Add(time.Duration(len(b)) * time.Second / time.Duration(rules.Bandwidth))
+		at = c.busy
+	}
+	at = at.Add(rules.delay())
+
+	if !at.After(now) && !c.sending {
+		c.lock.Unlock()
+		return c.Conn.Write(b)
+	}
+
+	// Held back messages keep their order, like on a TCP link
+	c.queue = append(c.queue, faultWrite{data: slices.Clone(b), at: at})
+	if !c.sending {
+		c.sending = true
+		go c.drain()
+	}
+	c.lock.Unlock()
+
+	c.faults.delayed.Add(1)
+	return len(b), nil
+}
+
+// drain writes the queue as messages come due, until it's empty
+func (c *faultConn) drain() {
+
+	for {
+		c.lock.Lock()
+		if len(c.queue) == 0 {
+			c.sending = false
+			c.lock.Unlock()
+			return
+		}
+		w := c.queue[0]
+		c.queue = c.queue[1:]
+		c.lock.Unlock()
+
+		time.Sleep(time.Until(w.at))
+		if _, err := c.Conn.Write(w.data); err != nil {
+			// The reading side sees the close and removes the node
+			networkError(err)
+			c.Conn.Close()
+
+			c.lock.Lock()
+			c.queue, c.sending = nil, false
+			c.lock.Unlock()
+			return
+		}
+	}
+}
@@ -0,0 +1,143 @@
+package core
+
+import (
+	"bufio"
+	"bytes"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+func TestFaultScenario(t *testing.T) {
+
+	f := NewFaults("127.0.0.1:19920")
+	f.Set(FaultScenario{Steps: []FaultRules{
+		{At: 60, Partition: [][]string{{"127.0.0.1:19920", "127.0.0.1:19921"}, {"127.0.0.1:19922", "10.0.0.5"}}},
+		{At: 0, Latency: 50},
+	}})
+
+	if r := f.Rules(); r.Latency != 50 || f.Partitioned("127.0.0.1:19922") {
+		t.Error("Wrong first step", r)
+	}
+
+	r := f.rules(time.Minute)
+	for address, cut := range map[string]bool{
+		"127.0.0.1:19921": false,
+		"127.0.0.1:19922": true,
+		"10.0.0.5:1992":   true,
+		"127.0.0.1:40000": false, // an inbound peer no group lists
+	} {
+		if r.partitioned(f.Self, address) != cut {
+			t.Error("Wrong partition of", address)
+		}
+	}
+	if r.Latency != 0 {
+		t.Error("Steps not replacing each other", r)
+	}
+
+	// Rules alone apply from the start
+	f.Set(FaultScenario{FaultRules: FaultRules{Loss: 0.5}})
+	if f.Rules().Loss != 0.5 {
+		t.Error("Rules without steps not applied", f.Info())
+	}
+
+	file := path.Join(t.TempDir(), "faults.json")
+	os.WriteFile(file, []byte(`{"steps": [{"at": 10, "loss": 2}]}`), 0600)
+	if _, err := LoadFaultScenario(file); err == nil {
+		t.Error("Loss over 1 accepted")
+	}
+}
+
+func TestFaultConnLatency(t *testing.T) {
+
+	l := netTestListener(t)
+	client, server := netTestPair(t, l)
+	defer client.Close()
+	defer server.Close()
+
+	f := NewFaults("")
+	f.Set(FaultScenario{FaultRules: FaultRules{Latency: 50, Jitter: 30}})
+	conn := f.Wrap(client, server.LocalAddr().String())
+
+	start := time.Now()
+	for i := 0; i < 20; i++ {
+		WriteFrame(conn, []byte{byte(i)})
+	}
+
+	r := bufio.NewReader(server)
+	for i := 0; i < 20; i++ {
+		b, err := ReadFrame(r, MAX_FRAME_SIZE)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i == 0 && time.Since(start) < time.Millisecond*50 {
+			t.Error("Message not held back", time.Since(start))
+		}
+		if !bytes.Equal(b, []byte{byte(i)}) {
+			t.Fatal("Messages reordered", i, b)
+		}
+	}
+	if info := f.Info(); info.Delayed != 20 || info.Dropped != 0 {
+		t.Error("Wrong counts", info)
+	}
+}
+
+func TestFaultConnLossAndBandwidth(t *testing.T) {
+
+	l := netTestListener(t)
+	client, server := netTestPair(t, l)
+	defer client.Close()
+	defer server.Close()
+
+	f := NewFaults("")
+	conn := f.Wrap(client, server.LocalAddr().String())
+	r := bufio.NewReader(server)
+
+	f.Set(FaultScenario{FaultRules: FaultRules{Loss: 1}})
+	WriteFrame(conn, []byte("lost"))
+	if f.Info().Dropped != 1 {
+		t.Error("Message not dropped")
+	}
+
+	// 5 messages of about 1000 bytes at 10000 bytes a second
+	f.Set(FaultScenario{FaultRules: FaultRules{Bandwidth: 10000}})
+	start := time.Now()
+	for i := 0; i < 5; i++ {
+		WriteFrame(conn, make([]byte, 1000))
+	}
+	for i := 0; i < 5; i++ {
+		if _, err := ReadFrame(r, MAX_FRAME_SIZE); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed < time.Millisecond*450 {
+		t.Error("Bandwidth not capped", elapsed)
+	}
+}
+
+func TestPartitionedPeerIgnored(t *testing.T) {
+
+	Core.Network = SetupNetwork("127.0.0.1:19920", BLOCKCHAIN_PORT)
+	l := netTestListener(t)
+	client, server := netTestPair(t, l)
+	defer client.Close()
+	Core.Nodes.AddNode(&Node{TCPConn: server, inbound: true})
+
+	Core.Network.Faults.Set(FaultScenario{FaultRules: FaultRules{Partition: [][]string{{"127.0.0.1:19920"}, {client.LocalAddr().String()}}}})
+	ping := func() error {
+		WriteMessage(client, Message{Identifier: MESSAGE_PING, Data: []byte("nonce")})
+		client.SetReadDeadline(time.Now().Add(time.Millisecond * 200))
+		_, err := ReadMessage(bufio.NewReader(client))
+		return err
+	}
+
+	if ping() == nil {
+		t.Error("Partitioned peer answered")
+	}
+
+	Core.Network.Faults.Set(FaultScenario{})
+	if err := ping(); err != nil {
+		t.Error("Healed partition still dropping", err)
+	}
+}
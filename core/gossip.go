@@ -0,0 +1,177 @@
+package core
+
+import (
+	"errors"
+	"math/rand/v2"
+	"sync"
+	"time"
+
+	"github.com/izqui/helpers"
+)
+
+// Gossip decides where broadcast messages go. Each message is sent to Fanout
+// random peers, every peer when Fanout is 0, and relayed the same way by the
+// nodes that see it first until its hop budget runs out. Messages already seen
+// are dropped, which is where the redundant bytes of flooding are counted.
+//
+// Gossiped messages carry GOSSIP_OPTIONS_SIZE bytes of options: the hops left
+// and the low 24 bits of the millisecond they were first sent, enough to time
+// propagation between nodes sharing a clock. Messages without them are
+// delivered and never relayed.
+type Gossip struct {
+	Fanout int
+	TTL    byte
+
+	lock  sync.Mutex
+	seen  map[string]string // message hash -> peer it came from first, empty for ours
+	ring  []string          // seen hashes in arrival order, the oldest go first
+	next  int
+	limit int // of seen hashes
+	stats GossipStats
+}
+
+type GossipStats struct {
+	Originated     int `json:"originated"`
+	Delivered      int `json:"delivered"`  // first copies of messages from peers
+	Duplicates     int `json:"duplicates"` // copies dropped as seen
+	Repeats        int `json:"repeats"`    // copies from the peer that sent the message first
+	Relayed        int `json:"relayed"`
+	MessagesSent   int `json:"messagesSent"`
+	BytesSent      int `json:"bytesSent"`
+	BytesReceived  int `json:"bytesReceived"`
+	DuplicateBytes int `json:"duplicateBytes"`
+
+	PropagationTotal time.Duration `json:"propagationTotal"` // from first sent to delivered here, over Delivered
+	PropagationMax   time.Duration `json:"propagationMax"`
+}
+
+var (
+	ErrSeenMessage     = errors.New("Message already seen")
+	ErrRepeatedMessage = errors.New("Peer sent the same message again")
+)
+
+func NewGossip(fanout int, ttl byte) *Gossip {
+
+	return &Gossip{Fanout: fanout, TTL: ttl, seen: map[string]string{}, limit: GOSSIP_SEEN_CACHE_SIZE}
+}
+
+// Originate stamps a message of ours with the hop budget and the time
+func (g *Gossip) Originate(m *Message) {
+
+	ms := gossipMillis(time.Now())
+	m.Options = []byte{g.TTL, byte(ms >> 16), byte(ms >> 8), byte(ms)}
+
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	g.markSeen(m, "")
+	g.stats.Originated++
+}
+
+// Receive counts a message of size bytes from the peer at from. It returns
+// the copy to pass on when hops are left, and an error for copies already
+// seen, ErrRepeatedMessage when from sent it before. Gossip never sends a
+// message twice over a link, so repeats are spam.
+func (g *Gossip) Receive(m *Message, size int, from string) (*Message, error) {
+
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	g.stats.BytesReceived += size
+	if len(m.Options) != GOSSIP_OPTIONS_SIZE {
+		return nil, nil
+	}
+
+	if first, seen := g.seen[gossipKey(m)]; seen {
+		g.stats.Duplicates++
+		g.stats.DuplicateBytes += size
+		if first == from {
+			g.stats.Repeats++
+			return nil, ErrRepeatedMessage
+		}
+		return nil, ErrSeenMessage
+	}
+	g.markSeen(m, from)
+
+	g.stats.Delivered++
+	sent := uint32(m.Options[1])<<16 | uint32(m.Options[2])<<8 | uint32(m.Options[3])
+	delay := time.Duration((gossipMillis(time.Now())-sent)&0xffffff) * time.Millisecond
+	g.stats.PropagationTotal += delay
+	if delay > g.stats.PropagationMax {
+		g.stats.PropagationMax = delay
+	}
+
+	if m.Options[0] <= 1 {
+		return nil, nil
+	}
+
+	relay := *m
+	relay.Options = append([]byte{m.Options[0] - 1}, m.Options[1:]...)
+	g.stats.Relayed++
+
+	return &relay, nil
+}
+
+// Targets picks the peers a message goes to, leaving out the one it came from
+func (g *Gossip) Targets(peers []string, from string) []string {
+
+	targets := make([]string, 0, len(peers))
+	for _, p := range peers {
+		if p != from {
+			targets = append(targets, p)
+		}
+	}
+
+	if g.Fanout > 0 && g.Fanout < len(targets) {
+		rand.Shuffle(len(targets), func(i, j int) { targets[i], targets[j] = targets[j], targets[i] })
+		targets = targets[:g.Fanout]
+	}
+	return targets
+}
+
+// Sent counts copies of a message of size bytes written to peers
+func (g *Gossip) Sent(copies, size int) {
+
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	g.stats.MessagesSent += copies
+	g.stats.BytesSent += copies * size
+}
+
+func (g *Gossip) Stats() GossipStats {
+
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	return g.stats
+}
+
+// markSeen remembers a message that wasn't seen as coming from peer
+func (g *Gossip) markSeen(m *Message, peer string) {
+
+	key := gossipKey(m)
+	if _, seen := g.seen[key]; seen {
+		return
+	}
+
+	if len(g.ring) < g.limit {
+		g.ring = append(g.ring, key)
+	} else {
+		delete(g.seen, g.ring[g.next])
+		g.ring[g.next] = key
+		g.next = (g.next + 1) % g.limit
+	}
+	g.seen[key] = peer
+}
+
+// gossipKey leaves out the options, which change on every hop
+func gossipKey(m *Message) string {
+
+	return string(helpers.SHA256(append([]byte{m.Identifier}, m.Data...)))
+}
+
+func gossipMillis(t time.Time) uint32 {
+
+	return uint32(t.UnixMilli()) & 0xffffff
+}
@@ -0,0 +1,207 @@
+package core
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"slices"
+	"testing"
+
+	"github.com/izqui/helpers"
+)
+
+func TestGossipDropsCopies(t *testing.T) {
+
+	g := NewGossip(0, 3)
+	m := &Message{Identifier: MESSAGE_SEND_TRANSACTION, Data: []byte("transaction")}
+	g.Originate(m)
+	if len(m.Options) != GOSSIP_OPTIONS_SIZE || m.Options[0] != 3 {
+		t.Fatal("Message not stamped", m.Options)
+	}
+
+	// Our own message coming back
+	if _, err := g.Receive(m, 10, "a"); err != ErrSeenMessage {
+		t.Error("Own message delivered", err)
+	}
+
+	peer := NewGossip(0, 3)
+	relay, err := peer.Receive(m, 10, "a")
+	if err != nil || relay == nil || relay.Options[0] != 2 || m.Options[0] != 3 {
+		t.Fatal("Message not relayed with one hop less", relay, err)
+	}
+	if _, err := peer.Receive(relay, 10, "b"); err != ErrSeenMessage {
+		t.Error("Copy with fewer hops delivered", err)
+	}
+	if _, err := peer.Receive(m, 10, "a"); err != ErrRepeatedMessage {
+		t.Error("Message sent twice by a peer not caught", err)
+	}
+
+	stats := peer.Stats()
+	if stats.Delivered != 1 || stats.Duplicates != 2 || stats.Repeats != 1 || stats.DuplicateBytes != 20 || stats.BytesReceived != 30 || stats.Relayed != 1 {
+		t.Errorf("Wrong stats %+v", stats)
+	}
+
+	// The last hop isn't relayed
+	last := &Message{Identifier: MESSAGE_SEND_BLOCK, Options: []byte{1, 0, 0, 0}, Data: []byte("block")}
+	if relay, err := peer.Receive(last, 5, "a"); err != nil || relay != nil {
+		t.Error("Message relayed past its hops")
+	}
+
+	// Replies have no gossip options and are always delivered
+	reply := &Message{Identifier: MESSAGE_SEND_NODES, Data: []byte("nodes")}
+	for i := 0; i < 2; i++ {
+		if relay, err := peer.Receive(reply, 5, "a"); err != nil || relay != nil {
+			t.Error("Reply dropped or relayed")
+		}
+	}
+}
+
+func TestGossipSeenCacheForgetsOldest(t *testing.T) {
+
+	g := NewGossip(0, 1)
+	g.limit = 2
+
+	messages := []*Message{{Data: []byte("a")}, {Data: []byte("b")}, {Data: []byte("c")}}
+	for _, m := range messages {
+		g.Originate(m)
+	}
+	if len(g.seen) != 2 {
+		t.Error("Seen cache grew past its size", len(g.seen))
+	}
+	if _, err := g.Receive(messages[0], 1, "a"); err != nil {
+		t.Error("Oldest message still remembered")
+	}
+	if _, err := g.Receive(messages[2], 1, "a"); err == nil {
+		t.Error("Newest message forgotten")
+	}
+}
+
+func TestGossipTargets(t *testing.T) {
+
+	peers := []string{"a", "b", "c", "d", "e"}
+
+	if targets := NewGossip(0, 1).Targets(peers, "c"); len(targets) != 4 || slices.Contains(targets, "c") {
+		t.Error("Flooding doesn't reach every other peer", targets)
+	}
+
+	for i := 0; i < 20; i++ {
+		targets := NewGossip(2, 1).Targets(peers, "a")
+		if len(targets) != 2 || targets[0] == targets[1] || slices.Contains(targets, "a") {
+			t.Fatal("Wrong fanout targets", targets)
+		}
+	}
+}
+
+type gossipSimResult struct {
+	coverage float64 // nodes reached
+	hops     int     // until the last node was reached
+	overhead float64 // bytes received per byte delivered, past the first copy
+}
+
+// simulateGossip broadcasts one message of size bytes over n nodes, each
+// linked to degree random peers, and follows it hop by hop
+func simulateGossip(n, degree, fanout int, ttl byte, size int) gossipSimResult {
+
+	names := make([]string, n)
+	nodes := make([]*Gossip, n)
+	links := make([]map[int]bool, n)
+	for i := range nodes {
+		names[i] = fmt.Sprint(i)
+		nodes[i] = NewGossip(fanout, ttl)
+		links[i] = map[int]bool{}
+	}
+	for i := range nodes {
+		// A ring keeps everyone reachable
+		links[i][(i+1)%n], links[(i+1)%n][i] = true, true
+		for len(links[i]) < degree {
+			if j := rand.IntN(n); j != i {
+				links[i][j], links[j][i] = true, true
+			}
+		}
+	}
+	index := map[string]int{}
+	for i, name := range names {
+		index[name] = i
+	}
+	peers := func(i int) []string {
+		l := []string{}
+		for j := range links[i] {
+			l = append(l, names[j])
+		}
+		return l
+	}
+
+	type delivery struct {
+		to, from int
+		m        Message
+	}
+
+	m := Message{Identifier: MESSAGE_SEND_TRANSACTION, Data: []byte(helpers.RandomString(size))}
+	nodes[0].Originate(&m)
+
+	queue := []delivery{}
+	for _, p := range nodes[0].Targets(peers(0), "") {
+		queue = append(queue, delivery{index[p], 0, m})
+	}
+
+	reached, hops := 1, 0
+	for hop := 1; len(queue) > 0; hop++ {
+		next := []delivery{}
+		for _, d := range queue {
+			relay, err := nodes[d.to].Receive(&d.m, size, names[d.from])
+			if err != nil {
+				continue
+			}
+			reached, hops = reached+1, hop
+			if relay != nil {
+				for _, p := range nodes[d.to].Targets(peers(d.to), names[d.from]) {
+					next = append(next, delivery{index[p], d.to, *relay})
+				}
+			}
+		}
+		queue = next
+	}
+
+	received := 0
+	for _, g := range nodes {
+		received += g.Stats().BytesReceived
+	}
+
+	return gossipSimResult{
+		coverage: float64(reached) / float64(n),
+		hops:     hops,
+		overhead: float64(received-(reached-1)*size) / float64((reached-1)*size),
+	}
+}
+
+func TestGossipReachesNetwork(t *testing.T) {
+
+	if r := simulateGossip(64, 8, 0, 8, 100); r.coverage != 1 {
+		t.Error("Flooding didn't reach every node", r)
+	}
+	if r := simulateGossip(64, 8, 4, 1, 100); r.coverage > 5.0/64 {
+		t.Error("Message travelled past its hops", r)
+	}
+}
+
+// benchmarkGossip reports coverage, hops to the last node reached and the
+// redundant bytes received for every byte delivered, over 256 nodes with 8
+// peers each
+func benchmarkGossip(b *testing.B, fanout int, ttl byte) {
+
+	var coverage, hops, overhead float64
+	for i := 0; i < b.N; i++ {
+		r := simulateGossip(256, 8, fanout, ttl, 250)
+		coverage += r.coverage
+		hops += float64(r.hops)
+		overhead += r.overhead
+	}
+
+	b.ReportMetric(100*coverage/float64(b.N), "%reached")
+	b.ReportMetric(hops/float64(b.N), "hops")
+	b.ReportMetric(overhead/float64(b.N), "redundant-bytes/byte")
+}
+
+func BenchmarkGossipFlood(b *testing.B)   { benchmarkGossip(b, 0, 16) }
+func BenchmarkGossipFanout2(b *testing.B) { benchmarkGossip(b, 2, 16) }
+func BenchmarkGossipFanout3(b *testing.B) { benchmarkGossip(b, 3, 16) }
+func BenchmarkGossipFanout4(b *testing.B) { benchmarkGossip(b, 4, 16) }
@@ -0,0 +1,263 @@
+package core
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/izqui/helpers"
+)
+
+// Peers authenticate each other as they connect. Both send an ephemeral
+// X25519 key, then sign the two ephemeral keys with their node Keypair, so
+// each side learns the other's public key and that it talks to its owner.
+// The shared secret keys AES-GCM in each direction and every frame written
+// afterwards is sealed as one record, numbered by its nonce.
+
+const (
+	HANDSHAKE_FRAME_SIZE  = 1024 // max size of the handshake frames
+	HANDSHAKE_LISTEN_SIZE = 255  // max length of the listen address
+)
+
+var (
+	ErrHandshakeSignature = errors.New("Handshake not signed by the peer key")
+	ErrHandshakePlaintext = errors.New("Peer doesn't agree on encrypting frames")
+	ErrRecordDecrypt      = errors.New("Record failed to decrypt")
+)
+
+// PeerAuth is what a peer tells about itself in the handshake
+type PeerAuth struct {
+	Scheme    byte
+	Public    []byte // base58 node key, the peer's identity
+	Listen    string // where it takes connections, empty when it doesn't say
+	Plaintext bool   // frames go unencrypted, to measure what encryption costs
+	Signature []byte
+}
+
+// signedHash covers the ephemeral keys, of the signer first, and the other fields
+func (a *PeerAuth) signedHash(signer, other []byte) []byte {
+
+	e := NewEncoder()
+	e.Fixed("signer ephemeral key", signer, 32)
+	e.Fixed("other ephemeral key", other, 32)
+	e.Byte(a.Scheme)
+	e.Bytes(a.Public)
+	e.Bytes([]byte(a.Listen))
+	e.Byte(handshakeFlag(a.Plaintext))
+
+	b, _ := e.Result()
+	return helpers.SHA256(b)
+}
+
+func (a *PeerAuth) MarshalBinary() ([]byte, error) {
+
+	e := NewEncoder()
+	e.Byte(CODEC_VERSION)
+	e.Byte(a.Scheme)
+	e.Bytes(a.Public)
+	e.Bytes([]byte(a.Listen))
+	e.Byte(handshakeFlag(a.Plaintext))
+	e.Bytes(a.Signature)
+
+	return e.Result()
+}
+
+func (a *PeerAuth) UnmarshalBinary(b []byte) error {
+
+	d := NewDecoder(b)
+	d.Version("auth version")
+	a.Scheme = d.Byte("auth scheme")
+	a.Public = d.Bytes("auth public key", NETWORK_KEY_SIZE)
+	a.Listen = string(d.Bytes("auth listen address", HANDSHAKE_LISTEN_SIZE))
+	if flag := d.Byte("auth plaintext"); flag > 1 {
+		d.fail("auth plaintext", ErrNonCanonical)
+	} else {
+		a.Plaintext = flag == 1
+	}
+	a.Signature = d.Bytes("auth signature", NETWORK_KEY_SIZE)
+
+	return d.Finish("auth")
+}
+
+func handshakeFlag(b bool) byte {
+
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// Handshake authenticates the peer at the other end of conn, which is
+// returned to read and write frames through, encrypted unless plaintext is
+// set. Both ends must agree on plaintext.
+func Handshake(conn net.Conn, keypair *Keypair, listen string, plaintext bool) (net.Conn, *PeerAuth, error) {
+
+	conn.SetDeadline(time.Now().Add(time.Second * PEER_HANDSHAKE_TIMEOUT))
+	defer conn.SetDeadline(time.Time{})
+
+	key, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	ours := key.PublicKey().Bytes()
+
+	r := bufio.NewReader(conn)
+	if err := WriteFrame(conn, append([]byte{CODEC_VERSION}, ours...)); err != nil {
+		return nil, nil, err
+	}
+	hello, err := ReadFrame(r, HANDSHAKE_FRAME_SIZE)
+	if err != nil {
+		return nil, nil, err
+	}
+	d := NewDecoder(hello)
+	d.Version("hello version")
+	theirs := d.Fixed("hello ephemeral key", len(ours))
+	if err := d.Finish("hello"); err != nil {
+		return nil, nil, err
+	}
+
+	auth := &PeerAuth{Scheme: keypair.Scheme(), Public: keypair.Public, Listen: listen, Plaintext: plaintext}
+	if auth.Signature, err = keypair.Sign(auth.signedHash(ours, theirs)); err != nil {
+		return nil, nil, err
+	}
+	b, err := auth.MarshalBinary()
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := WriteFrame(conn, b); err != nil {
+		return nil, nil, err
+	}
+
+	b, err = ReadFrame(r, HANDSHAKE_FRAME_SIZE)
+	if err != nil {
+		return nil, nil, err
+	}
+	peer := new(PeerAuth)
+	if err := peer.UnmarshalBinary(b); err != nil {
+		return nil, nil, err
+	}
+	if !VerifySignature(peer.Scheme, peer.Public, peer.Signature, peer.signedHash(theirs, ours)) {
+		return nil, peer, ErrHandshakeSignature
+	}
+	if peer.Plaintext != plaintext {
+		return nil, peer, ErrHandshakePlaintext
+	}
+
+	if plaintext {
+		return &bufferedConn{Conn: conn, r: r}, peer, nil
+	}
+
+	theirKey, err := ecdh.X25519().NewPublicKey(theirs)
+	if err != nil {
+		return nil, peer, err
+	}
+	secret, err := key.ECDH(theirKey)
+	if err != nil {
+		return nil, peer, err
+	}
+
+	c := &secureConn{Conn: conn, r: r}
+	if c.send, err = recordCipher(secret, ours, theirs, ours); err != nil {
+		return nil, peer, err
+	}
+	if c.recv, err = recordCipher(secret, ours, theirs, theirs); err != nil {
+		return nil, peer, err
+	}
+	return c, peer, nil
+}
+
+// recordCipher keys AES-GCM for the records sent by the owner of sender
+func recordCipher(secret, ours, theirs, sender []byte) (cipher.AEAD, error) {
+
+	// Both ends salt with the ephemeral keys in the same order
+	salt := append(append([]byte{}, ours...), theirs...)
+	if bytes.Compare(ours, theirs) > 0 {
+		salt = append(append([]byte{}, theirs...), ours...)
+	}
+
+	k, err := hkdf.Key(sha256.New, secret, salt, "records from "+string(sender), 32)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(k)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// bufferedConn reads what the handshake left buffered first
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+
+	return c.r.Read(p)
+}
+
+// secureConn seals every Write as one record, a frame or the frames a peer's
+// writer batched
+type secureConn struct {
+	net.Conn
+	r *bufio.Reader
+
+	send, recv cipher.AEAD
+
+	lock    sync.Mutex // keeps records on the wire in nonce order
+	sendSeq uint64
+	recvSeq uint64
+	plain   []byte // opened and not read yet
+}
+
+func (c *secureConn) Write(b []byte) (int, error) {
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	record := make([]byte, binary.MaxVarintLen64, binary.MaxVarintLen64+len(b)+c.send.Overhead())
+	n := binary.PutUvarint(record, uint64(len(b)+c.send.Overhead()))
+	record = c.send.Seal(record[:n], recordNonce(c.sendSeq), b, nil)
+	c.sendSeq++
+
+	if _, err := c.Conn.Write(record); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (c *secureConn) Read(p []byte) (int, error) {
+
+	if len(c.plain) == 0 {
+		record, err := ReadFrame(c.r, MAX_FRAME_SIZE+binary.MaxVarintLen64+c.recv.Overhead())
+		if err != nil {
+			return 0, err
+		}
+		if c.plain, err = c.recv.Open(record[:0], recordNonce(c.recvSeq), record, nil); err != nil {
+			return 0, ErrRecordDecrypt
+		}
+		c.recvSeq++
+	}
+
+	n := copy(p, c.plain)
+	c.plain = c.plain[n:]
+	return n, nil
+}
+
+func recordNonce(seq uint64) []byte {
+
+	nonce := make([]byte, 12)
+	binary.BigEndian.PutUint64(nonce[4:], seq)
+	return nonce
+}
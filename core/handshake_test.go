@@ -0,0 +1,163 @@
+package core
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// handshakeTestPair connects two ends and runs the handshake on both
+func handshakeTestPair(t testing.TB, a, b *Keypair, plaintextA, plaintextB bool) (net.Conn, net.Conn, *PeerAuth, error) {
+
+	l, err := net.ListenTCP("tcp4", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	client, err := net.DialTCP("tcp4", nil, l.Addr().(*net.TCPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := l.AcceptTCP()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close(); server.Close() })
+
+	type result struct {
+		conn net.Conn
+		err  error
+	}
+	done := make(chan result, 1)
+	go func() {
+		conn, _, err := Handshake(server, b, "", plaintextB)
+		done <- result{conn, err}
+	}()
+
+	conn, peer, err := Handshake(client, a, "127.0.0.1:19920", plaintextA)
+	r := <-done
+	if err == nil {
+		err = r.err
+	}
+	return conn, r.conn, peer, err
+}
+
+func TestHandshake(t *testing.T) {
+
+	a := GenerateNewKeypair()
+	b, _ := GenerateKeypair(SIGNATURE_SCHEME_ED25519)
+
+	client, server, peer, err := handshakeTestPair(t, a, b, false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(peer.Public, b.Public) || peer.Scheme != SIGNATURE_SCHEME_ED25519 {
+		t.Error("Peer not identified by its key", peer)
+	}
+
+	// Frames both ways, the first one sent before the other end reads
+	WriteMessage(client, Message{Identifier: MESSAGE_PING, Data: []byte("nonce")})
+	WriteMessage(server, Message{Identifier: MESSAGE_PONG, Data: []byte("nonce")})
+	if m, err := ReadMessage(bufio.NewReader(server)); err != nil || m.Identifier != MESSAGE_PING {
+		t.Error("Frame not decrypted", m, err)
+	}
+	if m, err := ReadMessage(bufio.NewReader(client)); err != nil || m.Identifier != MESSAGE_PONG {
+		t.Error("Frame not decrypted", m, err)
+	}
+
+	// A record the peer didn't seal
+	WriteFrame(client.(*secureConn).Conn, bytes.Repeat([]byte{1}, 40))
+	if _, err := ReadMessage(bufio.NewReader(server)); err != ErrRecordDecrypt {
+		t.Error("Forged record accepted", err)
+	}
+}
+
+func TestHandshakeRejects(t *testing.T) {
+
+	a, b := GenerateNewKeypair(), GenerateNewKeypair()
+
+	if _, _, _, err := handshakeTestPair(t, a, b, false, true); err != ErrHandshakePlaintext {
+		t.Error("Encrypting and plaintext ends connected", err)
+	}
+
+	// Claiming the key of another node
+	forged := &Keypair{Public: b.Public, Private: a.Private, SignatureScheme: a.SignatureScheme}
+	if _, _, _, err := handshakeTestPair(t, a, forged, false, false); err != ErrHandshakeSignature {
+		t.Error("Forged identity accepted", err)
+	}
+}
+
+func TestNodesIdentifiedByKey(t *testing.T) {
+
+	Core.Keypair = GenerateNewKeypair()
+	Core.Network = SetupNetwork("127.0.0.1:0", BLOCKCHAIN_PORT)
+	l := netTestListener(t)
+
+	// Connections both ways to a node with a key above ours, the one we dialed stays
+	c1, s1 := netTestPair(t, l)
+	defer c1.Close()
+	c2, s2 := netTestPair(t, l)
+	defer s2.Close()
+
+	in := &Node{TCPConn: s1, ID: "zzz", inbound: true}
+	out := &Node{TCPConn: c2, ID: "zzz"}
+	if !Core.Nodes.AddNode(in) || !Core.Nodes.AddNode(out) {
+		t.Fatal("Connection dialed by the lower key not kept")
+	}
+	if peers := Core.Network.Peers(); len(peers) != 1 || peers[0].Inbound || peers[0].ID != "zzz" {
+		t.Error("Both connections kept", peers)
+	}
+	c1.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := c1.Read(make([]byte, 1)); err != io.EOF {
+		t.Error("Replaced connection not closed", err)
+	}
+
+	c3, s3 := netTestPair(t, l)
+	defer c3.Close()
+	if Core.Nodes.AddNode(&Node{TCPConn: s3, ID: "zzz", inbound: true}) {
+		t.Error("Connection dialed by the higher key kept")
+	}
+}
+
+func benchmarkTransport(b *testing.B, plaintext bool) {
+
+	client, server, _, err := handshakeTestPair(b, GenerateNewKeypair(), GenerateNewKeypair(), plaintext, plaintext)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	// About the size of a signed transaction
+	m := Message{Identifier: MESSAGE_SEND_TRANSACTION, Data: bytes.Repeat([]byte{1}, 300)}
+	frame, _ := m.MarshalBinary()
+	b.SetBytes(int64(len(frame)))
+
+	done := make(chan error)
+	go func() {
+		r := bufio.NewReader(server)
+		for i := 0; i < b.N; i++ {
+			if _, err := ReadMessage(r); err != nil {
+				done <- err
+				return
+			}
+		}
+		done <- nil
+	}()
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := WriteMessage(client, m); err != nil {
+			b.Fatal(err)
+		}
+	}
+	if err := <-done; err != nil {
+		b.Fatal(err)
+	}
+}
+
+func BenchmarkTransportPlaintext(b *testing.B) { benchmarkTransport(b, true) }
+
+func BenchmarkTransportEncrypted(b *testing.B) { benchmarkTransport(b, false) }
@@ -0,0 +1,130 @@
+package core
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math/rand/v2"
+	"time"
+)
+
+// Peers are pinged every PEER_PING_INTERVAL. A pong gives the round trip
+// time, and any traffic from a peer counts as a sign of life. Peers that
+// leave a ping unanswered for PEER_PING_TIMEOUT, or send nothing for
+// PEER_IDLE_TIMEOUT, are disconnected.
+
+// seen records traffic from the node
+func (node *Node) seen() {
+
+	node.lock.Lock()
+	defer node.lock.Unlock()
+
+	node.lastSeen = int(time.Now().Unix())
+}
+
+// LastSeen is when the node last sent anything, in unix seconds
+func (node *Node) LastSeen() int {
+
+	node.lock.Lock()
+	defer node.lock.Unlock()
+
+	return node.lastSeen
+}
+
+// RTT is the round trip time of the last answered ping, 0 before the first
+func (node *Node) RTT() time.Duration {
+
+	node.lock.Lock()
+	defer node.lock.Unlock()
+
+	return node.rtt
+}
+
+// ping sends a ping, unless one is still waiting for its pong
+func (node *Node) ping() error {
+
+	node.lock.Lock()
+	if !node.pingSent.IsZero() {
+		node.lock.Unlock()
+		return nil
+	}
+	node.pingNonce = make([]byte, 8)
+	binary.BigEndian.PutUint64(node.pingNonce, rand.Uint64())
+	node.pingSent = time.Now()
+	m := Message{Identifier: MESSAGE_PING, Data: node.pingNonce}
+	node.lock.Unlock()
+
+	return node.Send(m, QUEUE_BLOCK)
+}
+
+// pong takes the answer to our ping, pongs to older pings are ignored
+func (node *Node) pong(nonce []byte) {
+
+	node.lock.Lock()
+	defer node.lock.Unlock()
+
+	if node.pingSent.IsZero() || !bytes.Equal(nonce, node.pingNonce) {
+		return
+	}
+	node.rtt = time.Since(node.pingSent)
+	node.pingSent = time.Time{}
+}
+
+// unresponsive tells why a node should be disconnected, empty when it's alive
+func (node *Node) unresponsive(now time.Time) string {
+
+	node.lock.Lock()
+	defer node.lock.Unlock()
+
+	if !node.pingSent.IsZero() && now.Sub(node.pingSent) > time.Second*PEER_PING_TIMEOUT {
+		return "ping not answered"
+	}
+	if idle := now.Sub(time.Unix(int64(node.lastSeen), 0)); idle > time.Second*PEER_IDLE_TIMEOUT {
+		return fmt.Sprintf("idle for %s", idle.Round(time.Second))
+	}
+	return ""
+}
+
+// heartbeat evicts the unresponsive nodes and pings the others
+func (n *Network) heartbeat() {
+
+	nodesLock.RLock()
+	nodes := make([]*Node, 0, len(n.Nodes))
+	for _, node := range n.Nodes {
+		nodes = append(nodes, node)
+	}
+	nodesLock.RUnlock()
+
+	now := time.Now()
+	for _, node := range nodes {
+		if reason := node.unresponsive(now); reason != "" {
+			fmt.Println("Evicting node", node.TCPConn.RemoteAddr(), reason)
+			node.TCPConn.Close()
+			n.Nodes.RemoveNode(node)
+			continue
+		}
+		if node.Supports(MESSAGE_PING) {
+			networkError(node.ping())
+		}
+	}
+}
+
+// MeanRTT averages the round trip time of the nodes answering pings
+func (n *Network) MeanRTT() time.Duration {
+
+	nodesLock.RLock()
+	defer nodesLock.RUnlock()
+
+	var total time.Duration
+	count := 0
+	for _, node := range n.Nodes {
+		if rtt := node.RTT(); rtt > 0 {
+			total += rtt
+			count++
+		}
+	}
+	if count == 0 {
+		return 0
+	}
+	return total / time.Duration(count)
+}
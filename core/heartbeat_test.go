@@ -0,0 +1,84 @@
+package core
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPingMeasuresRTT(t *testing.T) {
+
+	Core.Network = SetupNetwork("127.0.0.1:0", BLOCKCHAIN_PORT)
+	l := netTestListener(t)
+	client, server := netTestPair(t, l)
+
+	// Both ends in one network, each answers the other's pings
+	out := &Node{TCPConn: client}
+	Core.Nodes.AddNode(&Node{TCPConn: server, inbound: true})
+	Core.Nodes.AddNode(out)
+
+	if err := out.ping(); err != nil {
+		t.Fatal(err)
+	}
+	netTestWait(t, "pong", func() bool { return out.RTT() > 0 })
+
+	if time.Since(time.Unix(int64(out.LastSeen()), 0)) > time.Second*2 {
+		t.Error("Pong not counted as traffic", out.LastSeen())
+	}
+	if stats := Core.Network.Stats(); stats.MeanRTT <= 0 {
+		t.Error("Mean RTT not published", stats)
+	}
+	for _, p := range Core.Network.Peers() {
+		if !p.Inbound && p.RTT != out.RTT() {
+			t.Error("Peer RTT not published", p)
+		}
+	}
+
+	// Pongs to other pings don't count
+	out.ping()
+	out.pong([]byte("another nonce"))
+	if out.unresponsive(time.Now().Add(time.Second*(PEER_PING_TIMEOUT+1))) == "" {
+		t.Error("Pong with another nonce accepted")
+	}
+
+	client.Close()
+	netTestWait(t, "node removal", func() bool { return len(Core.Network.Peers()) == 0 })
+}
+
+func TestHeartbeatEvictsUnresponsiveNodes(t *testing.T) {
+
+	Core.Network = SetupNetwork("127.0.0.1:0", BLOCKCHAIN_PORT)
+	l := netTestListener(t)
+
+	// A peer that never answers, its end isn't read
+	silent, server := netTestPair(t, l)
+	defer silent.Close()
+	node := &Node{TCPConn: server, inbound: true}
+	Core.Nodes.AddNode(node)
+	node.seen()
+
+	Core.Network.heartbeat()
+	if node.unresponsive(time.Now()) != "" || len(Core.Network.Peers()) != 1 {
+		t.Fatal("Node evicted before its ping timed out")
+	}
+
+	node.lock.Lock()
+	node.pingSent = node.pingSent.Add(-time.Second * (PEER_PING_TIMEOUT + 1))
+	node.lock.Unlock()
+	Core.Network.heartbeat()
+	if len(Core.Network.Peers()) != 0 {
+		t.Error("Node not answering pings kept")
+	}
+
+	// Idle peers go too
+	idle, server := netTestPair(t, l)
+	defer idle.Close()
+	node = &Node{TCPConn: server, inbound: true, lastSeen: int(time.Now().Unix()) - PEER_IDLE_TIMEOUT - 1}
+	Core.Nodes.AddNode(node)
+	if reason := node.unresponsive(time.Now()); reason == "" {
+		t.Error("Idle node not found")
+	}
+	Core.Network.heartbeat()
+	if len(Core.Network.Peers()) != 0 {
+		t.Error("Idle node kept")
+	}
+}
@@ -0,0 +1,89 @@
+package core
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+
+	"github.com/izqui/helpers"
+)
+
+// Check is the outcome of one consistency check on a decoded object
+type Check struct {
+	Name   string `json:"name"`
+	OK     bool   `json:"ok"`
+	Detail string `json:"detail,omitempty"`
+}
+
+func failedChecks(checks []Check) []string {
+
+	failed := []string{}
+	for _, c := range checks {
+		if !c.OK {
+			failed = append(failed, c.Name)
+		}
+	}
+	return failed
+}
+
+// Checks runs the checks behind VerifyTransaction one by one
+func (t *Transaction) Checks(pow []byte) []Check {
+
+	hash := t.Hash()
+	payloadHash := helpers.SHA256(t.Payload)
+
+	return []Check{
+		{"payload hash", bytes.Equal(payloadHash, t.Header.PayloadHash), fmt.Sprintf("%x", payloadHash)},
+		{"proof of work", CheckProofOfWork(pow, hash), fmt.Sprintf("%d leading %#x bytes", len(pow), POW_PREFIX)},
+		signatureCheck(t.Header.Scheme, t.Header.From, t.Signature, hash),
+	}
+}
+
+// Checks runs the checks behind VerifyBlock one by one, and the transaction
+// checks on every transaction in the block
+func (b *Block) Checks(pow, txPow []byte) []Check {
+
+	hash := b.Hash()
+	merkel := b.GenerateMerkelRoot()
+
+	checks := []Check{
+		{"merkle root", bytes.Equal(merkel, b.MerkelRoot), fmt.Sprintf("%x", merkel)},
+		{"proof of work", CheckProofOfWork(pow, hash), fmt.Sprintf("%d leading %#x bytes", len(pow), POW_PREFIX)},
+		signatureCheck(b.BlockHeader.Scheme, b.Origin, b.Signature, hash),
+	}
+
+	return append(checks, b.TransactionSlice.Check(txPow))
+}
+
+// Check runs the transaction checks on every transaction, naming the ones failing
+func (slice TransactionSlice) Check(pow []byte) Check {
+
+	bad := []string{}
+	for i := range slice {
+		t := &slice[i]
+		if failed := failedChecks(t.Checks(pow)); len(failed) > 0 {
+			bad = append(bad, fmt.Sprintf("%d %x: %s", i, t.Hash(), strings.Join(failed, ", ")))
+		}
+	}
+	return Check{"transactions", len(bad) == 0, strings.Join(bad, "; ")}
+}
+
+// Checks of a compact block are the ones of its header, its transactions
+// aren't there yet
+func (c *CompactBlock) Checks(pow []byte) []Check {
+
+	hash := c.Hash()
+	return []Check{
+		{"proof of work", CheckProofOfWork(pow, hash), fmt.Sprintf("%d leading %#x bytes", len(pow), POW_PREFIX)},
+		signatureCheck(c.BlockHeader.Scheme, c.Origin, c.Signature, hash),
+	}
+}
+
+func signatureCheck(scheme byte, publicKey, sig, hash []byte) Check {
+
+	if _, err := VerifierForScheme(scheme); err != nil {
+		return Check{"signature", false, err.Error()}
+	}
+
+	return Check{"signature", VerifySignature(scheme, publicKey, sig, hash), SignatureSchemeName(scheme)}
+}
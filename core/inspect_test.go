@@ -0,0 +1,32 @@
+package core
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestBlockChecks(t *testing.T) {
+
+	b := codecTestBlock(2)
+
+	// No proof of work, everything else holds
+	for _, c := range b.Checks(nil, TEST_TRANSACTION_POW) {
+		if !c.OK {
+			t.Error("Check failed", c)
+		}
+	}
+
+	(*b.TransactionSlice)[1].Header.Fee++
+	checks := b.Checks(nil, TEST_TRANSACTION_POW)
+	if checks[0].Name != "merkle root" || checks[0].OK {
+		t.Error("Changed transaction kept the merkle root")
+	}
+	if checks[3].OK || !strings.HasPrefix(checks[3].Detail, "1 ") || !strings.Contains(checks[3].Detail, "signature") {
+		t.Error("Bad transaction not reported", checks[3])
+	}
+
+	b.BlockHeader.Scheme = 9
+	if c := b.Checks(nil, nil)[2]; c.OK || !strings.Contains(c.Detail, "Unknown signature scheme") {
+		t.Error("Unknown scheme not reported", c)
+	}
+}
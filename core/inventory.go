@@ -0,0 +1,260 @@
+package core
+
+import (
+	"encoding/hex"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Transactions are announced to peers by hash, batched every INV_INTERVAL,
+// and peers fetch only the ones they don't have. Every node announces what
+// it fetched to its own peers in turn, so a transaction crosses each link
+// whole at most once. Peers that don't handle inventory messages aren't sent
+// our transactions, Push gossips them whole again.
+
+const (
+	INV_INTERVAL        = 100         // milliseconds between announcements
+	INV_BATCH_SIZE      = 5000        // hashes per message
+	INV_KNOWN_SIZE      = TXPOOL_SIZE // transaction hashes remembered
+	INV_REQUEST_TIMEOUT = 10          // seconds before asking another peer for a transaction
+)
+
+// InventoryHashes is the data of inventory and get data messages
+type InventoryHashes [][]byte
+
+func (h InventoryHashes) MarshalBinary() ([]byte, error) {
+
+	e := NewEncoder()
+	e.Byte(CODEC_VERSION)
+	e.Uvarint(uint64(len(h)))
+	for _, hash := range h {
+		e.Fixed("inventory hash", hash, HASH_SIZE)
+	}
+
+	return e.Result()
+}
+
+func (h *InventoryHashes) UnmarshalBinary(b []byte) error {
+
+	d := NewDecoder(b)
+	d.Version("inventory version")
+
+	n := d.Uvarint("inventory count")
+	switch {
+	case n > INV_BATCH_SIZE:
+		d.fail("inventory count", ErrFieldTooLong)
+	case n > uint64(len(d.Remaining())/HASH_SIZE):
+		d.fail("inventory count", ErrShortBuffer)
+	}
+	*h = nil
+	for i := uint64(0); i < n && d.Err() == nil; i++ {
+		*h = append(*h, d.Fixed("inventory hash", HASH_SIZE))
+	}
+
+	return d.Finish("inventory")
+}
+
+type Inventory struct {
+	Push bool // transactions are gossiped whole instead, to compare the bytes it takes
+
+	lock  sync.Mutex
+	known map[string]*inventoryItem // transaction hash -> what we know of it
+	ring  []string                  // known hashes in arrival order, the oldest go first
+	next  int
+	limit int
+	queue []string // hashes to announce next
+	stats InventoryStats
+}
+
+type inventoryItem struct {
+	size      int      // of the transaction, 0 until we have it
+	peers     []string // known to have it, never announced it to
+	requested time.Time
+}
+
+type InventoryStats struct {
+	Announced    int `json:"announced"` // hashes sent to peers
+	Received     int `json:"received"`  // hashes announced to us
+	Requested    int `json:"requested"`
+	Served       int `json:"served"`
+	Duplicates   int `json:"duplicates"`   // announced hashes of transactions we had, not fetched
+	BytesAvoided int `json:"bytesAvoided"` // the duplicates would have taken whole
+	DuplicateTxs int `json:"duplicateTxs"` // transactions sent to us whole that we had
+}
+
+func NewInventory(limit int) *Inventory {
+
+	return &Inventory{known: map[string]*inventoryItem{}, limit: limit}
+}
+
+// item looks up a hash, adding it when unknown
+func (inv *Inventory) item(key string) *inventoryItem {
+
+	if it, ok := inv.known[key]; ok {
+		return it
+	}
+	it := &inventoryItem{}
+	inv.known[key] = it
+
+	if len(inv.ring) < inv.limit {
+		inv.ring = append(inv.ring, key)
+		return it
+	}
+	delete(inv.known, inv.ring[inv.next])
+	inv.ring[inv.next] = key
+	inv.next = (inv.next + 1) % inv.limit
+	return it
+}
+
+// Add records a transaction of size bytes we got from a peer, or made when
+// from is empty, and queues it to be announced. It returns false for
+// transactions we had.
+func (inv *Inventory) Add(hash []byte, size int, from string) bool {
+
+	inv.lock.Lock()
+	defer inv.lock.Unlock()
+
+	it := inv.item(hex.EncodeToString(hash))
+	if it.size > 0 {
+		inv.stats.DuplicateTxs++
+		return false
+	}
+	it.size = size
+	if from != "" {
+		it.addPeer(from)
+	}
+	if !inv.Push {
+		inv.queue = append(inv.queue, hex.EncodeToString(hash))
+	}
+	return true
+}
+
+// Announced takes hashes announced by peer and returns those to fetch from
+// it, the unknown ones not asked from another peer lately
+func (inv *Inventory) Announced(hashes InventoryHashes, peer string) InventoryHashes {
+
+	inv.lock.Lock()
+	defer inv.lock.Unlock()
+
+	want := InventoryHashes{}
+	now := time.Now()
+	for _, hash := range hashes {
+		inv.stats.Received++
+		it := inv.item(hex.EncodeToString(hash))
+		it.addPeer(peer)
+
+		switch {
+		case it.size > 0:
+			inv.stats.Duplicates++
+			inv.stats.BytesAvoided += it.size
+		case now.Sub(it.requested) > time.Second*INV_REQUEST_TIMEOUT:
+			it.requested = now
+			want = append(want, hash)
+		}
+	}
+	inv.stats.Requested += len(want)
+
+	return want
+}
+
+// Served counts transactions sent to peers that asked for them
+func (inv *Inventory) Served(n int) {
+
+	inv.lock.Lock()
+	defer inv.lock.Unlock()
+
+	inv.stats.Served += n
+}
+
+// batches empties the queue into the announcements for each of peers,
+// leaving out the hashes they're known to have
+func (inv *Inventory) batches(peers []string) map[string][]InventoryHashes {
+
+	inv.lock.Lock()
+	defer inv.lock.Unlock()
+
+	batches := map[string][]InventoryHashes{}
+	for _, key := range inv.queue {
+		it, ok := inv.known[key]
+		if !ok {
+			continue
+		}
+		hash, _ := hex.DecodeString(key)
+		for _, p := range peers {
+			if it.hasPeer(p) {
+				continue
+			}
+			b := batches[p]
+			if len(b) == 0 || len(b[len(b)-1]) == INV_BATCH_SIZE {
+				b = append(b, InventoryHashes{})
+			}
+			b[len(b)-1] = append(b[len(b)-1], hash)
+			batches[p] = b
+			inv.stats.Announced++
+		}
+	}
+	inv.queue = inv.queue[:0]
+
+	return batches
+}
+
+func (inv *Inventory) Stats() InventoryStats {
+
+	inv.lock.Lock()
+	defer inv.lock.Unlock()
+
+	return inv.stats
+}
+
+func (it *inventoryItem) addPeer(peer string) {
+
+	if !it.hasPeer(peer) {
+		it.peers = append(it.peers, peer)
+	}
+}
+
+func (it *inventoryItem) hasPeer(peer string) bool {
+
+	for _, p := range it.peers {
+		if p == peer {
+			return true
+		}
+	}
+	return false
+}
+
+// AnnounceTransaction sends a transaction of ours to peers
+func (n *Network) AnnounceTransaction(t *Transaction) {
+
+	n.Inventory.Add(t.Hash(), t.Size(), "")
+	if n.Inventory.Push {
+		n.TxBatch.Add(t)
+	}
+}
+
+// announce sends the queued hashes to the peers that handle inventory
+func (n *Network) announce() {
+
+	nodesLock.RLock()
+	defer nodesLock.RUnlock()
+
+	peers := make([]string, 0, len(n.Nodes))
+	for k, node := range n.Nodes {
+		if node.Supports(MESSAGE_INV) {
+			peers = append(peers, k)
+		}
+	}
+
+	for k, batches := range n.Inventory.batches(peers) {
+		for _, hashes := range batches {
+			data, _ := hashes.MarshalBinary()
+			b, _ := (&Message{Identifier: MESSAGE_INV, Data: data}).MarshalBinary()
+			if err := n.Nodes[k].out.push(b, LANE_TX, QUEUE_DROP); err != nil {
+				fmt.Println("Not announcing to", k+":", err)
+				continue
+			}
+			n.Gossip.Sent(1, len(b))
+		}
+	}
+}
@@ -0,0 +1,121 @@
+package core
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/izqui/helpers"
+)
+
+func TestInventoryHashesRoundTrip(t *testing.T) {
+
+	h := InventoryHashes{helpers.SHA256([]byte("a")), helpers.SHA256([]byte("b"))}
+	data, err := h.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded InventoryHashes
+	if err := decoded.UnmarshalBinary(data); err != nil || !reflect.DeepEqual(h, decoded) {
+		t.Error("Hashes changed in a round trip", err)
+	}
+
+	big := make(InventoryHashes, INV_BATCH_SIZE+1)
+	data, _ = big.MarshalBinary()
+	if err := decoded.UnmarshalBinary(data); err == nil {
+		t.Error("Announcement over the batch size decoded")
+	}
+}
+
+func TestInventoryFetchesUnknownOnce(t *testing.T) {
+
+	hash := helpers.SHA256([]byte("transaction"))
+
+	// Ours goes to both peers
+	a := NewInventory(10)
+	if !a.Add(hash, 300, "") {
+		t.Fatal("New transaction not added")
+	}
+	if b := a.batches([]string{"b", "c"}); len(b["b"]) != 1 || len(b["c"]) != 1 || !bytes.Equal(b["b"][0][0], hash) {
+		t.Fatal("Transaction not announced", b)
+	}
+	if b := a.batches([]string{"b"}); len(b) != 0 {
+		t.Error("Transaction announced twice", b)
+	}
+
+	// Fetched from the first peer announcing it, the others are spared
+	b := NewInventory(10)
+	if want := b.Announced(InventoryHashes{hash}, "a"); len(want) != 1 {
+		t.Fatal("Unknown transaction not requested")
+	}
+	if want := b.Announced(InventoryHashes{hash}, "c"); len(want) != 0 {
+		t.Error("Transaction requested while waiting for it")
+	}
+	if !b.Add(hash, 300, "a") || b.Add(hash, 300, "c") {
+		t.Error("Duplicate transaction not noticed")
+	}
+	b.Announced(InventoryHashes{hash}, "d")
+
+	// Every peer but e announced it
+	if batches := b.batches([]string{"a", "c", "d", "e"}); len(batches) != 1 || len(batches["e"]) != 1 {
+		t.Error("Transaction announced to peers that have it", batches)
+	}
+	if s := b.Stats(); s.Received != 3 || s.Requested != 1 || s.Duplicates != 1 || s.BytesAvoided != 300 || s.DuplicateTxs != 1 {
+		t.Error("Wrong stats", s)
+	}
+}
+
+func TestInventoryRequestTimeout(t *testing.T) {
+
+	hash := helpers.SHA256([]byte("transaction"))
+	inv := NewInventory(10)
+	inv.Announced(InventoryHashes{hash}, "a")
+
+	// a never answered, ask the next peer announcing it
+	inv.known[hex.EncodeToString(hash)].requested = time.Now().Add(-time.Second * (INV_REQUEST_TIMEOUT + 1))
+	if want := inv.Announced(InventoryHashes{hash}, "b"); len(want) != 1 {
+		t.Error("Transaction not requested again")
+	}
+}
+
+func TestInventoryPush(t *testing.T) {
+
+	inv := NewInventory(10)
+	inv.Push = true
+	inv.Add(helpers.SHA256([]byte("transaction")), 300, "")
+	if b := inv.batches([]string{"a"}); len(b) != 0 {
+		t.Error("Transaction announced while pushing", b)
+	}
+}
+
+func TestAnnounceToPeers(t *testing.T) {
+
+	Core.Network = SetupNetwork("127.0.0.1:0", BLOCKCHAIN_PORT)
+	l := netTestListener(t)
+	client, server := netTestPair(t, l)
+	defer client.Close()
+	old, oldServer := netTestPair(t, l)
+	defer old.Close()
+
+	Core.Nodes.AddNode(&Node{TCPConn: server, lastSeen: int(time.Now().Unix()), inbound: true})
+	Core.Nodes.AddNode(&Node{TCPConn: oldServer, lastSeen: int(time.Now().Unix()), inbound: true, version: &PeerVersion{Capabilities: requiredMessages}})
+
+	tr := codecTestTransaction()
+	Core.Network.AnnounceTransaction(tr)
+	Core.Network.announce()
+
+	client.SetReadDeadline(time.Now().Add(time.Second * 5))
+	m, err := ReadMessage(bufio.NewReader(client))
+	var hashes InventoryHashes
+	if err != nil || m.Identifier != MESSAGE_INV || hashes.UnmarshalBinary(m.Data) != nil || !bytes.Equal(hashes[0], tr.Hash()) {
+		t.Fatal("Transaction not announced", m, err)
+	}
+
+	old.SetReadDeadline(time.Now().Add(time.Millisecond * 200))
+	if m, err := ReadMessage(bufio.NewReader(old)); err == nil {
+		t.Error("Announced to a peer without inventory", m)
+	}
+}
@@ -0,0 +1,195 @@
+package core
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Encrypted keystore: the private key is sealed with AES-256-GCM under a key
+// derived from a passphrase with PBKDF2-SHA256. The public key and scheme stay
+// readable and are authenticated as additional data.
+
+const (
+	KEYSTORE_VERSION        = 1
+	KEYSTORE_KDF            = "pbkdf2-sha256"
+	KEYSTORE_CIPHER         = "aes-256-gcm"
+	KEYSTORE_KDF_ITERATIONS = 600000
+	KEYSTORE_SALT_SIZE      = 16
+
+	KEYSTORE_PASSPHRASE_ENV = "BLOCKCHAIN_KEYSTORE_PASSPHRASE"
+)
+
+var (
+	ErrWrongPassphrase = errors.New("Wrong keystore passphrase or corrupted keystore")
+	ErrNoPassphrase    = errors.New("No keystore passphrase, set " + KEYSTORE_PASSPHRASE_ENV + " or run from a terminal")
+)
+
+type EncryptedKey struct {
+	Version    int       `json:"version"`
+	Public     string    `json:"public"`
+	Scheme     byte      `json:"scheme"`
+	KDF        string    `json:"kdf"`
+	KDFParams  KDFParams `json:"kdfparams"`
+	Cipher     string    `json:"cipher"`
+	Nonce      string    `json:"nonce"`
+	Ciphertext string    `json:"ciphertext"`
+}
+
+type KDFParams struct {
+	Iterations int    `json:"iterations"`
+	Salt       string `json:"salt"`
+}
+
+// PassphrasePrompt asks for the passphrase when it isn't in the environment,
+// tests and tools can replace it
+var PassphrasePrompt = promptPassphrase
+
+func EncryptKeypair(k *Keypair, passphrase []byte) (*EncryptedKey, error) {
+
+	salt := make([]byte, KEYSTORE_SALT_SIZE)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+
+	ek := &EncryptedKey{
+		Version:   KEYSTORE_VERSION,
+		Public:    string(k.Public),
+		Scheme:    k.SignatureScheme,
+		KDF:       KEYSTORE_KDF,
+		KDFParams: KDFParams{Iterations: KEYSTORE_KDF_ITERATIONS, Salt: hex.EncodeToString(salt)},
+		Cipher:    KEYSTORE_CIPHER,
+	}
+
+	aead, err := ek.aead(passphrase)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	ek.Nonce = hex.EncodeToString(nonce)
+	ek.Ciphertext = hex.EncodeToString(aead.Seal(nil, nonce, k.Private, ek.additionalData()))
+
+	return ek, nil
+}
+
+func (ek *EncryptedKey) Decrypt(passphrase []byte) (*Keypair, error) {
+
+	if ek.Version != KEYSTORE_VERSION || ek.KDF != KEYSTORE_KDF || ek.Cipher != KEYSTORE_CIPHER {
+		return nil, fmt.Errorf("Unsupported keystore version %d (%s, %s)", ek.Version, ek.KDF, ek.Cipher)
+	}
+
+	aead, err := ek.aead(passphrase)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce, err := hex.DecodeString(ek.Nonce)
+	if err != nil || len(nonce) != aead.NonceSize() {
+		return nil, errors.New("Invalid keystore nonce")
+	}
+	ciphertext, err := hex.DecodeString(ek.Ciphertext)
+	if err != nil {
+		return nil, errors.New("Invalid keystore ciphertext")
+	}
+
+	private, err := aead.Open(nil, nonce, ciphertext, ek.additionalData())
+	if err != nil {
+		return nil, ErrWrongPassphrase
+	}
+
+	return &Keypair{Public: []byte(ek.Public), Private: private, SignatureScheme: ek.Scheme}, nil
+}
+
+func (ek *EncryptedKey) aead(passphrase []byte) (cipher.AEAD, error) {
+
+	salt, err := hex.DecodeString(ek.KDFParams.Salt)
+	if err != nil {
+		return nil, errors.New("Invalid keystore salt")
+	}
+	if ek.KDFParams.Iterations < 1 {
+		return nil, errors.New("Invalid keystore KDF iterations")
+	}
+
+	key, err := pbkdf2.Key(sha256.New, string(passphrase), salt, ek.KDFParams.Iterations, 32)
+	if err != nil {
+		return nil, err
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+func (ek *EncryptedKey) additionalData() []byte {
+
+	return append([]byte{byte(ek.Version), ek.Scheme}, ek.Public...)
+}
+
+// KeystorePassphrase reads the passphrase from the environment, where an empty
+// value is accepted, or prompts for it on a terminal
+func KeystorePassphrase(confirm bool) ([]byte, error) {
+
+	if p, ok := os.LookupEnv(KEYSTORE_PASSPHRASE_ENV); ok {
+		return []byte(p), nil
+	}
+
+	return PassphrasePrompt(confirm)
+}
+
+func promptPassphrase(confirm bool) ([]byte, error) {
+
+	if fi, err := os.Stdin.Stat(); err != nil || fi.Mode()&os.ModeCharDevice == 0 {
+		return nil, ErrNoPassphrase
+	}
+
+	// The standard library can't turn off terminal echo
+	r := bufio.NewReader(os.Stdin)
+	fmt.Fprint(os.Stderr, "Keystore passphrase: ")
+	p, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	p = strings.TrimRight(p, "\r\n")
+
+	if confirm {
+		fmt.Fprint(os.Stderr, "Repeat passphrase: ")
+		again, err := r.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		if strings.TrimRight(again, "\r\n") != p {
+			return nil, errors.New("Passphrases don't match")
+		}
+	}
+
+	return []byte(p), nil
+}
+
+// isEncryptedKeystore tells an encrypted keystore from a legacy plaintext Keypair
+func isEncryptedKeystore(data []byte) (bool, error) {
+
+	var probe struct {
+		Ciphertext string `json:"ciphertext"`
+	}
+	if err := json.Unmarshal(data, &probe); err != nil {
+		return false, err
+	}
+	return probe.Ciphertext != "", nil
+}
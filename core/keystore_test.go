@@ -0,0 +1,89 @@
+package core
+
+import (
+	"encoding/json"
+	"os"
+	"path"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestKeystoreEncryption(t *testing.T) {
+
+	kp, _ := GenerateKeypair(SIGNATURE_SCHEME_ED25519)
+
+	ek, err := EncryptKeypair(kp, []byte("correct horse"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(ek.Ciphertext, string(kp.Private)) {
+		t.Error("Private key stored in the clear")
+	}
+
+	decrypted, err := ek.Decrypt([]byte("correct horse"))
+	if err != nil || !reflect.DeepEqual(decrypted, kp) {
+		t.Error("Keystore doesn't round trip", err)
+	}
+
+	if _, err := ek.Decrypt([]byte("battery staple")); err != ErrWrongPassphrase {
+		t.Error("Decrypted with the wrong passphrase")
+	}
+
+	ek.Public = string(GenerateNewKeypair().Public)
+	if _, err := ek.Decrypt([]byte("correct horse")); err != ErrWrongPassphrase {
+		t.Error("Public key isn't authenticated")
+	}
+}
+
+func TestKeystoreMigration(t *testing.T) {
+
+	t.Setenv(KEYSTORE_PASSPHRASE_ENV, "migrate me")
+
+	base := t.TempDir()
+	dir := DataDirectory(base)
+
+	// Plaintext keys as written by older versions
+	kp := GenerateNewKeypair()
+	plain, _ := json.Marshal(kp)
+	os.WriteFile(path.Join(dir, BLOCKHAIN_KEYS_FILENAME), plain, 0660)
+
+	opened, err := OpenConfiguration(base)
+	if err != nil || !reflect.DeepEqual(opened, kp) {
+		t.Fatal("Plaintext keys not opened", err)
+	}
+
+	data, _ := os.ReadFile(path.Join(dir, BLOCKHAIN_KEYS_FILENAME))
+	if encrypted, _ := isEncryptedKeystore(data); !encrypted {
+		t.Error("Plaintext keys weren't migrated")
+	}
+
+	fi, _ := os.Stat(path.Join(dir, BLOCKHAIN_KEYS_FILENAME))
+	di, _ := os.Stat(dir)
+	if fi.Mode().Perm() != 0600 || di.Mode().Perm() != 0700 {
+		t.Error("Keystore readable by others", fi.Mode(), di.Mode())
+	}
+
+	reopened, err := OpenConfiguration(base)
+	if err != nil || !reflect.DeepEqual(reopened, kp) {
+		t.Error("Migrated keystore doesn't open", err)
+	}
+
+	t.Setenv(KEYSTORE_PASSPHRASE_ENV, "wrong")
+	if _, err := OpenConfiguration(base); err != ErrWrongPassphrase {
+		t.Error("Opened keystore with the wrong passphrase")
+	}
+}
+
+func TestKeystoreWithoutPassphrase(t *testing.T) {
+
+	// Setenv restores the passphrase the test started with
+	t.Setenv(KEYSTORE_PASSPHRASE_ENV, "")
+	os.Unsetenv(KEYSTORE_PASSPHRASE_ENV)
+	PassphrasePrompt = func(bool) ([]byte, error) { return nil, ErrNoPassphrase }
+	defer func() { PassphrasePrompt = promptPassphrase }()
+
+	if err := WriteConfiguration(t.TempDir(), GenerateNewKeypair()); err != ErrNoPassphrase {
+		t.Error("Wrote keys without a passphrase")
+	}
+}
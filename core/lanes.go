@@ -0,0 +1,103 @@
+package core
+
+// Messages wait in one of three lanes, on their way to a peer and on their
+// way to the handlers: control and consensus, blocks, and transactions. Each
+// round takes up to laneWeights messages from every lane with some waiting,
+// highest priority first, so a transaction flood can't starve blocks and
+// pings, while transactions still get their share.
+
+type Lane byte
+
+const (
+	LANE_CONTROL Lane = iota
+	LANE_BLOCK
+	LANE_TX
+	LANE_COUNT
+)
+
+const LANE_INCOMING_SIZE = 1000 // messages from peers waiting in each lane
+
+// laneWeights are the messages taken from each lane per round
+var laneWeights = [LANE_COUNT]int{8, 4, 1}
+
+var laneNames = [LANE_COUNT]string{"control", "block", "tx"}
+
+type LaneStats struct {
+	Depth   int `json:"depth"` // frames waiting
+	Bytes   int `json:"bytes"`
+	Dropped int `json:"dropped"`
+	Frames  int `json:"frames"` // written
+}
+
+func (l Lane) String() string {
+
+	return laneNames[l]
+}
+
+// MessageLane is the lane messages with the identifier go in
+func MessageLane(id byte) Lane {
+
+	switch id {
+	case MESSAGE_GET_TRANSACTION, MESSAGE_SEND_TRANSACTION, MESSAGE_SEND_TRANSACTIONS, MESSAGE_INV, MESSAGE_GET_DATA:
+		return LANE_TX
+	case MESSAGE_GET_BLOCK, MESSAGE_SEND_BLOCK, MESSAGE_SEND_COMPACT_BLOCK, MESSAGE_GET_BLOCK_TRANSACTIONS, MESSAGE_SEND_BLOCK_TRANSACTIONS:
+		return LANE_BLOCK
+	}
+	return LANE_CONTROL
+}
+
+// laneScheduler runs the weighted rounds, callers guard it
+type laneScheduler struct {
+	credits [LANE_COUNT]int // left in this round
+}
+
+// pick takes the lane to serve next out of the ones with messages waiting
+func (s *laneScheduler) pick(waiting [LANE_COUNT]bool) (Lane, bool) {
+
+	for pass := 0; pass < 2; pass++ {
+		for l := LANE_CONTROL; l < LANE_COUNT; l++ {
+			if waiting[l] && s.credits[l] > 0 {
+				s.credits[l]--
+				return l, true
+			}
+		}
+		// Every waiting lane had its share, next round
+		s.credits = laneWeights
+	}
+	return 0, false
+}
+
+// NextMessage waits for the next message from peers to handle
+func (n *Network) NextMessage() Message {
+
+	n.incomingLock.Lock()
+	defer n.incomingLock.Unlock()
+
+	var waiting [LANE_COUNT]bool
+	for l := range waiting {
+		waiting[l] = len(n.incoming[l]) > 0
+	}
+	// Only this takes from the lanes, the one picked has a message
+	if l, ok := n.incomingLanes.pick(waiting); ok {
+		return <-n.incoming[l]
+	}
+
+	select {
+	case m := <-n.incoming[LANE_CONTROL]:
+		return m
+	case m := <-n.incoming[LANE_BLOCK]:
+		return m
+	case m := <-n.incoming[LANE_TX]:
+		return m
+	}
+}
+
+// IncomingDepth counts the messages waiting in each lane to be handled
+func (n *Network) IncomingDepth() [LANE_COUNT]int {
+
+	var depth [LANE_COUNT]int
+	for l := range depth {
+		depth[l] = len(n.incoming[l])
+	}
+	return depth
+}
@@ -0,0 +1,111 @@
+package core
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMessageLane(t *testing.T) {
+
+	lanes := map[byte]Lane{
+		MESSAGE_PING:               LANE_CONTROL,
+		MESSAGE_VERSION:            LANE_CONTROL,
+		MESSAGE_PBFT_PREPARE:       LANE_CONTROL,
+		MESSAGE_GET_NODES:          LANE_CONTROL,
+		MESSAGE_SEND_BLOCK:         LANE_BLOCK,
+		MESSAGE_SEND_COMPACT_BLOCK: LANE_BLOCK,
+		MESSAGE_SEND_TRANSACTIONS:  LANE_TX,
+		MESSAGE_INV:                LANE_TX,
+	}
+	for id, lane := range lanes {
+		if got := MessageLane(id); got != lane {
+			t.Error(MessageName(id), "in lane", got, "not", lane)
+		}
+	}
+}
+
+func TestLaneSchedulerWeights(t *testing.T) {
+
+	var s laneScheduler
+	all := [LANE_COUNT]bool{true, true, true}
+
+	// Two rounds with every lane waiting, each gets its weight
+	var taken [LANE_COUNT]int
+	for i := 0; i < 2*(laneWeights[LANE_CONTROL]+laneWeights[LANE_BLOCK]+laneWeights[LANE_TX]); i++ {
+		l, ok := s.pick(all)
+		if !ok {
+			t.Fatal("No lane picked")
+		}
+		taken[l]++
+	}
+	for l := range taken {
+		if taken[l] != 2*laneWeights[l] {
+			t.Error("Lane", Lane(l), "taken", taken[l], "times")
+		}
+	}
+
+	if l, ok := s.pick([LANE_COUNT]bool{LANE_TX: true}); !ok || l != LANE_TX {
+		t.Error("Lane waiting alone not picked", l, ok)
+	}
+	if _, ok := s.pick([LANE_COUNT]bool{}); ok {
+		t.Error("Picked a lane with nothing waiting")
+	}
+}
+
+func TestOutboundLanes(t *testing.T) {
+
+	q := newOutbound()
+	for i := 0; i < PEER_QUEUE_SIZE; i++ {
+		q.push([]byte{byte(LANE_TX)}, LANE_TX, QUEUE_DROP)
+	}
+
+	// A full transaction lane doesn't keep blocks and pings out or behind
+	if err := q.push([]byte{byte(LANE_BLOCK)}, LANE_BLOCK, QUEUE_DROP); err != nil {
+		t.Fatal("Block dropped behind transactions", err)
+	}
+	if err := q.push([]byte{byte(LANE_CONTROL)}, LANE_CONTROL, QUEUE_DROP); err != nil {
+		t.Fatal("Ping dropped behind transactions", err)
+	}
+	if s := q.Stats(); s.Depth != PEER_QUEUE_SIZE+2 || s.Lanes[LANE_TX].Depth != PEER_QUEUE_SIZE || s.Lanes[LANE_BLOCK].Depth != 1 {
+		t.Error("Wrong depth", s)
+	}
+
+	batch := q.take()
+	if len(batch) < 3 || batch[0][0] != byte(LANE_CONTROL) || batch[1][0] != byte(LANE_BLOCK) {
+		t.Error("Transactions written ahead of blocks and pings", batch[:3])
+	}
+	if s := q.Stats(); s.Lanes[LANE_CONTROL].Frames != 1 || s.Lanes[LANE_BLOCK].Frames != 1 || s.Frames != len(batch) {
+		t.Error("Wrong lane stats", s)
+	}
+}
+
+func TestNextMessage(t *testing.T) {
+
+	n := SetupNetwork("127.0.0.1:0", BLOCKCHAIN_PORT)
+	for i := 0; i < 100; i++ {
+		n.incoming[LANE_TX] <- Message{Identifier: MESSAGE_SEND_TRANSACTION}
+		n.incoming[LANE_BLOCK] <- Message{Identifier: MESSAGE_SEND_BLOCK}
+		n.incoming[LANE_CONTROL] <- Message{Identifier: MESSAGE_PBFT_PREPARE}
+	}
+	if d := n.IncomingDepth(); d != [LANE_COUNT]int{100, 100, 100} {
+		t.Error("Wrong depth", d)
+	}
+
+	var taken [LANE_COUNT]int
+	for i := 0; i < laneWeights[LANE_CONTROL]+laneWeights[LANE_BLOCK]+laneWeights[LANE_TX]; i++ {
+		taken[MessageLane(n.NextMessage().Identifier)]++
+	}
+	if taken != laneWeights {
+		t.Error("Messages not taken by weight", taken)
+	}
+
+	// Idle lanes wait for the next message from any of them
+	n = SetupNetwork("127.0.0.1:0", BLOCKCHAIN_PORT)
+	go func() {
+		time.Sleep(time.Millisecond * 50)
+		n.incoming[LANE_TX] <- Message{Identifier: MESSAGE_INV}
+	}()
+	if m := n.NextMessage(); m.Identifier != MESSAGE_INV {
+		t.Error("Wrong message", MessageName(m.Identifier))
+	}
+}
@@ -4,6 +4,10 @@ import (
 	"encoding/hex"
 	"fmt"
 	"log"
+	"os"
+	"path"
+	"strings"
+	"sync"
 	"time"
 )
 
@@ -11,37 +15,108 @@ var Core = struct {
 	*Keypair
 	*Blockchain
 	*Network
+
+	RPC     *RPCServer
+	DataDir string
 }{}
 
-func Start(address string) {
+// Config of a node run by Start
+type Config struct {
+	Address   string // where peers connect
+	DataDir   string // keys, block store, peers and reports, see DataDirectory
+	Consensus string // CONSENSUS_POW when empty
+	Fanout    int    // peers a broadcast goes to, all when 0
+	TTL       int    // hops a broadcast travels, GOSSIP_TTL when 0
+	Faults     string // scenario file of faults to inject into the network, see FaultScenario
+	Plaintext  bool   // frames to peers aren't encrypted, all nodes must agree
+	ChainID    uint32 // peers on other chains are rejected, DEFAULT_CHAIN_ID when 0
+	FullBlocks bool   // blocks go out whole instead of compact, see CompactRelay
+	PushTxs    bool   // transactions are gossiped whole instead of announced, see Inventory
+	SingleTxs  bool   // every transaction goes in a message of its own, see TxBatcher
+	Compress   bool   // frames to peers that also compress are deflated
+	RateLimits string // file of limits on the messages from each peer, see RateLimits
+}
+
+func Start(config Config) {
+
+	Core.DataDir = DataDirectory(config.DataDir)
+	if err := os.MkdirAll(Core.DataDir, 0700); err != nil {
+		log.Fatalln("Creating data directory:", err)
+	}
 
 	// Setup keys
-	keypair, _ := OpenConfiguration(HOME_DIRECTORY_CONFIG)
+	keypair, err := OpenConfiguration(Core.DataDir)
+	if err != nil {
+		// Don't generate a new identity over a keystore we couldn't unlock
+		log.Fatalln("Opening keystore:", err)
+	}
 	if keypair == nil {
 
 		fmt.Println("Generating keypair...")
 		keypair = GenerateNewKeypair()
-		WriteConfiguration(HOME_DIRECTORY_CONFIG, keypair)
+		logOnError(WriteConfiguration(Core.DataDir, keypair))
 	}
 	Core.Keypair = keypair
 
 	// Setup Network
-	Core.Network = SetupNetwork(address, BLOCKCHAIN_PORT)
-	go Core.Network.Run()
-	for _, n := range SEED_NODES() {
-		Core.Network.ConnectionsQueue <- n
+	Core.Network = SetupNetwork(config.Address, BLOCKCHAIN_PORT)
+	Core.Network.Gossip.Fanout = config.Fanout
+	Core.Network.Plaintext = config.Plaintext
+	Core.Network.Compress = config.Compress
+	Core.Network.Inventory.Push = config.PushTxs
+	Core.Network.TxBatch.Single = config.SingleTxs
+	if config.ChainID != 0 {
+		Core.Network.ChainID = config.ChainID
+	}
+	if Core.Network.Scores, err = NewPeerScores(Core.DataDir); err != nil {
+		log.Println("Loading bans:", err)
+	}
+	if config.TTL > 0 {
+		Core.Network.Gossip.TTL = byte(min(config.TTL, 255))
+	}
+	if config.Faults != "" {
+		scenario, err := LoadFaultScenario(config.Faults)
+		if err != nil {
+			log.Fatalln("Loading fault scenario:", err)
+		}
+		Core.Network.Faults.Set(scenario)
+	}
+	if config.RateLimits != "" {
+		limits, err := LoadRateLimits(config.RateLimits)
+		if err != nil {
+			log.Fatalln("Loading rate limits:", err)
+		}
+		Core.Network.Limits.Set(limits)
 	}
 
 	// Setup blockchain
 	Core.Blockchain = SetupBlockchan()
+	Core.Blockchain.Relay.FullBlocks = config.FullBlocks
+	if Core.Blockchain.Consensus, err = NewConsensus(config.Consensus, Core.Blockchain, Core.DataDir); err != nil {
+		log.Fatalln("Setting up consensus:", err)
+	}
+	store, blocks, err := OpenBlockStore(path.Join(Core.DataDir, BLOCKCHAIN_STORE_FILENAME))
+	if err != nil {
+		log.Fatalln("Opening block store:", err)
+	}
+	if len(blocks) > 0 {
+		fmt.Printf("Loaded %d blocks from %s\n", len(blocks), Core.DataDir)
+		Core.Blockchain.LoadBlocks(blocks)
+		Core.Blockchain.CurrentBlock = Core.Blockchain.CreateNewBlock()
+	}
+	Core.Blockchain.Store = store
+
+	// Peers are told our genesis and consensus when they connect
+	go Core.Network.Run()
+	peers, err := LoadPeers(Core.DataDir)
+	logOnError(err)
+	Core.Network.Prefer(append(SEED_NODES(), peers...)...)
+
 	go Core.Blockchain.Run()
 
 	go func() {
 		for {
-			select {
-			case msg := <-Core.Network.IncomingMessages:
-				HandleIncomingMessage(msg)
-			}
+			HandleIncomingMessage(Core.Network.NextMessage())
 		}
 	}()
 }
@@ -49,6 +124,8 @@ func Start(address string) {
 func CreateTransaction(txt string) *Transaction {
 
 	t := NewTransaction(Core.Keypair.Public, nil, []byte(txt))
+	t.Header.Scheme = Core.Keypair.Scheme()
+	t.Header.Fee = t.MinRelayFee()
 	t.Header.Nonce = t.GenerateNonce(TRANSACTION_POW)
 	t.Signature = t.Sign(Core.Keypair)
 
@@ -56,9 +133,6 @@ func CreateTransaction(txt string) *Transaction {
 }
 
 //var cnt = 0
-var count int = 0
-var totalTime float64 = 0
-var SEND int = 10000
 func HandleIncomingMessage(msg Message) {
 
 
@@ -67,18 +141,21 @@ func HandleIncomingMessage(msg Message) {
 		t := new(Transaction)
 		_, err := t.UnmarshalBinary(msg.Data)
 		if err != nil {
-			networkError(err)
+			logRejected("tx", msg.Data, err)
+			Core.Network.Penalize(msg.Peer, PEER_PENALTY_MALFORMED, "undecodable transaction")
 			break
 		}
-		count += 1
-
-		trHax := hex.EncodeToString(t.Hash())
-		du := time.Now().Sub(beginTime[trHax]).Seconds()
-		totalTime += du
-		if count >= SEND {
+		receiveTransaction(t, msg.Peer)
 
-			fmt.Println("Receive ", SEND, " valid tx, total time is :", totalTime)
-			panic("xxxxx")
+	case MESSAGE_SEND_TRANSACTIONS:
+		var txs TransactionSlice
+		if err := txs.UnmarshalBinary(msg.Data); err != nil {
+			logRejected("txs", msg.Data, err)
+			Core.Network.Penalize(msg.Peer, PEER_PENALTY_MALFORMED, "undecodable transactions")
+			break
+		}
+		for i := range txs {
+			receiveTransaction(&txs[i], msg.Peer)
 		}
 
 
@@ -88,19 +165,170 @@ func HandleIncomingMessage(msg Message) {
 		b := new(Block)
 		err := b.UnmarshalBinary(msg.Data)
 		if err != nil {
-			networkError(err)
+			logRejected("block", msg.Data, err)
+			Core.Network.Penalize(msg.Peer, PEER_PENALTY_MALFORMED, "undecodable block")
+			break
+		}
+		receiveBlock(b, msg.Peer)
+
+	case MESSAGE_SEND_COMPACT_BLOCK:
+		c := new(CompactBlock)
+		if err := c.UnmarshalBinary(msg.Data); err != nil {
+			logRejected("compact-block", msg.Data, err)
+			Core.Network.Penalize(msg.Peer, PEER_PENALTY_MALFORMED, "undecodable compact block")
+			break
+		}
+		// Checked before waiting for its transactions
+		if failed := failedChecks(c.Checks(blockPow())); len(failed) > 0 {
+			Core.Network.Penalize(msg.Peer, checksPenalty(failed, PEER_PENALTY_BAD_BLOCK), "bad compact block: "+strings.Join(failed, ", "))
+			break
+		}
+		b, req := Core.Blockchain.Relay.Receive(c, msg.Peer)
+		if req != nil {
+			reply := NewMessage(MESSAGE_GET_BLOCK_TRANSACTIONS)
+			reply.Data, _ = req.MarshalBinary()
+			Core.Network.Reply(msg.Peer, *reply)
+		}
+		if b != nil {
+			receiveBlock(b, msg.Peer)
+		}
+
+	case MESSAGE_GET_BLOCK_TRANSACTIONS:
+		req := new(BlockTransactionsRequest)
+		if err := req.UnmarshalBinary(msg.Data); err != nil {
+			logRejected("transactions-request", msg.Data, err)
+			Core.Network.Penalize(msg.Peer, PEER_PENALTY_MALFORMED, "undecodable transactions request")
+			break
+		}
+		reply, err := Core.Blockchain.Relay.Serve(req, Core.Blockchain, func(m Message) { Core.Network.Reply(msg.Peer, m) })
+		if err == ErrBlockTransactions {
+			Core.Network.Penalize(msg.Peer, PEER_PENALTY_MALFORMED, "transactions request past the block")
+		}
+		if reply != nil {
+			Core.Network.Reply(msg.Peer, *reply)
+		}
+
+	case MESSAGE_SEND_BLOCK_TRANSACTIONS:
+		bt := new(BlockTransactions)
+		if err := bt.UnmarshalBinary(msg.Data); err != nil {
+			logRejected("block-transactions", msg.Data, err)
+			Core.Network.Penalize(msg.Peer, PEER_PENALTY_MALFORMED, "undecodable block transactions")
+			break
+		}
+		b, err := Core.Blockchain.Relay.Fill(bt, msg.Peer)
+		if err == ErrBlockTransactions {
+			Core.Network.Penalize(msg.Peer, PEER_PENALTY_BAD_BLOCK, "block transactions don't match the block")
+		}
+		if b != nil {
+			receiveBlock(b, msg.Peer)
+		}
+
+	case MESSAGE_INV:
+		var hashes InventoryHashes
+		if err := hashes.UnmarshalBinary(msg.Data); err != nil {
+			logRejected("inventory", msg.Data, err)
+			Core.Network.Penalize(msg.Peer, PEER_PENALTY_MALFORMED, "undecodable inventory")
+			break
+		}
+		if want := Core.Network.Inventory.Announced(hashes, msg.Peer); len(want) > 0 {
+			reply := NewMessage(MESSAGE_GET_DATA)
+			reply.Data, _ = want.MarshalBinary()
+			Core.Network.Reply(msg.Peer, *reply)
+		}
+
+	case MESSAGE_GET_DATA:
+		var hashes InventoryHashes
+		if err := hashes.UnmarshalBinary(msg.Data); err != nil {
+			logRejected("get-data", msg.Data, err)
+			Core.Network.Penalize(msg.Peer, PEER_PENALTY_MALFORMED, "undecodable get data")
 			break
 		}
-		print("Receive a block contains ", b.TransactionSlice.Len(), " tx\n")
-		blockHash := hex.EncodeToString(b.Hash())
-		fmt.Printf("Recieve a block [%s]\n", blockHash)
-		//if value, ok := beginTime[blockHash]; ok {
-		usedTime := time.Now().Sub(beginTime[blockHash]).Seconds()
-		txsNumber := BLOCK_TX_NUM
-		fmt.Printf("Tx_num: %d, usedTime: %fs, tps: %f\n", txsNumber, usedTime, float64(txsNumber)/usedTime)
-		//}
-		//Core.Blockchain.BlocksQueue <- *b
+		txs := TransactionSlice{}
+		for _, hash := range hashes {
+			t := Core.Blockchain.Relay.Transaction(hash)
+			if t == nil {
+				t = Core.Blockchain.Mempool.Get(hash)
+			}
+			if t != nil {
+				txs = append(txs, *t)
+			}
+		}
+		Core.Network.ReplyTransactions(msg.Peer, txs)
+		Core.Network.Inventory.Served(len(txs))
+
+	case MESSAGE_PBFT_PRE_PREPARE, MESSAGE_PBFT_PREPARE, MESSAGE_PBFT_COMMIT, MESSAGE_PBFT_VIEW_CHANGE, MESSAGE_PBFT_NEW_VIEW:
+		if h, ok := Core.Blockchain.Consensus.(ConsensusHandler); ok {
+			h.HandleMessage(msg)
+		}
+	}
+}
+
+// receiveTransaction checks a transaction from peer and counts it, see receivedStats
+func receiveTransaction(t *Transaction, peer string) {
+
+	if failed := failedChecks(t.Checks(TRANSACTION_POW)); len(failed) > 0 {
+		Core.Network.Penalize(peer, checksPenalty(failed, PEER_PENALTY_INVALID_TRANSACTION), "invalid transaction: "+strings.Join(failed, ", "))
+		return
+	}
+	if !Core.Network.Inventory.Add(t.Hash(), t.Size(), peer) {
+		return
+	}
+	Core.Blockchain.Relay.Add(t)
+
+	received.Lock()
+	defer received.Unlock()
+
+	received.Transactions++
+	if start, ok := beginTime.get(hex.EncodeToString(t.Hash())); ok {
+		received.TotalTime += time.Since(start).Seconds()
+	}
+}
+
+// ReceivedStats count the valid transactions from peers
+type ReceivedStats struct {
+	Transactions int     `json:"transactions"`
+	TotalTime    float64 `json:"totalTime"` // seconds from making ours to getting them back
+}
+
+var received struct {
+	sync.Mutex
+	ReceivedStats
+}
+
+func receivedStats() ReceivedStats {
+
+	received.Lock()
+	defer received.Unlock()
+
+	return received.ReceivedStats
+}
+
+// blockPow is the proof of work blocks from peers need, none without proof of work consensus
+func blockPow() []byte {
+
+	if c, ok := Core.Blockchain.Consensus.(*ProofOfWork); ok {
+		return c.Difficulty
+	}
+	return nil
+}
+
+// receiveBlock checks a block from peer and queues it to be added
+func receiveBlock(b *Block, peer string) {
+
+	if failed := failedChecks(b.Checks(blockPow(), TRANSACTION_POW)); len(failed) > 0 {
+		Core.Network.Penalize(peer, checksPenalty(failed, PEER_PENALTY_BAD_BLOCK), "bad block: "+strings.Join(failed, ", "))
+		return
 	}
+	print("Receive a block contains ", b.TransactionSlice.Len(), " tx\n")
+	blockHash := hex.EncodeToString(b.Hash())
+	fmt.Printf("Recieve a block [%s]\n", blockHash)
+	//if value, ok := beginTime[blockHash]; ok {
+	start, _ := beginTime.get(blockHash)
+	usedTime := time.Now().Sub(start).Seconds()
+	txsNumber := BLOCK_TX_NUM
+	fmt.Printf("Tx_num: %d, usedTime: %fs, tps: %f\n", txsNumber, usedTime, float64(txsNumber)/usedTime)
+	//}
+	Core.Blockchain.BlocksQueue <- *b
 }
 
 func logOnError(err error) {
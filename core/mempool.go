@@ -0,0 +1,188 @@
+package core
+
+import (
+	"container/heap"
+	"encoding/hex"
+	"errors"
+	"math/bits"
+	"sync"
+
+	"github.com/izqui/helpers"
+)
+
+var (
+	ErrMempoolFull = errors.New("Mempool is full")
+	ErrFeeTooLow   = errors.New("Transaction fee is below the minimum relay fee")
+	ErrTxInMempool = errors.New("Transaction already in mempool")
+)
+
+// Mempool holds validated transactions waiting to be included in a block,
+// ordered by fee rate so block assembly takes the highest paying ones first.
+type Mempool struct {
+	sync.Mutex
+
+	Capacity        int
+	MinRelayFeeRate uint64
+
+	entries map[string]*mempoolEntry
+	queue   mempoolQueue
+	bytes   int
+	seq     uint64
+}
+
+type mempoolEntry struct {
+	tx    *Transaction
+	hash  string
+	size  int
+	seq   uint64
+	index int
+}
+
+func NewMempool(capacity int, minRelayFeeRate uint64) *Mempool {
+
+	return &Mempool{Capacity: capacity, MinRelayFeeRate: minRelayFeeRate, entries: map[string]*mempoolEntry{}}
+}
+
+func (mp *Mempool) Add(t *Transaction) error {
+
+	size := t.Size()
+	if t.Header.Fee < uint64(size)*mp.MinRelayFeeRate {
+		return ErrFeeTooLow
+	}
+
+	hash := hex.EncodeToString(t.Hash())
+
+	mp.Lock()
+	defer mp.Unlock()
+
+	if mp.entries[hash] != nil {
+		return ErrTxInMempool
+	}
+	if len(mp.entries) >= mp.Capacity {
+		return ErrMempoolFull
+	}
+
+	mp.seq++
+	e := &mempoolEntry{tx: t, hash: hash, size: size, seq: mp.seq}
+	mp.entries[hash] = e
+	mp.bytes += size
+	heap.Push(&mp.queue, e)
+
+	return nil
+}
+
+// Select removes and returns up to max transactions, highest fee rate first
+func (mp *Mempool) Select(max int) TransactionSlice {
+
+	mp.Lock()
+	defer mp.Unlock()
+
+	n := helpers.Min(max, mp.queue.Len())
+	slice := make(TransactionSlice, 0, n)
+	for i := 0; i < n; i++ {
+
+		e := heap.Pop(&mp.queue).(*mempoolEntry)
+		delete(mp.entries, e.hash)
+		mp.bytes -= e.size
+
+		slice = append(slice, *e.tx)
+	}
+
+	return slice
+}
+
+// Remove drops a transaction, e.g. once it has been included in someone else's block
+func (mp *Mempool) Remove(hash []byte) bool {
+
+	mp.Lock()
+	defer mp.Unlock()
+
+	e := mp.entries[hex.EncodeToString(hash)]
+	if e == nil {
+		return false
+	}
+
+	heap.Remove(&mp.queue, e.index)
+	delete(mp.entries, e.hash)
+	mp.bytes -= e.size
+
+	return true
+}
+
+func (mp *Mempool) Get(hash []byte) *Transaction {
+
+	mp.Lock()
+	defer mp.Unlock()
+
+	if e := mp.entries[hex.EncodeToString(hash)]; e != nil {
+		return e.tx
+	}
+	return nil
+}
+
+func (mp *Mempool) Has(hash []byte) bool {
+
+	return mp.Get(hash) != nil
+}
+
+func (mp *Mempool) Len() int {
+
+	mp.Lock()
+	defer mp.Unlock()
+
+	return len(mp.entries)
+}
+
+// Bytes is the total marshalled size of the pooled transactions
+func (mp *Mempool) Bytes() int {
+
+	mp.Lock()
+	defer mp.Unlock()
+
+	return mp.bytes
+}
+
+// mempoolQueue is a max-heap on fee rate, ties broken by arrival order
+type mempoolQueue []*mempoolEntry
+
+func (q mempoolQueue) Len() int { return len(q) }
+
+func (q mempoolQueue) Less(i, j int) bool {
+
+	// Compare fee_i/size_i > fee_j/size_j as fee_i*size_j > fee_j*size_i in 128 bits
+	hi1, lo1 := bits.Mul64(q[i].tx.Header.Fee, uint64(q[j].size))
+	hi2, lo2 := bits.Mul64(q[j].tx.Header.Fee, uint64(q[i].size))
+
+	if hi1 != hi2 {
+		return hi1 > hi2
+	}
+	if lo1 != lo2 {
+		return lo1 > lo2
+	}
+	return q[i].seq < q[j].seq
+}
+
+func (q mempoolQueue) Swap(i, j int) {
+
+	q[i], q[j] = q[j], q[i]
+	q[i].index = i
+	q[j].index = j
+}
+
+func (q *mempoolQueue) Push(x interface{}) {
+
+	e := x.(*mempoolEntry)
+	e.index = len(*q)
+	*q = append(*q, e)
+}
+
+func (q *mempoolQueue) Pop() interface{} {
+
+	old := *q
+	l := len(old)
+	e := old[l-1]
+	old[l-1] = nil
+	*q = old[:l-1]
+
+	return e
+}
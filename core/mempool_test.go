@@ -0,0 +1,73 @@
+package core
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/izqui/helpers"
+)
+
+func mempoolTestTransaction(payloadSize int, feeRate uint64) *Transaction {
+
+	tr := NewTransaction(nil, nil, []byte(helpers.RandomString(payloadSize)))
+	tr.Header.Fee = uint64(tr.Size()) * feeRate
+
+	return tr
+}
+
+func TestMempoolFeeOrdering(t *testing.T) {
+
+	mp := NewMempool(10, MIN_RELAY_FEE_RATE)
+
+	low := mempoolTestTransaction(100, 1)
+	high := mempoolTestTransaction(1000, 5)
+	mid := mempoolTestTransaction(10, 3)
+	midLater := mempoolTestTransaction(500, 3)
+
+	for _, tr := range []*Transaction{low, high, mid, midLater} {
+		if err := mp.Add(tr); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	slice := mp.Select(3)
+	expected := TransactionSlice{*high, *mid, *midLater}
+
+	if !reflect.DeepEqual(slice, expected) {
+		t.Error("Mempool doesn't select by fee rate")
+	}
+	if mp.Len() != 1 || mp.Bytes() != low.Size() || !mp.Has(low.Hash()) {
+		t.Error("Mempool didn't keep the lowest paying transaction")
+	}
+}
+
+func TestMempoolMinRelayFee(t *testing.T) {
+
+	mp := NewMempool(10, 2)
+
+	tr := mempoolTestTransaction(100, 1)
+	if mp.Add(tr) != ErrFeeTooLow {
+		t.Error("Accepted transaction under the minimum relay fee")
+	}
+
+	tr.Header.Fee = tr.MinRelayFee() * 2
+	if mp.Add(tr) != nil {
+		t.Error("Rejected transaction paying the minimum relay fee")
+	}
+}
+
+func TestMempoolDuplicatesAndCapacity(t *testing.T) {
+
+	mp := NewMempool(1, MIN_RELAY_FEE_RATE)
+
+	tr := mempoolTestTransaction(100, 1)
+	if mp.Add(tr) != nil || mp.Add(tr) != ErrTxInMempool {
+		t.Error("Mempool accepted a duplicate transaction")
+	}
+	if mp.Add(mempoolTestTransaction(100, 1)) != ErrMempoolFull {
+		t.Error("Mempool grew over its capacity")
+	}
+	if !mp.Remove(tr.Hash()) || mp.Len() != 0 || mp.Bytes() != 0 {
+		t.Error("Mempool removal fails")
+	}
+}
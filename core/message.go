@@ -1,9 +1,9 @@
 package core
 
 import (
-	"bytes"
-	"errors"
-	"github.com/izqui/helpers"
+	"bufio"
+	"fmt"
+	"io"
 )
 
 type Message struct {
@@ -11,7 +11,47 @@ type Message struct {
 	Options    []byte
 	Data       []byte
 
-	Reply chan Message
+	Peer string // key of the node it came from, empty for our own, see Network.Reply
+}
+
+var messageNames = map[byte]string{
+	MESSAGE_GET_NODES:        "getNodes",
+	MESSAGE_SEND_NODES:       "sendNodes",
+	MESSAGE_GET_TRANSACTION:  "getTransaction",
+	MESSAGE_SEND_TRANSACTION: "sendTransaction",
+	MESSAGE_GET_BLOCK:        "getBlock",
+	MESSAGE_SEND_BLOCK:       "sendBlock",
+
+	MESSAGE_PBFT_PRE_PREPARE: "pbftPrePrepare",
+	MESSAGE_PBFT_PREPARE:     "pbftPrepare",
+	MESSAGE_PBFT_COMMIT:      "pbftCommit",
+	MESSAGE_PBFT_VIEW_CHANGE: "pbftViewChange",
+	MESSAGE_PBFT_NEW_VIEW:    "pbftNewView",
+
+	MESSAGE_PING: "ping",
+	MESSAGE_PONG: "pong",
+
+	MESSAGE_VERSION: "version",
+	MESSAGE_REJECT:  "reject",
+
+	MESSAGE_SEND_COMPACT_BLOCK:      "sendCompactBlock",
+	MESSAGE_GET_BLOCK_TRANSACTIONS:  "getBlockTransactions",
+	MESSAGE_SEND_BLOCK_TRANSACTIONS: "sendBlockTransactions",
+
+	MESSAGE_INV:      "inv",
+	MESSAGE_GET_DATA: "getData",
+
+	MESSAGE_SEND_TRANSACTIONS: "sendTransactions",
+
+	MESSAGE_COMPRESSED: "compressed",
+}
+
+func MessageName(id byte) string {
+
+	if name, ok := messageNames[id]; ok {
+		return name
+	}
+	return fmt.Sprintf("unknown(%d)", id)
 }
 
 func NewMessage(id byte) *Message {
@@ -21,26 +61,46 @@ func NewMessage(id byte) *Message {
 
 func (m *Message) MarshalBinary() ([]byte, error) {
 
-	buf := new(bytes.Buffer)
+	e := NewEncoder()
+	e.Byte(CODEC_VERSION)
+	e.Byte(m.Identifier)
+	e.Bytes(m.Options)
+	e.Bytes(m.Data)
 
-	buf.WriteByte(m.Identifier)
-	buf.Write(helpers.FitBytesInto(m.Options, MESSAGE_OPTIONS_SIZE))
-	buf.Write(m.Data)
+	return e.Result()
+}
+
+func (m *Message) UnmarshalBinary(d []byte) error {
 
-	return buf.Bytes(), nil
+	dec := NewDecoder(d)
+	dec.Version("message version")
+	m.Identifier = dec.Byte("message identifier")
+	m.Options = dec.Bytes("message options", MESSAGE_OPTIONS_SIZE)
+	m.Data = dec.Bytes("message data", MAX_FRAME_SIZE)
 
+	return dec.Finish("message")
 }
 
-func (m *Message) UnmarshalBinary(d []byte) error {
+// WriteMessage frames a message so the other end can find where it stops
+func WriteMessage(w io.Writer, m Message) error {
+
+	b, err := m.MarshalBinary()
+	if err != nil {
+		return err
+	}
+
+	return WriteFrame(w, b)
+}
 
-	buf := bytes.NewBuffer(d)
+// ReadMessage reads the next framed message. Frames that arrive whole but
+// don't decode are returned as errors without breaking the stream.
+func ReadMessage(r *bufio.Reader) (*Message, error) {
 
-	if len(d) < MESSAGE_OPTIONS_SIZE+MESSAGE_TYPE_SIZE {
-		return errors.New("Insuficient message size")
+	b, err := ReadFrame(r, MAX_FRAME_SIZE)
+	if err != nil {
+		return nil, err
 	}
-	m.Identifier = buf.Next(1)[0]
-	m.Options = helpers.StripByte(buf.Next(MESSAGE_OPTIONS_SIZE), 0)
-	m.Data = buf.Next(helpers.MaxInt)
 
-	return nil
+	m := new(Message)
+	return m, m.UnmarshalBinary(b)
 }
@@ -1,11 +1,18 @@
 package core
 
 import (
+	"bufio"
+	"bytes"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net"
 	"os"
+	"path"
+	"slices"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/izqui/helpers"
@@ -15,83 +22,272 @@ type ConnectionsQueue chan string
 type NodeChannel chan *Node
 type Node struct {
 	*net.TCPConn
+	conn     net.Conn // TCPConn behind the handshake encryption and fault layer, frames go through it
+	ID       string   // base58 public key the node authenticated with
+	listen   string   // where the node said it takes connections
+	version  *PeerVersion
+	reader   *bufio.Reader // of conn, frames are read from
 	lastSeen int
+	inbound  bool // connected to us, outbound nodes we dialed
+	out      *outbound
+	compress bool // frames to it are compressed, both ends enabled compression
+	limits   peerLimits
+
+	lock        sync.Mutex // guards lastSeen, the ping state and compression
+	pingNonce   []byte
+	pingSent    time.Time // of the ping waiting for a pong, zero when none
+	rtt         time.Duration
+	compression CompressionStats
 }
 
 type Nodes map[string]*Node
 
+// rejectedCount limits the rejected data saved by logRejected
+var rejectedCount int32
+
+// nodesLock guards Core.Nodes, which is read outside the network goroutine
+var nodesLock sync.RWMutex
+
 type Network struct {
 	Nodes
 	ConnectionsQueue
 	Address            string
 	ConnectionCallback NodeChannel
 	BroadcastQueue     chan Message
-	IncomingMessages   chan Message
+	Gossip             *Gossip
+	Inventory          *Inventory
+	TxBatch            *TxBatcher // of our transactions when they're pushed whole
+	Scores             *PeerScores
+	Faults             *Faults
+	Limits             *RateLimiter // of the messages from each peer
+	Plaintext          bool         // frames to peers aren't encrypted, to measure what encryption costs
+	Compress           bool         // frames to peers that agree are compressed, see CompressionStats
+	ChainID            uint32
+
+	// Connection slots, MAX_NODE_CONNECTIONS split between both directions
+	MaxInbound  int
+	MaxOutbound int
+
+	preferred []string // dialed again whenever not connected, guarded by nodesLock
+
+	incoming      [LANE_COUNT]chan Message // from peers, taken by NextMessage
+	incomingLock  sync.Mutex               // guards incomingLanes
+	incomingLanes laneScheduler
+}
+
+// Key identifies the node by the public key it authenticated with
+func (node *Node) Key() string {
+
+	if node.ID == "" {
+		// Skipped the handshake, in tests
+		return node.TCPConn.RemoteAddr().String()
+	}
+	return node.ID
+}
+
+// Address is where the node takes connections, when it said so for the host
+// it connects from, else where it connects from
+func (node *Node) Address() string {
+
+	remote := node.TCPConn.RemoteAddr().String()
+	host, _, _ := net.SplitHostPort(remote)
+	if listenHost, _, err := net.SplitHostPort(node.listen); err == nil && listenHost == host {
+		return node.listen
+	}
+	return remote
+}
+
+// Supports tells if the node said it handles messages of type id
+func (node *Node) Supports(id byte) bool {
+
+	return node.version == nil || node.version.Supports(id)
+}
+
+func (node *Node) protocol() uint32 {
+
+	if node.version == nil {
+		return 0
+	}
+	return node.version.Protocol
+}
+
+// replaces tells if node, another connection to the peer of old, is the one
+// to keep. Both peers keep the connection dialed by the lower key.
+func (node *Node) replaces(old *Node) bool {
+
+	if node.ID == "" || node.inbound == old.inbound {
+		return false
+	}
+	return node.dialer() < old.dialer()
+}
+
+func (node *Node) dialer() string {
+
+	if node.inbound {
+		return node.ID
+	}
+	return string(Core.Keypair.Public)
 }
 
 func (n Nodes) AddNode(node *Node) bool {
 
-	key := node.TCPConn.RemoteAddr().String()
+	key := node.Key()
+	if Core.Network.Scores.Banned(node.Address(), node.ID) {
+		fmt.Println("Refused banned node", node.Address())
+		node.TCPConn.Close()
+		return false
+	}
+
+	nodesLock.Lock()
+	defer nodesLock.Unlock()
+
+	old := n[key]
+	if old != nil && !node.replaces(old) {
+		node.TCPConn.Close()
+		return false
+	}
+	if (old == nil || old.inbound != node.inbound) && !n.freeSlot(node.inbound) {
+		fmt.Println("No free connection slot for", key)
+		node.TCPConn.Close()
+		return false
+	}
+	if old != nil {
+		fmt.Println("Replacing connection to", key)
+		old.TCPConn.Close()
+	}
+
+	fmt.Println("Node connected", key, node.Address())
+	if node.conn == nil {
+		node.conn = node.TCPConn
+	}
+	node.conn = Core.Network.Faults.Wrap(node.conn, node.Address())
+	if node.reader == nil {
+		node.reader = bufio.NewReader(node.conn)
+	}
+	n[key] = node
 
-	if key != Core.Network.Address && n[key] == nil {
+	node.out = newOutbound()
+	node.compress = Core.Network.Compress && node.Supports(MESSAGE_COMPRESSED)
+	go node.write()
+	go Core.Network.HandleNode(node)
 
-		fmt.Println("Node connected", key)
-		n[key] = node
+	return true
+}
 
-		go HandleNode(node)
+// RemoveNode forgets a disconnected node, freeing its slot
+func (n Nodes) RemoveNode(node *Node) {
 
-		return true
+	key := node.Key()
+
+	nodesLock.Lock()
+	defer nodesLock.Unlock()
+
+	if n[key] == node {
+		delete(n, key)
+	}
+}
+
+// freeSlot tells if another connection fits in the direction of inbound
+func (n Nodes) freeSlot(inbound bool) bool {
+
+	in, out := n.slots()
+	if inbound {
+		return in < Core.Network.MaxInbound
+	}
+	return out < Core.Network.MaxOutbound
+}
+
+// connectedTo tells if the node at address is connected, either way
+func (n Nodes) connectedTo(address string) bool {
+
+	for _, node := range n {
+		if node.Address() == address {
+			return true
+		}
 	}
 	return false
 }
 
-func HandleNode(node *Node) {
+// slots counts the connections in each direction
+func (n Nodes) slots() (inbound, outbound int) {
 
-	for {
-		var bs []byte = make([]byte, 1024 * 1000 * 5)
-		n, err := node.TCPConn.Read(bs[0:])
-		networkError(err)
+	for _, node := range n {
+		if node.inbound {
+			inbound++
+		} else {
+			outbound++
+		}
+	}
+	return inbound, outbound
+}
+
+func (n *Network) HandleNode(node *Node) {
 
-		if err == io.EOF {
-			fmt.Println("EOF")
-			//: Remove node [Issue: https://github.com/izqui/blockchain/issues/3]
+	peer := node.Key()
+	for {
+		b, err := ReadFrame(node.reader, MAX_FRAME_SIZE)
+		if err != nil {
+			networkError(err)
+			fmt.Println("Node disconnected", node.TCPConn.RemoteAddr())
 			node.TCPConn.Close()
+			node.out.close()
+			n.Nodes.RemoveNode(node)
 			break
 		}
+		if n.Faults.Partitioned(node.Address()) {
+			continue
+		}
+		node.seen()
+		if !n.Limits.AllowFrame(node, len(b)) {
+			continue
+		}
 
 		m := new(Message)
-		err = m.UnmarshalBinary(bs[0:n])
-
+		size := len(b)
+		err = m.UnmarshalBinary(b)
+		if err == nil && m.Identifier == MESSAGE_COMPRESSED {
+			if n.Compress {
+				size, err = node.decompress(m)
+			} else {
+				err = ErrNotCompressing
+			}
+		}
 		if err != nil {
-			fmt.Println(err)
+			// The frame arrived whole, only this message is lost
+			logRejected("message", b, err)
+			n.Penalize(peer, PEER_PENALTY_MALFORMED, "undecodable message")
+			continue
+		}
+		if !n.Limits.Allow(node, m.Identifier, size) {
 			continue
 		}
 
-		m.Reply = make(chan Message)
-
-		go func(cb chan Message) {
-			for {
-				m, ok := <-cb
-
-				if !ok {
-					close(cb)
-					break
-				}
-
-				b, _ := m.MarshalBinary()
-				l := len(b)
-
-				i := 0
-				for i < l {
-
-					a, _ := node.TCPConn.Write(b[i:])
-					i += a
-				}
-			}
+		switch m.Identifier {
+		case MESSAGE_PING:
+			networkError(node.Send(Message{Identifier: MESSAGE_PONG, Data: m.Data}, QUEUE_BLOCK))
+			continue
+		case MESSAGE_PONG:
+			node.pong(m.Data)
+			continue
+		case MESSAGE_REJECT:
+			fmt.Printf("Node %s rejected us: %s\n", node.Address(), m.Data)
+			node.TCPConn.Close()
+			continue
+		}
 
-		}(m.Reply)
+		relay, err := n.Gossip.Receive(m, len(b), peer)
+		if err == ErrRepeatedMessage {
+			n.Penalize(peer, PEER_PENALTY_REPEATED_MESSAGE, "repeated "+MessageName(m.Identifier))
+		}
+		if err != nil {
+			continue
+		}
+		if relay != nil {
+			go n.send(*relay, peer)
+		}
+		m.Peer = peer
 
-		Core.Network.IncomingMessages <- *m
+		n.incoming[MessageLane(m.Identifier)] <- *m
 	}
 }
 
@@ -99,9 +295,20 @@ func SetupNetwork(address, port string) *Network {
 
 	n := new(Network)
 
-	n.BroadcastQueue, n.IncomingMessages = make(chan Message), make(chan Message)
+	n.BroadcastQueue = make(chan Message)
+	for l := range n.incoming {
+		n.incoming[l] = make(chan Message, LANE_INCOMING_SIZE)
+	}
 	n.ConnectionsQueue, n.ConnectionCallback = CreateConnectionsQueue()
 	n.Nodes = Nodes{}
+	n.Gossip = NewGossip(GOSSIP_FANOUT, GOSSIP_TTL)
+	n.Inventory = NewInventory(INV_KNOWN_SIZE)
+	n.TxBatch = NewTxBatcher(n.broadcastTransactions)
+	n.Scores, _ = NewPeerScores("")
+	n.Faults = NewFaults(address)
+	n.Limits = NewRateLimiter()
+	n.ChainID = DEFAULT_CHAIN_ID
+	n.MaxInbound, n.MaxOutbound = MAX_NODE_CONNECTIONS-MAX_OUTBOUND_CONNECTIONS, MAX_OUTBOUND_CONNECTIONS
 	n.Address = address //fmt.Sprintf("%s:%s", address, port)
 
 	return n
@@ -112,13 +319,39 @@ func (n *Network) Run() {
 	fmt.Println("Listening in", Core.Address)
 	listenCb := StartListening(Core.Address)
 
+	go func() {
+		for {
+			n.reconnect()
+			time.Sleep(time.Second * PEER_RECONNECT_INTERVAL)
+		}
+	}()
+	go func() {
+		for {
+			time.Sleep(time.Second * PEER_PING_INTERVAL)
+			n.heartbeat()
+		}
+	}()
+	go func() {
+		for {
+			time.Sleep(time.Millisecond * INV_INTERVAL)
+			n.announce()
+		}
+	}()
+
 	for {
 		select {
 		case node := <-listenCb:
 			Core.Nodes.AddNode(node)
 
 		case node := <-n.ConnectionCallback:
-			Core.Nodes.AddNode(node)
+			if Core.Nodes.AddNode(node) {
+				// Outbound connections are to listening addresses, worth dialing again
+				address := node.TCPConn.RemoteAddr().String()
+				n.Prefer(address)
+				if Core.DataDir != "" {
+					go func() { logOnError(RememberPeer(Core.DataDir, address)) }()
+				}
+			}
 
 		case message := <-n.BroadcastQueue:
 			go n.BroadcastMessage(message)
@@ -126,6 +359,45 @@ func (n *Network) Run() {
 	}
 }
 
+// Prefer adds peers to keep connections to
+func (n *Network) Prefer(addresses ...string) {
+
+	nodesLock.Lock()
+	defer nodesLock.Unlock()
+
+	for _, a := range addresses {
+		if !slices.Contains(n.preferred, dialAddress(a)) {
+			n.preferred = append(n.preferred, dialAddress(a))
+		}
+	}
+}
+
+// reconnect dials the preferred peers while outbound slots are free, the
+// connections queue skips the ones connected or banned
+func (n *Network) reconnect() {
+
+	nodesLock.RLock()
+	_, outbound := n.Nodes.slots()
+	preferred := slices.Clone(n.preferred)
+	nodesLock.RUnlock()
+
+	if outbound >= n.MaxOutbound {
+		return
+	}
+	for _, a := range preferred {
+		n.ConnectionsQueue <- a
+	}
+}
+
+// dialAddress gives seed nodes the default port, remembered peers carry theirs
+func dialAddress(address string) string {
+
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		return fmt.Sprintf("%s:%s", address, BLOCKCHAIN_PORT)
+	}
+	return address
+}
+
 func CreateConnectionsQueue() (ConnectionsQueue, NodeChannel) {
 
 	in := make(ConnectionsQueue)
@@ -134,11 +406,13 @@ func CreateConnectionsQueue() (ConnectionsQueue, NodeChannel) {
 	go func() {
 
 		for {
-			address := <-in
+			address := dialAddress(<-in)
 
-			address = fmt.Sprintf("%s:%s", address, BLOCKCHAIN_PORT)
+			nodesLock.RLock()
+			connected := Core.Nodes.connectedTo(address)
+			nodesLock.RUnlock()
 
-			if address != Core.Network.Address && Core.Nodes[address] == nil {
+			if address != Core.Network.Address && !connected && !Core.Network.Scores.Banned(address, "") && !Core.Network.Faults.Partitioned(address) {
 
 				go ConnectToNode(address, 5*time.Second, false, out)
 			}
@@ -161,9 +435,19 @@ func StartListening(address string) NodeChannel {
 
 		for {
 			connection, err := l.AcceptTCP()
-			networkError(err)
+			if err != nil {
+				networkError(err)
+				continue
+			}
 
-			cb <- &Node{connection, int(time.Now().Unix())}
+			go func() {
+				node, err := secureNode(connection, true)
+				if err != nil {
+					networkError(err)
+					return
+				}
+				cb <- node
+			}()
 		}
 
 	}(listener)
@@ -180,14 +464,19 @@ func ConnectToNode(dst string, timeout time.Duration, retry bool, cb NodeChannel
 loop:
 	for {
 
-		breakChannel := make(chan bool)
+		breakChannel := make(chan bool, 1)
 		go func() {
 
 			con, err = net.DialTCP("tcp", nil, addrDst)
 
 			if con != nil {
 
-				cb <- &Node{con, int(time.Now().Unix())}
+				node, err := secureNode(con, false)
+				if err != nil {
+					networkError(err)
+					return
+				}
+				cb <- node
 				breakChannel <- true
 			}
 		}()
@@ -204,19 +493,143 @@ loop:
 	}
 }
 
+// secureNode runs the handshake on a new connection, which is closed if it fails
+func secureNode(conn *net.TCPConn, inbound bool) (*Node, error) {
+
+	secured, peer, err := Handshake(conn, Core.Keypair, Core.Network.Address, Core.Network.Plaintext)
+	if err == nil && bytes.Equal(peer.Public, Core.Keypair.Public) {
+		err = errors.New("Connected to ourselves")
+	}
+	if err != nil {
+		if err == ErrHandshakeSignature {
+			Core.Network.Scores.Penalize(conn.RemoteAddr().String(), "", PEER_PENALTY_INVALID_SIGNATURE, "forged handshake")
+		}
+		conn.Close()
+		return nil, fmt.Errorf("Handshake with %s: %w", conn.RemoteAddr(), err)
+	}
+
+	r := bufio.NewReader(secured)
+	version, err := ExchangeVersions(secured, r, LocalVersion())
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("Version of %s: %w", conn.RemoteAddr(), err)
+	}
+
+	return &Node{TCPConn: conn, conn: secured, reader: r, ID: string(peer.Public), listen: peer.Listen, version: version, lastSeen: int(time.Now().Unix()), inbound: inbound}, nil
+}
+
 func (n *Network) BroadcastMessage(message Message) {
 
+	n.Gossip.Originate(&message)
+	n.send(message, "")
+}
+
+// send writes a gossiped message to the peers picked for it, from is the peer it came from
+func (n *Network) send(message Message, from string) {
+
 	b, _ := message.MarshalBinary()
 	print("BroadCast... :", len(b))
+
+	nodesLock.RLock()
+	defer nodesLock.RUnlock()
+
+	peers := make([]string, 0, len(n.Nodes))
 	for k, node := range n.Nodes {
+		if node.Supports(message.Identifier) {
+			peers = append(peers, k)
+		}
+	}
+	targets := n.Gossip.Targets(peers, from)
+
+	sent := 0
+	for _, k := range targets {
 		fmt.Println("Broadcasting...", k)
-		go func() {
-			_, err := node.TCPConn.Write(b)
-			if err != nil {
-				fmt.Println("Error bcing to", node.TCPConn.RemoteAddr())
-			}
-		}()
+		if err := n.Nodes[k].out.push(b, MessageLane(message.Identifier), QUEUE_DROP); err != nil {
+			fmt.Println("Not broadcasting to", k+":", err)
+			continue
+		}
+		sent++
 	}
+	n.Gossip.Sent(sent, len(b))
+}
+
+type PeerInfo struct {
+	ID       string `json:"id"` // public key
+	Address  string `json:"address"`
+	LastSeen int    `json:"lastSeen"`
+	Score    int    `json:"score"` // penalties, banned at PEER_BAN_SCORE
+	Inbound  bool   `json:"inbound"`
+
+	RTT      time.Duration `json:"rtt"` // of the last ping, 0 before the first pong
+	Protocol uint32        `json:"protocol"`
+	Queue    QueueStats    `json:"queue"` // of frames waiting to be written to it
+
+	Compression CompressionStats `json:"compression"`
+	RateLimited RateLimitCounts  `json:"rateLimited"` // messages from it over the limits
+}
+
+func (n *Network) Peers() []PeerInfo {
+
+	nodesLock.RLock()
+	defer nodesLock.RUnlock()
+
+	peers := make([]PeerInfo, 0, len(n.Nodes))
+	for _, node := range n.Nodes {
+		peers = append(peers, PeerInfo{ID: node.ID, Address: node.Address(), LastSeen: node.LastSeen(), Score: n.Scores.Score(node.Address(), node.ID), Inbound: node.inbound, RTT: node.RTT(), Protocol: node.protocol(), Queue: node.out.Stats(), Compression: node.CompressionStats(), RateLimited: node.RateLimitCounts()})
+	}
+
+	return peers
+}
+
+// Penalize scores a misbehaving peer by its address, as keys cost nothing to
+// make, and by its key, as loopback ports do, and disconnects the peers at
+// that address or with that key when that gets it banned
+func (n *Network) Penalize(peer string, penalty int, reason string) {
+
+	nodesLock.RLock()
+	node := n.Nodes[peer]
+	nodesLock.RUnlock()
+
+	if node == nil || !n.Scores.Penalize(node.Address(), node.ID, penalty, reason) {
+		return
+	}
+	address, id := node.Address(), node.ID
+
+	nodesLock.Lock()
+	defer nodesLock.Unlock()
+
+	for k, node := range n.Nodes {
+		if peerKey(node.Address()) == peerKey(address) || id != "" && node.ID == id {
+			node.TCPConn.Close()
+			delete(n.Nodes, k)
+		}
+	}
+}
+
+type NetworkStats struct {
+	Peers    int  `json:"peers"`
+	Inbound  int  `json:"inbound"`
+	Outbound int  `json:"outbound"`
+	Fanout   int  `json:"fanout"`
+	TTL      byte `json:"ttl"`
+
+	MeanRTT time.Duration `json:"meanRtt"`
+	GossipStats
+	Inventory InventoryStats  `json:"inventory"`
+	TxBatches TxBatchStats    `json:"txBatches"`
+	Compact   CompactStats    `json:"compact"`  // blocks relayed compact, filled in by getNetworkStats
+	Incoming  [LANE_COUNT]int `json:"incoming"` // messages waiting to be handled in each lane
+	Received  ReceivedStats   `json:"received"` // valid transactions from peers
+}
+
+func (n *Network) Stats() NetworkStats {
+
+	nodesLock.RLock()
+	peers := len(n.Nodes)
+	inbound, outbound := n.Nodes.slots()
+	nodesLock.RUnlock()
+
+	return NetworkStats{Peers: peers, Inbound: inbound, Outbound: outbound, Fanout: n.Gossip.Fanout, TTL: n.Gossip.TTL, MeanRTT: n.MeanRTT(), GossipStats: n.Gossip.Stats(), Inventory: n.Inventory.Stats(), TxBatches: n.TxBatch.Stats(), Incoming: n.IncomingDepth(), Received: receivedStats()}
 }
 
 func GetIpAddress() []string {
@@ -236,6 +649,29 @@ func GetIpAddress() []string {
 	return addrs
 }
 
+// logRejected keeps data a peer sent that doesn't decode, so it can be looked
+// at with cli inspect
+func logRejected(kind string, data []byte, err error) {
+
+	networkError(err)
+	if Core.DataDir == "" || atomic.AddInt32(&rejectedCount, 1) > MAX_REJECTED_FILES {
+		return
+	}
+
+	dir := path.Join(Core.DataDir, REJECTED_DIRECTORY)
+	file := path.Join(dir, fmt.Sprintf("%d-%s.bin", time.Now().UnixNano(), kind))
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		networkError(err)
+		return
+	}
+	if err := os.WriteFile(file, data, 0600); err != nil {
+		networkError(err)
+		return
+	}
+
+	log.Printf("Saved rejected %s, inspect with: cli inspect -type %s %s\n", kind, kind, file)
+}
+
 func networkError(err error) {
 
 	if err != nil && err != io.EOF {
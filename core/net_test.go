@@ -0,0 +1,123 @@
+package core
+
+import (
+	"bufio"
+	"net"
+	"testing"
+	"time"
+)
+
+// netTestPair connects a client to l, returning both ends
+func netTestPair(t *testing.T, l *net.TCPListener) (*net.TCPConn, *net.TCPConn) {
+
+	client, err := net.DialTCP("tcp4", nil, l.Addr().(*net.TCPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := l.AcceptTCP()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client, server
+}
+
+func netTestListener(t *testing.T) *net.TCPListener {
+
+	l, err := net.ListenTCP("tcp4", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	return l
+}
+
+func netTestWait(t *testing.T, what string, done func() bool) {
+
+	deadline := time.Now().Add(time.Second * 5)
+	for !done() {
+		if time.Now().After(deadline) {
+			t.Fatal("Timed out waiting for", what)
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+}
+
+func TestConnectionSlots(t *testing.T) {
+
+	Core.Network = SetupNetwork("127.0.0.1:0", BLOCKCHAIN_PORT)
+	Core.Network.MaxInbound, Core.Network.MaxOutbound = 1, 1
+	l := netTestListener(t)
+
+	c1, s1 := netTestPair(t, l)
+	defer c1.Close()
+	c2, s2 := netTestPair(t, l)
+	defer c2.Close()
+
+	if !Core.Nodes.AddNode(&Node{TCPConn: s1, inbound: true}) {
+		t.Fatal("Inbound node not added")
+	}
+	if Core.Nodes.AddNode(&Node{TCPConn: s2, inbound: true}) {
+		t.Error("Inbound node added past its slots")
+	}
+	if !Core.Nodes.AddNode(&Node{TCPConn: c2}) {
+		t.Error("Outbound node not added beside a full inbound side")
+	}
+
+	stats := Core.Network.Stats()
+	if stats.Inbound != 1 || stats.Outbound != 1 {
+		t.Errorf("Wrong slots %+v", stats)
+	}
+
+	// A peer going away frees its slot
+	c1.Close()
+	netTestWait(t, "node removal", func() bool { return Core.Network.Stats().Inbound == 0 })
+
+	c3, s3 := netTestPair(t, l)
+	defer c3.Close()
+	if !Core.Nodes.AddNode(&Node{TCPConn: s3, inbound: true}) {
+		t.Error("Freed slot not reused")
+	}
+}
+
+func TestReconnectPreferredPeers(t *testing.T) {
+
+	Core.Keypair = GenerateNewKeypair()
+	Core.Network = SetupNetwork("127.0.0.1:0", BLOCKCHAIN_PORT)
+	l := netTestListener(t)
+	Core.Network.Prefer(l.Addr().String(), l.Addr().String())
+	peer := GenerateNewKeypair()
+
+	connect := func() *net.TCPConn {
+		go Core.Network.reconnect()
+		server, err := l.AcceptTCP()
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn, _, err := Handshake(server, peer, l.Addr().String(), false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := ExchangeVersions(conn, bufio.NewReader(conn), LocalVersion()); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case node := <-Core.Network.ConnectionCallback:
+			if !Core.Nodes.AddNode(node) || node.inbound || node.ID != string(peer.Public) {
+				t.Fatal("Preferred peer not added as outbound")
+			}
+		case <-time.After(time.Second * 5):
+			t.Fatal("Preferred peer not dialed")
+		}
+		return server
+	}
+
+	server := connect()
+	if len(Core.Network.preferred) != 1 {
+		t.Error("Preferred peer added twice", Core.Network.preferred)
+	}
+
+	// The peer drops us and gets dialed again
+	server.Close()
+	netTestWait(t, "node removal", func() bool { return len(Core.Network.Peers()) == 0 })
+	connect().Close()
+}
@@ -0,0 +1,225 @@
+package core
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// Every peer has one queue of frames to send and one goroutine writing them,
+// so frames never interleave on the connection. Small frames waiting together
+// go out in one write. The queue holds frame payloads in a lane each, taken
+// by weight, the writer frames and compresses them. Broadcasts and replies
+// that find their lane full are dropped, so a peer that stops reading can't
+// hold up the message handler. Control messages wait for room until
+// PEER_QUEUE_TIMEOUT.
+
+const (
+	PEER_QUEUE_SIZE       = 10000            // frames waiting for a peer in each lane
+	PEER_QUEUE_BYTES      = 64 * 1024 * 1024 // bytes waiting for a peer in each lane
+	PEER_WRITE_BATCH_SIZE = 64 * 1024        // small frames written together up to this
+	PEER_QUEUE_TIMEOUT    = 5                // seconds a sender waits for room
+)
+
+type QueuePolicy byte
+
+const (
+	QUEUE_DROP  QueuePolicy = iota // frames that don't fit are dropped
+	QUEUE_BLOCK                    // senders wait for room
+)
+
+var (
+	ErrQueueFull   = errors.New("Peer queue full")
+	ErrQueueClosed = errors.New("Peer queue closed")
+)
+
+type outbound struct {
+	lock   sync.Mutex
+	ready  *sync.Cond // frames were queued or the queue closed
+	room   *sync.Cond // frames were taken or the queue closed
+	frames [LANE_COUNT][][]byte
+	bytes  [LANE_COUNT]int
+	lanes  laneScheduler
+	closed bool
+	stats  QueueStats
+}
+
+type QueueStats struct {
+	Depth   int                   `json:"depth"` // frames waiting
+	Bytes   int                   `json:"bytes"`
+	Dropped int                   `json:"dropped"`
+	Frames  int                   `json:"frames"` // written
+	Writes  int                   `json:"writes"` // frames written together count once
+	Lanes   [LANE_COUNT]LaneStats `json:"lanes"`
+}
+
+func newOutbound() *outbound {
+
+	q := &outbound{}
+	q.ready, q.room = sync.NewCond(&q.lock), sync.NewCond(&q.lock)
+	return q
+}
+
+// full tells if frame doesn't fit in its lane, one frame always does in an empty lane
+func (q *outbound) full(frame []byte, lane Lane) bool {
+
+	frames := q.frames[lane]
+	return len(frames) >= PEER_QUEUE_SIZE || len(frames) > 0 && q.bytes[lane]+len(frame) > PEER_QUEUE_BYTES
+}
+
+func (q *outbound) push(frame []byte, lane Lane, policy QueuePolicy) error {
+
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	if policy == QUEUE_BLOCK && !q.closed && q.full(frame, lane) {
+		deadline := time.Now().Add(time.Second * PEER_QUEUE_TIMEOUT)
+		timer := time.AfterFunc(time.Second*PEER_QUEUE_TIMEOUT, func() {
+			q.lock.Lock()
+			defer q.lock.Unlock()
+			q.room.Broadcast()
+		})
+		defer timer.Stop()
+
+		for !q.closed && q.full(frame, lane) && time.Now().Before(deadline) {
+			q.room.Wait()
+		}
+	}
+
+	switch {
+	case q.closed:
+		return ErrQueueClosed
+	case q.full(frame, lane):
+		q.stats.Dropped++
+		q.stats.Lanes[lane].Dropped++
+		return ErrQueueFull
+	}
+	q.frames[lane] = append(q.frames[lane], frame)
+	q.bytes[lane] += len(frame)
+	q.ready.Signal()
+
+	return nil
+}
+
+// waiting tells which lanes have frames
+func (q *outbound) waiting() (waiting [LANE_COUNT]bool) {
+
+	for l := range waiting {
+		waiting[l] = len(q.frames[l]) > 0
+	}
+	return waiting
+}
+
+// take waits for frames and returns as many as fit in a batch, at least
+// one, picking the lanes by weight, nil once the queue is closed
+func (q *outbound) take() [][]byte {
+
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	for q.waiting() == [LANE_COUNT]bool{} && !q.closed {
+		q.ready.Wait()
+	}
+	if q.closed {
+		return nil
+	}
+
+	var batch [][]byte
+	size := 0
+	for {
+		lane, ok := q.lanes.pick(q.waiting())
+		if !ok {
+			break
+		}
+		frame := q.frames[lane][0]
+		if len(batch) > 0 && size+len(frame) > PEER_WRITE_BATCH_SIZE {
+			// The lane keeps its turn for the next batch
+			q.lanes.credits[lane]++
+			break
+		}
+		batch = append(batch, frame)
+		size += len(frame)
+		q.frames[lane] = q.frames[lane][1:]
+		q.bytes[lane] -= len(frame)
+		q.stats.Lanes[lane].Frames++
+	}
+	q.stats.Frames += len(batch)
+	q.stats.Writes++
+	q.room.Broadcast()
+
+	return batch
+}
+
+// close drops the waiting frames and stops the writer
+func (q *outbound) close() {
+
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	q.closed = true
+	q.frames, q.bytes = [LANE_COUNT][][]byte{}, [LANE_COUNT]int{}
+	q.ready.Broadcast()
+	q.room.Broadcast()
+}
+
+func (q *outbound) Stats() QueueStats {
+
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	stats := q.stats
+	for l := range stats.Lanes {
+		stats.Lanes[l].Depth, stats.Lanes[l].Bytes = len(q.frames[l]), q.bytes[l]
+		stats.Depth += len(q.frames[l])
+		stats.Bytes += q.bytes[l]
+	}
+	return stats
+}
+
+// write sends the queued frames to the node until its queue is closed
+func (node *Node) write() {
+
+	for {
+		batch := node.out.take()
+		if batch == nil {
+			return
+		}
+
+		var b []byte
+		for _, payload := range batch {
+			b = AppendFrame(b, node.compressed(payload))
+		}
+		if _, err := node.conn.Write(b); err != nil {
+			networkError(err)
+			node.out.close()
+			node.TCPConn.Close()
+			return
+		}
+	}
+}
+
+// Send queues a message to the node in its lane
+func (node *Node) Send(m Message, policy QueuePolicy) error {
+
+	if node.out == nil {
+		return ErrQueueClosed
+	}
+	b, err := m.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	return node.out.push(b, MessageLane(m.Identifier), policy)
+}
+
+// Reply sends m to the peer a message came from, dropped when its queue is full
+func (n *Network) Reply(peer string, m Message) error {
+
+	nodesLock.RLock()
+	node := n.Nodes[peer]
+	nodesLock.RUnlock()
+
+	if node == nil {
+		return ErrQueueClosed
+	}
+	return node.Send(m, QUEUE_DROP)
+}
@@ -0,0 +1,133 @@
+package core
+
+import (
+	"bufio"
+	"bytes"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestOutboundKeepsFramesWhole(t *testing.T) {
+
+	l := netTestListener(t)
+	client, server := netTestPair(t, l)
+	defer client.Close()
+	defer server.Close()
+
+	node := &Node{TCPConn: client, conn: client, out: newOutbound()}
+	go node.write()
+
+	// Senders at once, with frames small and over the batch size
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				size := 100
+				if j%10 == 0 {
+					size = PEER_WRITE_BATCH_SIZE * 2
+				}
+				node.Send(Message{Identifier: byte(i), Data: bytes.Repeat([]byte{byte(i)}, size)}, QUEUE_BLOCK)
+			}
+		}()
+	}
+
+	r := bufio.NewReader(server)
+	server.SetReadDeadline(time.Now().Add(time.Second * 10))
+	for n := 0; n < 500; n++ {
+		m, err := ReadMessage(r)
+		if err != nil {
+			t.Fatal("Frame", n, err)
+		}
+		if !bytes.Equal(m.Data, bytes.Repeat([]byte{m.Identifier}, len(m.Data))) {
+			t.Fatal("Frames interleaved")
+		}
+	}
+	wg.Wait()
+
+	if s := node.out.Stats(); s.Frames != 500 || s.Writes >= s.Frames || s.Depth != 0 || s.Dropped != 0 {
+		t.Error("Small frames not written together", s)
+	}
+	node.out.close()
+}
+
+func TestOutboundPolicies(t *testing.T) {
+
+	q := newOutbound()
+	for i := 0; i < PEER_QUEUE_SIZE; i++ {
+		q.push([]byte{1}, LANE_TX, QUEUE_DROP)
+	}
+	if err := q.push([]byte{1}, LANE_TX, QUEUE_DROP); err != ErrQueueFull || q.Stats().Dropped != 1 {
+		t.Error("Broadcast past a full queue not dropped", err)
+	}
+
+	// Control messages wait until the writer takes frames
+	done := make(chan error)
+	go func() { done <- q.push([]byte{2}, LANE_TX, QUEUE_BLOCK) }()
+	select {
+	case err := <-done:
+		t.Fatal("Control message didn't wait for room", err)
+	case <-time.After(time.Millisecond * 100):
+	}
+	if batch := q.take(); len(batch) != PEER_QUEUE_SIZE {
+		t.Error("Small frames not taken together", len(batch))
+	}
+	if err := <-done; err != nil {
+		t.Error("Control message not queued", err)
+	}
+
+	// Or until the peer goes away
+	for q.Stats().Depth < PEER_QUEUE_SIZE {
+		q.push([]byte{1}, LANE_TX, QUEUE_DROP)
+	}
+	go func() { done <- q.push([]byte{2}, LANE_TX, QUEUE_BLOCK) }()
+	time.Sleep(time.Millisecond * 50)
+	q.close()
+	if err := <-done; err != ErrQueueClosed {
+		t.Error("Waiting sender not released", err)
+	}
+	if batch := q.take(); batch != nil {
+		t.Error("Closed queue still written", batch)
+	}
+}
+
+func TestOutboundByteLimit(t *testing.T) {
+
+	q := newOutbound()
+	big := make([]byte, PEER_QUEUE_BYTES)
+	if err := q.push(big, LANE_TX, QUEUE_DROP); err != nil {
+		t.Error("Frame over the limit refused by an empty queue", err)
+	}
+	if err := q.push([]byte{1}, LANE_TX, QUEUE_DROP); err != ErrQueueFull {
+		t.Error("Bytes past the limit queued", err)
+	}
+	if s := q.Stats(); s.Depth != 1 || s.Bytes != PEER_QUEUE_BYTES {
+		t.Error("Wrong depth", s)
+	}
+}
+
+func TestReplyToStalledPeer(t *testing.T) {
+
+	Core.Network = SetupNetwork("127.0.0.1:0", BLOCKCHAIN_PORT)
+	node := &Node{ID: "stalled", out: newOutbound()}
+	Core.Nodes[node.ID] = node
+	for i := 0; i < PEER_QUEUE_SIZE; i++ {
+		node.out.push([]byte{1}, LANE_BLOCK, QUEUE_DROP)
+		node.out.push([]byte{1}, LANE_TX, QUEUE_DROP)
+	}
+
+	// The handler goes on to the other peers
+	start := time.Now()
+	if err := Core.Network.Reply(node.ID, Message{Identifier: MESSAGE_SEND_BLOCK}); err != ErrQueueFull {
+		t.Error("Reply to a full queue not dropped", err)
+	}
+	Core.Network.ReplyTransactions(node.ID, TransactionSlice{*codecTestTransaction()})
+	if dropped := node.out.Stats().Dropped; dropped != 2 {
+		t.Error("Wrong drops", dropped)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Error("Replies waited for the peer", elapsed)
+	}
+}
@@ -0,0 +1,842 @@
+package core
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// PBFT agrees on every block with the validator set in three phases. The
+// leader of a height and view sends a pre-prepare with the block, validators
+// that accept it broadcast a prepare, and once a quorum of prepares agree
+// they broadcast a commit. A quorum of commits makes the commit certificate
+// and the block final. Replicas that wait on a leader for too long vote to
+// change the view, the next leader proves a quorum of view changes in a new
+// view and re-proposes the highest prepared block, so nothing a replica may
+// have committed is lost. A quorum is n-f of the n validators, any two of
+// them share an honest one whatever n is.
+type PBFT struct {
+	Chain       *Blockchain
+	Validators  [][]byte // public keys
+	Keypair     *Keypair
+	Transport   Transport
+	ViewTimeout time.Duration
+
+	lock         sync.Mutex
+	sendLock     sync.Mutex // keeps the order of the messages sent after unlocking
+	unsent       []Message  // broadcast under lock, sent by unlock
+	index        int        // ours in Validators, -1 when only following
+	height       int        // being agreed on, the chain head is the one before
+	view         uint64
+	round        *pbftRound
+	pending      []Message // for a later view or height
+	waiters      map[int]chan struct{}
+	certificates map[int][]PBFTVote
+	timer        *time.Timer
+	stats        PBFTStats
+
+	inbox    chan Message
+	outbox   chan Message
+	timeouts chan pbftTimeout
+}
+
+type PBFTStats struct {
+	Committed     int           `json:"committed"`
+	ViewChanges   int           `json:"viewChanges"`
+	CommitLatency time.Duration `json:"commitLatency"` // total, from the first pre-prepare seen to commit
+}
+
+// Transport carries consensus messages to the other validators
+type Transport interface {
+	Broadcast(m Message)
+}
+
+// ConsensusHandler is implemented by engines exchanging their own messages
+type ConsensusHandler interface {
+	HandleMessage(m Message)
+}
+
+var ErrAwaitingQuorum = errors.New("Block has no commit certificate yet")
+
+// State of the height being agreed on
+type pbftRound struct {
+	started time.Time
+	own     *Block // assembled by us, its transactions go back to the mempool if it loses
+
+	blocks   map[string]*Block // by digest
+	accepted map[uint64]string // view -> digest of the accepted pre-prepare
+	prepares map[pbftKey]map[uint32]PBFTVote
+	commits  map[pbftKey]map[uint32]PBFTVote
+	prepared *PBFTMessage // highest prepared block with its prepares
+
+	committing     map[uint64]bool
+	viewChanges    map[uint64]map[uint32]PBFTMessage
+	sentViewChange map[uint64]bool
+	sentNewView    map[uint64]bool
+}
+
+type pbftKey struct {
+	view   uint64
+	digest string
+}
+
+type pbftTimeout struct {
+	height int
+	view   uint64
+}
+
+func NewPBFT(bl *Blockchain, validators [][]byte, keypair *Keypair, transport Transport) (*PBFT, error) {
+
+	if len(validators) == 0 {
+		return nil, errors.New("PBFT needs at least one validator")
+	}
+
+	c := &PBFT{
+		Chain:        bl,
+		Validators:   validators,
+		Keypair:      keypair,
+		Transport:    transport,
+		ViewTimeout:  time.Second * PBFT_VIEW_TIMEOUT,
+		index:        -1,
+		waiters:      map[int]chan struct{}{},
+		certificates: map[int][]PBFTVote{},
+		inbox:        make(chan Message, PBFT_QUEUE_SIZE),
+		outbox:       make(chan Message, PBFT_QUEUE_SIZE),
+		timeouts:     make(chan pbftTimeout, 1),
+	}
+	for i, v := range validators {
+		if keypair != nil && bytes.Equal(v, keypair.Public) {
+			c.index = i
+		}
+	}
+	c.round = newPBFTRound()
+
+	go c.run()
+	go func() {
+		for m := range c.outbox {
+			c.Transport.Broadcast(m)
+		}
+	}()
+
+	return c, nil
+}
+
+func newPBFTRound() *pbftRound {
+
+	return &pbftRound{
+		blocks:         map[string]*Block{},
+		accepted:       map[uint64]string{},
+		prepares:       map[pbftKey]map[uint32]PBFTVote{},
+		commits:        map[pbftKey]map[uint32]PBFTVote{},
+		committing:     map[uint64]bool{},
+		viewChanges:    map[uint64]map[uint32]PBFTMessage{},
+		sentViewChange: map[uint64]bool{},
+		sentNewView:    map[uint64]bool{},
+	}
+}
+
+func (c *PBFT) Name() string { return CONSENSUS_PBFT }
+
+// Propose starts agreement on a block when we lead the current view. Other
+// validators only start waiting on the leader when they have transactions.
+func (c *PBFT) Propose(height int, assemble func() Block) (*Block, error) {
+
+	c.lock.Lock()
+	defer c.unlock()
+
+	c.sync()
+	r := c.round
+	if _, started := r.accepted[c.view]; height != c.height || c.index < 0 || c.leader(c.view) != c.index || started {
+		if c.Chain.Mempool.Len() > 0 {
+			c.armTimer(false)
+		}
+		return nil, ErrNotProposer
+	}
+
+	b := assemble()
+	if err := c.seal(&b); err != nil {
+		return nil, err
+	}
+	r.own = &b
+
+	m := &PBFTMessage{Vote: PBFTVote{Phase: MESSAGE_PBFT_PRE_PREPARE, View: c.view, Digest: b.Hash()}, Block: &b}
+	if err := c.broadcast(m); err != nil {
+		return nil, err
+	}
+	c.accept(&b, c.view)
+
+	return &b, nil
+}
+
+// Validate passes our own pending proposal, other blocks become final
+// through commit certificates and not by being handed to the chain
+func (c *PBFT) Validate(b *Block, height int) error {
+
+	c.lock.Lock()
+	defer c.unlock()
+
+	if own := c.round.own; height == c.height && own != nil && bytes.Equal(own.Hash(), b.Hash()) {
+		return nil
+	}
+	return ErrAwaitingQuorum
+}
+
+// Finalize leaves our proposal to its commit certificate
+func (c *PBFT) Finalize(b *Block, height int) error {
+
+	return nil
+}
+
+// WaitFinal waits for the commit certificate of our proposal
+func (c *PBFT) WaitFinal(b *Block, height int) error {
+
+	c.lock.Lock()
+	c.sync()
+	done, ok := c.waiters[height]
+	if !ok && height >= c.height {
+		done = make(chan struct{})
+		c.waiters[height] = done
+	}
+	c.unlock()
+
+	if done != nil {
+		select {
+		case <-done:
+		case <-time.After(c.ViewTimeout * 8):
+			return ErrAwaitingQuorum
+		}
+	}
+
+	if final := c.Chain.BlockByHeight(height); final == nil || !bytes.Equal(final.Hash(), b.Hash()) {
+		return fmt.Errorf("Another block was committed at height %d", height)
+	}
+	return nil
+}
+
+func (c *PBFT) HandleMessage(m Message) {
+
+	c.inbox <- m
+}
+
+// Certificate returns the commit certificate of a recent height
+func (c *PBFT) Certificate(height int) []PBFTVote {
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return c.certificates[height]
+}
+
+func (c *PBFT) Stats() PBFTStats {
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return c.stats
+}
+
+func (c *PBFT) run() {
+
+	for {
+		select {
+		case m := <-c.inbox:
+			c.lock.Lock()
+			c.handle(m)
+			c.unlock()
+
+		case t := <-c.timeouts:
+			c.lock.Lock()
+			if c.sync(); t.height == c.height && t.view == c.view {
+				c.startViewChange(c.view + 1)
+			}
+			c.unlock()
+		}
+	}
+}
+
+func (c *PBFT) handle(m Message) {
+
+	c.sync()
+
+	pm := new(PBFTMessage)
+	if err := pm.UnmarshalBinary(m.Data); err != nil {
+		logRejected("pbft", m.Data, err)
+		return
+	}
+
+	v := &pm.Vote
+	if v.Phase != m.Identifier || !c.verifyVote(v) {
+		return
+	}
+
+	height := int(v.Height)
+	if height < c.height {
+		return
+	}
+	changesView := v.Phase == MESSAGE_PBFT_VIEW_CHANGE || v.Phase == MESSAGE_PBFT_NEW_VIEW
+	if height > c.height || (v.View > c.view && !changesView) {
+		if height <= c.height+1 && len(c.pending) < PBFT_MAX_PENDING {
+			c.pending = append(c.pending, m)
+		}
+		return
+	}
+
+	switch v.Phase {
+	case MESSAGE_PBFT_PRE_PREPARE:
+		c.onPrePrepare(pm)
+	case MESSAGE_PBFT_PREPARE:
+		c.record(v)
+		c.checkPrepared(v.View)
+	case MESSAGE_PBFT_COMMIT:
+		c.record(v)
+		c.checkCommitted()
+	case MESSAGE_PBFT_VIEW_CHANGE:
+		c.onViewChange(pm)
+	case MESSAGE_PBFT_NEW_VIEW:
+		c.onNewView(pm)
+	}
+}
+
+func (c *PBFT) onPrePrepare(pm *PBFTMessage) {
+
+	v := &pm.Vote
+	if v.View != c.view || int(v.Validator) != c.leader(v.View) {
+		return
+	}
+	if _, ok := c.round.accepted[v.View]; ok || pm.Block == nil || !bytes.Equal(pm.Block.Hash(), v.Digest) {
+		return
+	}
+	if err := c.checkProposal(pm.Block); err != nil {
+		fmt.Printf("Rejected pre-prepare for block %d: %v\n", c.height, err)
+		return
+	}
+
+	c.accept(pm.Block, v.View)
+}
+
+// accept takes the block as the proposal of view and prepares it
+func (c *PBFT) accept(b *Block, view uint64) {
+
+	r := c.round
+	digest := string(b.Hash())
+	r.blocks[digest] = b
+	r.accepted[view] = digest
+	if r.started.IsZero() {
+		r.started = time.Now()
+	}
+
+	c.armTimer(false)
+	c.vote(MESSAGE_PBFT_PREPARE, view, b.Hash())
+	c.checkPrepared(view)
+	c.checkCommitted()
+}
+
+func (c *PBFT) checkPrepared(view uint64) {
+
+	r := c.round
+	digest, ok := r.accepted[view]
+	if !ok || r.committing[view] || view != c.view {
+		return
+	}
+	votes := r.prepares[pbftKey{view, digest}]
+	if len(votes) < c.quorum() {
+		return
+	}
+
+	r.committing[view] = true
+	r.prepared = &PBFTMessage{
+		Vote:        PBFTVote{View: view, Digest: []byte(digest)},
+		Block:       r.blocks[digest],
+		Certificate: voteList(votes),
+	}
+	c.vote(MESSAGE_PBFT_COMMIT, view, []byte(digest))
+	c.checkCommitted()
+}
+
+func (c *PBFT) checkCommitted() {
+
+	for k, votes := range c.round.commits {
+		if b := c.round.blocks[k.digest]; b != nil && len(votes) >= c.quorum() {
+			c.commit(b, voteList(votes))
+			return
+		}
+	}
+}
+
+func (c *PBFT) commit(b *Block, certificate []PBFTVote) {
+
+	r := c.round
+	c.Chain.CommitBlock(b)
+
+	// A block of ours that lost gives its transactions back
+	if r.own != nil && !bytes.Equal(r.own.Hash(), b.Hash()) {
+		for i := range *r.own.TransactionSlice {
+			if t := &(*r.own.TransactionSlice)[i]; !c.Chain.inChain(t) {
+				c.Chain.Mempool.Add(t)
+			}
+		}
+	}
+
+	c.certificates[c.height] = certificate
+	delete(c.certificates, c.height-PBFT_CERTIFICATES)
+	c.stats.Committed++
+	c.stats.CommitLatency += time.Since(r.started)
+
+	if done, ok := c.waiters[c.height]; ok {
+		close(done)
+		delete(c.waiters, c.height)
+	}
+
+	c.next(c.height + 1)
+}
+
+// next moves on to height, starting over at view 0
+func (c *PBFT) next(height int) {
+
+	c.height, c.view, c.round = height, 0, newPBFTRound()
+	c.stopTimer()
+
+	// Waiters on skipped heights find out from the chain
+	for h, done := range c.waiters {
+		if h < height {
+			close(done)
+			delete(c.waiters, h)
+		}
+	}
+
+	c.retry()
+}
+
+// sync catches up when the chain moved on without us, blocks loaded from the store
+func (c *PBFT) sync() {
+
+	if _, head := c.Chain.Head(); head+1 > c.height {
+		c.next(head + 1)
+	}
+}
+
+// retry handles the messages kept for later again
+func (c *PBFT) retry() {
+
+	pending := c.pending
+	c.pending = nil
+	for _, m := range pending {
+		c.handle(m)
+	}
+}
+
+func (c *PBFT) startViewChange(view uint64) {
+
+	r := c.round
+	if view <= c.view && r.sentViewChange[view] {
+		return
+	}
+	if view > c.view {
+		c.view = view
+		c.stats.ViewChanges++
+	}
+	r.sentViewChange[view] = true
+
+	m := &PBFTMessage{Vote: PBFTVote{Phase: MESSAGE_PBFT_VIEW_CHANGE, View: view}}
+	if r.prepared != nil {
+		m.Vote.Digest = r.prepared.Vote.Digest
+		m.Block = r.prepared.Block
+		m.Certificate = r.prepared.Certificate
+	}
+	if c.index >= 0 && c.broadcast(m) == nil {
+		c.recordViewChange(m)
+	}
+
+	c.armTimer(true)
+	c.checkNewView(view)
+	c.retry()
+}
+
+func (c *PBFT) onViewChange(pm *PBFTMessage) {
+
+	view := pm.Vote.View
+	if view < c.view || c.checkViewChange(pm) != nil {
+		return
+	}
+	c.recordViewChange(pm)
+
+	// f+1 replicas gave up on the leader, at least one of them is honest
+	if view > c.view && len(c.round.viewChanges[view]) > c.faulty() {
+		c.startViewChange(view)
+	}
+	c.checkNewView(view)
+}
+
+func (c *PBFT) recordViewChange(pm *PBFTMessage) {
+
+	r := c.round
+	if r.viewChanges[pm.Vote.View] == nil {
+		r.viewChanges[pm.Vote.View] = map[uint32]PBFTMessage{}
+	}
+	r.viewChanges[pm.Vote.View][pm.Vote.Validator] = *pm
+}
+
+// checkNewView sends the new view once we lead it and a quorum asked for it
+func (c *PBFT) checkNewView(view uint64) {
+
+	r := c.round
+	if view != c.view || c.index < 0 || c.leader(view) != c.index || r.sentNewView[view] || len(r.viewChanges[view]) < c.quorum() {
+		return
+	}
+
+	proofs := []PBFTMessage{}
+	for _, vc := range r.viewChanges[view] {
+		if len(proofs) < c.quorum() {
+			vc.Block = nil
+			proofs = append(proofs, vc)
+		}
+	}
+
+	// The highest prepared block may have been committed somewhere, propose it again
+	var b *Block
+	if digest := highestPrepared(proofs); digest != nil {
+		for _, vc := range r.viewChanges[view] {
+			if vc.Block != nil && bytes.Equal(vc.Vote.Digest, digest) {
+				b = vc.Block
+			}
+		}
+	} else {
+		assembled := c.Chain.AssembleBlock()
+		assembled.BlockHeader.Timestamp = uint32(time.Now().Unix())
+		if err := c.seal(&assembled); err != nil {
+			logOnError(err)
+			return
+		}
+		b, r.own = &assembled, &assembled
+	}
+	if b == nil {
+		return
+	}
+
+	r.sentNewView[view] = true
+	m := &PBFTMessage{Vote: PBFTVote{Phase: MESSAGE_PBFT_NEW_VIEW, View: view, Digest: b.Hash()}, Block: b, ViewChanges: proofs}
+	if c.broadcast(m) == nil {
+		c.accept(b, view)
+	}
+}
+
+func (c *PBFT) onNewView(pm *PBFTMessage) {
+
+	v := &pm.Vote
+	if v.View < c.view || int(v.Validator) != c.leader(v.View) || pm.Block == nil || !bytes.Equal(pm.Block.Hash(), v.Digest) {
+		return
+	}
+	if _, ok := c.round.accepted[v.View]; ok {
+		return
+	}
+
+	seen := map[uint32]bool{}
+	for i := range pm.ViewChanges {
+		vc := &pm.ViewChanges[i]
+		if vc.Vote.Phase != MESSAGE_PBFT_VIEW_CHANGE || vc.Vote.View != v.View || int(vc.Vote.Height) != c.height {
+			return
+		}
+		if !c.verifyVote(&vc.Vote) || c.checkPreparedCertificate(vc) != nil {
+			return
+		}
+		seen[vc.Vote.Validator] = true
+	}
+	if len(seen) < c.quorum() {
+		return
+	}
+
+	if digest := highestPrepared(pm.ViewChanges); digest != nil && !bytes.Equal(digest, v.Digest) {
+		fmt.Printf("New view %d for block %d drops a prepared block\n", v.View, c.height)
+		return
+	}
+	if err := c.checkProposal(pm.Block); err != nil {
+		fmt.Printf("Rejected new view for block %d: %v\n", c.height, err)
+		return
+	}
+
+	if v.View > c.view {
+		c.view = v.View
+		c.stats.ViewChanges++
+	}
+	c.accept(pm.Block, v.View)
+	c.retry()
+}
+
+// checkViewChange verifies the prepared block a view change carries, if any
+func (c *PBFT) checkViewChange(pm *PBFTMessage) error {
+
+	if isZeroHash(pm.Vote.Digest) {
+		return nil
+	}
+	if pm.Block == nil || !bytes.Equal(pm.Block.Hash(), pm.Vote.Digest) {
+		return errors.New("View change without its prepared block")
+	}
+	return c.checkPreparedCertificate(pm)
+}
+
+// checkPreparedCertificate verifies a quorum of prepares for the digest of a view change
+func (c *PBFT) checkPreparedCertificate(pm *PBFTMessage) error {
+
+	if isZeroHash(pm.Vote.Digest) {
+		return nil
+	}
+
+	seen := map[uint32]bool{}
+	for i := range pm.Certificate {
+		p := &pm.Certificate[i]
+		if p.Phase != MESSAGE_PBFT_PREPARE || p.Height != pm.Vote.Height || p.View != pm.Certificate[0].View || p.View >= pm.Vote.View {
+			return errors.New("Prepare from another round in certificate")
+		}
+		if !bytes.Equal(p.Digest, pm.Vote.Digest) || !c.verifyVote(p) {
+			return errors.New("Invalid prepare in certificate")
+		}
+		seen[p.Validator] = true
+	}
+	if len(seen) < c.quorum() {
+		return errors.New("Prepare certificate without quorum")
+	}
+	return nil
+}
+
+// checkProposal verifies a block before preparing it
+func (c *PBFT) checkProposal(b *Block) error {
+
+	head, _ := c.Chain.Head()
+	if !extendsBlock(b, head) {
+		return ErrUnknownParent
+	}
+	if !bytes.Equal(b.GenerateMerkelRoot(), b.MerkelRoot) {
+		return errors.New("Merkle root doesn't match the transactions")
+	}
+	if c.validatorIndex(b.Origin) < 0 || !VerifySignature(b.BlockHeader.Scheme, b.Origin, b.Signature, b.Hash()) {
+		return errors.New("Block not signed by a validator")
+	}
+	for i := range *b.TransactionSlice {
+		t := &(*b.TransactionSlice)[i]
+		if !t.VerifyTransaction(TRANSACTION_POW) {
+			return fmt.Errorf("Transaction %x: %w", t.Hash(), ErrInvalidTransaction)
+		}
+		if c.Chain.inChain(t) {
+			return fmt.Errorf("Transaction %x: %w", t.Hash(), ErrTxInChain)
+		}
+	}
+	return nil
+}
+
+// highestPrepared is the digest prepared in the latest view among view changes, nil if none
+func highestPrepared(viewChanges []PBFTMessage) []byte {
+
+	var digest []byte
+	var view uint64
+	for i := range viewChanges {
+		vc := &viewChanges[i]
+		if isZeroHash(vc.Vote.Digest) || len(vc.Certificate) == 0 {
+			continue
+		}
+		if digest == nil || vc.Certificate[0].View > view {
+			digest, view = vc.Vote.Digest, vc.Certificate[0].View
+		}
+	}
+	return digest
+}
+
+func (c *PBFT) vote(phase byte, view uint64, digest []byte) {
+
+	if c.index < 0 {
+		return
+	}
+
+	m := &PBFTMessage{Vote: PBFTVote{Phase: phase, View: view, Digest: digest}}
+	if c.broadcast(m) == nil {
+		c.record(&m.Vote)
+	}
+}
+
+// broadcast signs the vote of m as ours and queues it for the other validators,
+// sent once the lock is released
+func (c *PBFT) broadcast(m *PBFTMessage) error {
+
+	m.Vote.Height = uint64(c.height)
+	m.Vote.Validator = uint32(c.index)
+	if err := m.Vote.Sign(c.Keypair); err != nil {
+		return err
+	}
+
+	data, err := m.MarshalBinary()
+	if err != nil {
+		return err
+	}
+
+	c.unsent = append(c.unsent, Message{Identifier: m.Vote.Phase, Data: data})
+	return nil
+}
+
+// unlock releases the lock before queueing the messages broadcast under it,
+// so a slow outbox doesn't hold up the handlers
+func (c *PBFT) unlock() {
+
+	unsent := c.unsent
+	c.unsent = nil
+	if len(unsent) == 0 {
+		c.lock.Unlock()
+		return
+	}
+
+	c.sendLock.Lock()
+	defer c.sendLock.Unlock()
+	c.lock.Unlock()
+
+	for _, m := range unsent {
+		c.outbox <- m
+	}
+}
+
+func (c *PBFT) record(v *PBFTVote) {
+
+	votes := c.round.prepares
+	if v.Phase == MESSAGE_PBFT_COMMIT {
+		votes = c.round.commits
+	}
+
+	k := pbftKey{v.View, string(v.Digest)}
+	if votes[k] == nil {
+		votes[k] = map[uint32]PBFTVote{}
+	}
+	votes[k][v.Validator] = *v
+
+	// Votes are the first sign of a round for validators that missed the pre-prepare
+	c.armTimer(false)
+}
+
+func (c *PBFT) verifyVote(v *PBFTVote) bool {
+
+	if int(v.Validator) >= len(c.Validators) {
+		return false
+	}
+	return VerifySignature(v.Scheme, c.Validators[v.Validator], v.Signature, v.SignedHash())
+}
+
+// seal makes a block ours
+func (c *PBFT) seal(b *Block) error {
+
+	b.BlockHeader.Origin = c.Keypair.Public
+	b.BlockHeader.Scheme = c.Keypair.Scheme()
+
+	sig, err := c.Keypair.Sign(b.Hash())
+	if err != nil {
+		return err
+	}
+	b.Signature = sig
+
+	return nil
+}
+
+// armTimer gives the current view ViewTimeout, doubled on every view change.
+// Unless restart is set, a running timer is left alone.
+func (c *PBFT) armTimer(restart bool) {
+
+	if c.timer != nil {
+		if !restart {
+			return
+		}
+		c.timer.Stop()
+	}
+
+	shift := c.view
+	if shift > 6 {
+		shift = 6
+	}
+
+	t := pbftTimeout{c.height, c.view}
+	c.timer = time.AfterFunc(c.ViewTimeout<<shift, func() { c.timeouts <- t })
+}
+
+func (c *PBFT) stopTimer() {
+
+	if c.timer != nil {
+		c.timer.Stop()
+		c.timer = nil
+	}
+}
+
+// leader of a view at the current height, rotating with the height so the
+// work of proposing is spread over the validators
+func (c *PBFT) leader(view uint64) int {
+
+	return int((uint64(c.height) + view) % uint64(len(c.Validators)))
+}
+
+// faulty is f, the most faulty validators tolerated
+func (c *PBFT) faulty() int {
+
+	return (len(c.Validators) - 1) / 3
+}
+
+// quorum is n-f, 2f+1 when n is 3f+1. With other counts 2f+1 is too few
+// for two quorums to overlap in an honest validator.
+func (c *PBFT) quorum() int {
+
+	return len(c.Validators) - c.faulty()
+}
+
+func (c *PBFT) validatorIndex(key []byte) int {
+
+	for i, v := range c.Validators {
+		if bytes.Equal(v, key) {
+			return i
+		}
+	}
+	return -1
+}
+
+// voteList orders votes by validator
+func voteList(votes map[uint32]PBFTVote) []PBFTVote {
+
+	l := make([]PBFTVote, 0, len(votes))
+	for _, v := range votes {
+		l = append(l, v)
+	}
+	sort.Slice(l, func(i, j int) bool { return l[i].Validator < l[j].Validator })
+
+	return l
+}
+
+func isZeroHash(h []byte) bool {
+
+	return len(bytes.Trim(h, "\x00")) == 0
+}
+
+// NetworkTransport sends consensus messages to every connected node
+type NetworkTransport struct{}
+
+func (NetworkTransport) Broadcast(m Message) {
+
+	Core.Network.BroadcastQueue <- m
+}
+
+// MemoryNetwork connects engines in one process, for tests and benchmarks
+type MemoryNetwork struct {
+	Handlers []ConsensusHandler
+}
+
+func (n *MemoryNetwork) Transport(self int) Transport {
+
+	return memoryTransport{n, self}
+}
+
+type memoryTransport struct {
+	network *MemoryNetwork
+	self    int
+}
+
+func (t memoryTransport) Broadcast(m Message) {
+
+	for i, h := range t.network.Handlers {
+		if i != t.self {
+			h.HandleMessage(m)
+		}
+	}
+}
@@ -0,0 +1,164 @@
+package core
+
+import (
+	"github.com/izqui/helpers"
+)
+
+// PBFTVote is a validator's signed statement about the block with Digest at
+// Height in View. Phase is the message it was sent in.
+type PBFTVote struct {
+	Phase     byte
+	View      uint64
+	Height    uint64
+	Digest    []byte // zero in view changes without a prepared block
+	Validator uint32 // index in the validator set
+	Scheme    byte
+	Signature []byte
+}
+
+// PBFTMessage carries a vote and whatever backs it up
+type PBFTMessage struct {
+	Vote PBFTVote
+
+	Block       *Block        // pre-prepare, new view and view changes with a prepared block
+	Certificate []PBFTVote    // view change: the prepares of its prepared block
+	ViewChanges []PBFTMessage // new view: the view changes electing the leader
+}
+
+// SignedHash is what the validator signs
+func (v *PBFTVote) SignedHash() []byte {
+
+	e := NewEncoder()
+	e.Byte(v.Phase)
+	e.Uint64(v.View)
+	e.Uint64(v.Height)
+	e.Fixed("vote digest", v.Digest, HASH_SIZE)
+	e.Uint32(v.Validator)
+	e.Byte(v.Scheme)
+
+	b, _ := e.Result()
+	return helpers.SHA256(b)
+}
+
+func (v *PBFTVote) Sign(signer Signer) error {
+
+	v.Scheme = signer.Scheme()
+	sig, err := signer.Sign(v.SignedHash())
+	if err != nil {
+		return err
+	}
+	v.Signature = sig
+
+	return nil
+}
+
+func (v *PBFTVote) encode(e *Encoder) {
+
+	e.Byte(v.Phase)
+	e.Uint64(v.View)
+	e.Uint64(v.Height)
+	e.Fixed("vote digest", v.Digest, HASH_SIZE)
+	e.Uint32(v.Validator)
+	e.Byte(v.Scheme)
+	e.Bytes(v.Signature)
+}
+
+func (v *PBFTVote) decode(d *Decoder) {
+
+	v.Phase = d.Byte("vote phase")
+	v.View = d.Uint64("vote view")
+	v.Height = d.Uint64("vote height")
+	v.Digest = d.Fixed("vote digest", HASH_SIZE)
+	v.Validator = d.Uint32("vote validator")
+	v.Scheme = d.Byte("vote scheme")
+	v.Signature = d.Bytes("vote signature", NETWORK_KEY_SIZE)
+}
+
+func (m *PBFTMessage) MarshalBinary() ([]byte, error) {
+
+	e := NewEncoder()
+	e.Byte(CODEC_VERSION)
+	m.encode(e)
+
+	return e.Result()
+}
+
+func (m *PBFTMessage) UnmarshalBinary(d []byte) error {
+
+	dec := NewDecoder(d)
+	dec.Version("pbft message version")
+	m.decode(dec, true)
+
+	return dec.Finish("pbft message")
+}
+
+func (m *PBFTMessage) encode(e *Encoder) {
+
+	m.Vote.encode(e)
+
+	if m.Block == nil {
+		e.Byte(0)
+	} else {
+		b, err := m.Block.MarshalBinary()
+		if err != nil && e.err == nil {
+			e.err = err
+		}
+		e.Byte(1)
+		e.Bytes(b)
+	}
+
+	e.Uvarint(uint64(len(m.Certificate)))
+	for i := range m.Certificate {
+		m.Certificate[i].encode(e)
+	}
+
+	e.Uvarint(uint64(len(m.ViewChanges)))
+	for i := range m.ViewChanges {
+		m.ViewChanges[i].encode(e)
+	}
+}
+
+// decode only accepts view changes in the outer message
+func (m *PBFTMessage) decode(d *Decoder, outer bool) {
+
+	m.Vote.decode(d)
+
+	start := d.Offset()
+	switch d.Byte("pbft block flag") {
+	case 0:
+	case 1:
+		data := d.Bytes("pbft block", MAX_FRAME_SIZE)
+		if d.Err() != nil {
+			return
+		}
+		m.Block = new(Block)
+		if err := m.Block.UnmarshalBinary(data); err != nil {
+			d.off = start
+			d.fail("pbft block", err)
+		}
+	default:
+		d.off = start
+		d.fail("pbft block flag", ErrNonCanonical)
+	}
+
+	if n := d.count("pbft certificate size"); n > 0 {
+		m.Certificate = make([]PBFTVote, n)
+	}
+	for i := range m.Certificate {
+		m.Certificate[i].decode(d)
+	}
+
+	start = d.Offset()
+	n := d.count("pbft view changes")
+	if n > 0 && !outer {
+		d.off = start
+		d.fail("pbft view changes", ErrFieldTooLong)
+		return
+	}
+	if n > 0 {
+		m.ViewChanges = make([]PBFTMessage, n)
+	}
+	for i := range m.ViewChanges {
+		m.ViewChanges[i].decode(d, false)
+	}
+}
@@ -0,0 +1,338 @@
+package core
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+type pbftTestNode struct {
+	Keypair *Keypair
+	Chain   *Blockchain
+	Engine  *PBFT
+}
+
+// droppedHandler stands for a validator that is offline
+type droppedHandler struct{}
+
+func (droppedHandler) HandleMessage(m Message) {}
+
+// pbftTestCluster starts n validators over a MemoryNetwork, the ones in
+// offline get no engine and drop their messages
+func pbftTestCluster(t testing.TB, n int, timeout time.Duration, offline ...int) []pbftTestNode {
+
+	nodes := make([]pbftTestNode, n)
+	keys := [][]byte{}
+	for i := range nodes {
+		nodes[i].Keypair = GenerateNewKeypair()
+		keys = append(keys, nodes[i].Keypair.Public)
+	}
+
+	// Blocks are sealed with the validator keys, Core.Keypair only fills in an origin
+	Core.Keypair = nodes[0].Keypair
+
+	network := &MemoryNetwork{Handlers: make([]ConsensusHandler, n)}
+	for i := range nodes {
+		network.Handlers[i] = droppedHandler{}
+	}
+	for i := range nodes {
+		if containsInt(offline, i) {
+			continue
+		}
+
+		nodes[i].Chain = SetupBlockchan()
+		engine, err := NewPBFT(nodes[i].Chain, keys, nodes[i].Keypair, network.Transport(i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		engine.ViewTimeout = timeout
+		nodes[i].Chain.Consensus = engine
+		nodes[i].Engine = engine
+	}
+	for i := range nodes {
+		if nodes[i].Engine != nil {
+			network.Handlers[i] = nodes[i].Engine
+		}
+	}
+
+	return nodes
+}
+
+func containsInt(l []int, i int) bool {
+
+	for _, v := range l {
+		if v == i {
+			return true
+		}
+	}
+	return false
+}
+
+// pbftTestSubmit adds transactions to the mempool of every running validator
+func pbftTestSubmit(nodes []pbftTestNode, txs ...*Transaction) {
+
+	for _, n := range nodes {
+		if n.Chain != nil {
+			for _, tr := range txs {
+				n.Chain.Mempool.Add(tr)
+			}
+		}
+	}
+}
+
+// pbftTestWait waits for every running validator to reach height
+func pbftTestWait(t testing.TB, nodes []pbftTestNode, height int, timeout time.Duration) {
+
+	deadline := time.Now().Add(timeout)
+	for _, n := range nodes {
+		if n.Chain == nil {
+			continue
+		}
+		for _, h := n.Chain.Head(); h < height; _, h = n.Chain.Head() {
+			if time.Now().After(deadline) {
+				t.Fatalf("Validator stuck at height %d, expected %d", h, height)
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+}
+
+func TestPBFTMessageMarshalling(t *testing.T) {
+
+	kp := GenerateNewKeypair()
+	prepare := PBFTVote{Phase: MESSAGE_PBFT_PREPARE, View: 2, Height: 7, Digest: codecTestBlock(2).Hash(), Validator: 3}
+	if err := prepare.Sign(kp); err != nil {
+		t.Fatal(err)
+	}
+
+	viewChange := PBFTMessage{Vote: PBFTVote{Phase: MESSAGE_PBFT_VIEW_CHANGE, View: 3, Height: 7, Digest: prepare.Digest}, Certificate: []PBFTVote{prepare, prepare}}
+	viewChange.Vote.Sign(kp)
+
+	m := &PBFTMessage{Vote: PBFTVote{Phase: MESSAGE_PBFT_NEW_VIEW, View: 3, Height: 7, Digest: prepare.Digest}, Block: codecTestBlock(2), ViewChanges: []PBFTMessage{viewChange}}
+	m.Vote.Sign(kp)
+
+	data, err := m.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	decoded := new(PBFTMessage)
+	if err := decoded.UnmarshalBinary(data); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(decoded.Vote, m.Vote) || !reflect.DeepEqual(decoded.ViewChanges, m.ViewChanges) || !reflect.DeepEqual(decoded.Block.Hash(), m.Block.Hash()) {
+		t.Error("Marshall unmarshall PBFT message error")
+	}
+	if !VerifySignature(kp.Scheme(), kp.Public, decoded.ViewChanges[0].Certificate[1].Signature, prepare.SignedHash()) {
+		t.Error("Prepare signature doesn't verify after decoding")
+	}
+
+	// View changes don't nest
+	m.ViewChanges[0].ViewChanges = []PBFTMessage{viewChange}
+	data, _ = m.MarshalBinary()
+	if err := new(PBFTMessage).UnmarshalBinary(data); err == nil {
+		t.Error("Nested view change decoded")
+	}
+}
+
+func TestPBFTCommit(t *testing.T) {
+
+	nodes := pbftTestCluster(t, 4, time.Second)
+	tr := codecTestTransaction()
+	pbftTestSubmit(nodes, tr)
+
+	if _, err := nodes[1].Chain.ProposeBlock(nodes[1].Chain.AssembleBlock); err != ErrNotProposer {
+		t.Fatal("Validator 1 proposed out of turn", err)
+	}
+
+	b, err := nodes[0].Chain.ProposeBlock(nodes[0].Chain.AssembleBlock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pbftTestWait(t, nodes, 0, time.Second*5)
+
+	for i, n := range nodes {
+		if final := n.Chain.BlockByHeight(0); final == nil || !reflect.DeepEqual(final.Hash(), b.Hash()) {
+			t.Errorf("Validator %d committed another block", i)
+		}
+		if _, height := n.Chain.FindTransaction(tr.Hash()); height != 0 || n.Chain.Mempool.Len() != 0 {
+			t.Errorf("Transaction of validator %d not committed", i)
+		}
+	}
+
+	certificate := nodes[2].Engine.Certificate(0)
+	if len(certificate) < 3 {
+		t.Fatal("Commit certificate without quorum", certificate)
+	}
+	for _, v := range certificate {
+		if v.Phase != MESSAGE_PBFT_COMMIT || !reflect.DeepEqual(v.Digest, b.Hash()) || !nodes[2].Engine.verifyVote(&v) {
+			t.Error("Invalid vote in commit certificate", v)
+		}
+	}
+
+	// The leader rotates with the height
+	pbftTestSubmit(nodes, codecTestTransaction())
+	if _, err := nodes[1].Chain.ProposeBlock(nodes[1].Chain.AssembleBlock); err != nil {
+		t.Fatal("Validator 1 didn't lead the second block", err)
+	}
+	pbftTestWait(t, nodes, 1, time.Second*5)
+}
+
+func TestPBFTViewChange(t *testing.T) {
+
+	// Validator 0 leads the first block and is offline
+	nodes := pbftTestCluster(t, 4, time.Millisecond*50, 0)
+	tr := codecTestTransaction()
+	pbftTestSubmit(nodes, tr)
+
+	for _, n := range nodes[1:] {
+		if _, err := n.Chain.ProposeBlock(n.Chain.AssembleBlock); err != ErrNotProposer {
+			t.Fatal("Proposed without leading", err)
+		}
+	}
+	pbftTestWait(t, nodes, 0, time.Second*5)
+
+	b := nodes[1].Chain.BlockByHeight(0)
+	if !reflect.DeepEqual(b.Origin, nodes[1].Keypair.Public) {
+		t.Error("Block not proposed by the leader of view 1")
+	}
+	for i, n := range nodes[1:] {
+		if !reflect.DeepEqual(n.Chain.BlockByHeight(0).Hash(), b.Hash()) {
+			t.Errorf("Validator %d committed another block", i+1)
+		}
+		if stats := n.Engine.Stats(); stats.ViewChanges != 1 || stats.Committed != 1 {
+			t.Errorf("Wrong stats of validator %d: %+v", i+1, stats)
+		}
+	}
+	if _, height := nodes[3].Chain.FindTransaction(tr.Hash()); height != 0 {
+		t.Error("Transaction not committed after the view change")
+	}
+}
+
+func TestPBFTWaitsOutsideAcceptLock(t *testing.T) {
+
+	// Without the other validators our proposal waits for a quorum
+	nodes := pbftTestCluster(t, 4, time.Millisecond*200, 1, 2, 3)
+	pbftTestSubmit(nodes, codecTestTransaction())
+	go nodes[0].Chain.ProposeBlock(nodes[0].Chain.AssembleBlock)
+	netTestWait(t, "proposal", func() bool {
+		nodes[0].Engine.lock.Lock()
+		defer nodes[0].Engine.lock.Unlock()
+		return len(nodes[0].Engine.waiters) == 1
+	})
+
+	// Blocks from peers still get through
+	b := nodes[0].Chain.CreateNewBlock()
+	accepted := make(chan error)
+	go func() { accepted <- nodes[0].Chain.AcceptBlock(&b) }()
+	select {
+	case err := <-accepted:
+		if err != ErrAwaitingQuorum {
+			t.Error("Block of a peer accepted", err)
+		}
+	case <-time.After(time.Millisecond * 500):
+		t.Fatal("Block waited on our proposal")
+	}
+}
+
+func TestPBFTConflictingProposals(t *testing.T) {
+
+	for _, n := range []int{3, 5} {
+		pbftTestEquivocate(t, n)
+	}
+}
+
+// pbftTestEquivocate has validator 0 lead with one block for the first half
+// of the others and another block for the rest, voting for both. The honest
+// validators must never commit different blocks.
+func pbftTestEquivocate(t *testing.T, n int) {
+
+	nodes := pbftTestCluster(t, n, time.Millisecond*50, 0)
+	faulty := &PBFT{Keypair: nodes[0].Keypair}
+	send := func(to []pbftTestNode, m *PBFTMessage) {
+		faulty.broadcast(m)
+		for _, node := range to {
+			node.Engine.HandleMessage(faulty.unsent[0])
+		}
+		faulty.unsent = nil
+	}
+
+	honest := nodes[1:]
+	for _, to := range [][]pbftTestNode{honest[:len(honest)/2], honest[len(honest)/2:]} {
+		b := nodes[1].Chain.CreateNewBlock()
+		b.AddTransaction(codecTestTransaction())
+		b.BlockHeader.MerkelRoot = b.GenerateMerkelRoot()
+		if err := faulty.seal(&b); err != nil {
+			t.Fatal(err)
+		}
+		send(to, &PBFTMessage{Vote: PBFTVote{Phase: MESSAGE_PBFT_PRE_PREPARE, Digest: b.Hash()}, Block: &b})
+		send(to, &PBFTMessage{Vote: PBFTVote{Phase: MESSAGE_PBFT_PREPARE, Digest: b.Hash()}})
+		send(to, &PBFTMessage{Vote: PBFTVote{Phase: MESSAGE_PBFT_COMMIT, Digest: b.Hash()}})
+	}
+
+	// Long enough for a view change or two
+	time.Sleep(time.Millisecond * 500)
+	var committed *Block
+	for i, node := range honest {
+		b := node.Chain.BlockByHeight(0)
+		if b == nil {
+			continue
+		}
+		if committed != nil && !reflect.DeepEqual(b.Hash(), committed.Hash()) {
+			t.Errorf("%d validators: validator %d committed another block", n, i+1)
+		}
+		committed = b
+	}
+}
+
+func TestPBFTRejectsForgedVotes(t *testing.T) {
+
+	nodes := pbftTestCluster(t, 4, time.Second)
+
+	// A vote signed by a key outside the validator set
+	v := PBFTVote{Phase: MESSAGE_PBFT_COMMIT, Digest: codecTestBlock(2).Hash(), Validator: 1}
+	v.Sign(GenerateNewKeypair())
+	if nodes[0].Engine.verifyVote(&v) {
+		t.Error("Forged vote verified")
+	}
+
+	v.Validator = 9
+	if nodes[0].Engine.verifyVote(&v) {
+		t.Error("Vote of an unknown validator verified")
+	}
+}
+
+// benchmarkPBFT commits b.N blocks, reporting committed transactions per
+// second and the mean time from pre-prepare to commit
+func benchmarkPBFT(b *testing.B, n int) {
+
+	const txsPerBlock = 20
+
+	nodes := pbftTestCluster(b, n, time.Second*5)
+	txs := make([]*Transaction, b.N*txsPerBlock)
+	for i := range txs {
+		txs[i] = codecTestTransaction()
+	}
+
+	b.ResetTimer()
+	start := time.Now()
+	for i := 0; i < b.N; i++ {
+		pbftTestSubmit(nodes, txs[i*txsPerBlock:(i+1)*txsPerBlock]...)
+
+		leader := nodes[i%n].Chain
+		if _, err := leader.ProposeBlock(leader.AssembleBlock); err != nil {
+			b.Fatal(err)
+		}
+		pbftTestWait(b, nodes, i, time.Minute)
+	}
+	elapsed := time.Since(start)
+	b.StopTimer()
+
+	stats := nodes[0].Engine.Stats()
+	b.ReportMetric(float64(len(txs))/elapsed.Seconds(), "tx/s")
+	b.ReportMetric(float64(stats.CommitLatency.Milliseconds())/float64(stats.Committed), "ms/commit")
+}
+
+func BenchmarkPBFT4(b *testing.B)  { benchmarkPBFT(b, 4) }
+func BenchmarkPBFT7(b *testing.B)  { benchmarkPBFT(b, 7) }
+func BenchmarkPBFT16(b *testing.B) { benchmarkPBFT(b, 16) }
@@ -0,0 +1,66 @@
+package core
+
+import (
+	"encoding/json"
+	"os"
+	"path"
+	"sync"
+)
+
+const BLOCKCHAIN_PEERS_FILENAME = "peers.json"
+
+// peersLock serializes updates to the peers file
+var peersLock sync.Mutex
+
+// LoadPeers returns the addresses saved in a data directory, none if there is no peers file
+func LoadPeers(dir string) ([]string, error) {
+
+	data, err := os.ReadFile(path.Join(dir, BLOCKCHAIN_PEERS_FILENAME))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	peers := []string{}
+	return peers, json.Unmarshal(data, &peers)
+}
+
+func SavePeers(dir string, peers []string) error {
+
+	data, err := json.MarshalIndent(peers, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+
+	file := path.Join(dir, BLOCKCHAIN_PEERS_FILENAME)
+	if err := os.WriteFile(file+".tmp", data, 0600); err != nil {
+		return err
+	}
+
+	return os.Rename(file+".tmp", file)
+}
+
+// RememberPeer adds an address we connected to so the node dials it again on restart
+func RememberPeer(dir, address string) error {
+
+	peersLock.Lock()
+	defer peersLock.Unlock()
+
+	peers, err := LoadPeers(dir)
+	if err != nil {
+		return err
+	}
+	for _, p := range peers {
+		if p == address {
+			return nil
+		}
+	}
+
+	return SavePeers(dir, append(peers, address))
+}
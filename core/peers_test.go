@@ -0,0 +1,63 @@
+package core
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestRememberPeer(t *testing.T) {
+
+	dir := t.TempDir()
+
+	if peers, err := LoadPeers(dir); err != nil || len(peers) != 0 {
+		t.Error("Peers without a peers file", peers, err)
+	}
+
+	RememberPeer(dir, "127.0.0.1:1992")
+	RememberPeer(dir, "127.0.0.1:1993")
+	RememberPeer(dir, "127.0.0.1:1992")
+
+	peers, err := LoadPeers(dir)
+	if err != nil || !reflect.DeepEqual(peers, []string{"127.0.0.1:1992", "127.0.0.1:1993"}) {
+		t.Error("Wrong peers", peers, err)
+	}
+}
+
+func TestCreateIdentities(t *testing.T) {
+
+	t.Setenv(KEYSTORE_PASSPHRASE_ENV, "cluster")
+
+	base := t.TempDir()
+	addresses := []string{"127.0.0.1:1992", "127.0.0.1:1993", "127.0.0.1:1994"}
+
+	dirs, err := CreateIdentities(base, addresses, SIGNATURE_SCHEME_ED25519)
+	if err != nil || len(dirs) != 3 {
+		t.Fatal(err)
+	}
+
+	origins := map[string]bool{}
+	for _, d := range dirs {
+		k, err := OpenConfiguration(d)
+		if err != nil || k == nil || k.Scheme() != SIGNATURE_SCHEME_ED25519 {
+			t.Fatal("Identity not created", d, err)
+		}
+		origins[string(k.Public)] = true
+	}
+	if len(origins) != 3 {
+		t.Error("Nodes share keys")
+	}
+
+	peers, _ := LoadPeers(dirs[1])
+	if !reflect.DeepEqual(peers, []string{"127.0.0.1:1992", "127.0.0.1:1994"}) {
+		t.Error("Wrong cluster peers", peers)
+	}
+
+	validators, _ := LoadValidators(dirs[2])
+	if len(validators) != 3 || !origins[string(validators[0])] {
+		t.Error("Wrong validator set", validators)
+	}
+
+	if _, err := CreateIdentities(base, addresses, SIGNATURE_SCHEME_ED25519); err == nil {
+		t.Error("Existing identities overwritten")
+	}
+}
@@ -0,0 +1,109 @@
+package core
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+)
+
+const BLOCKCHAIN_VALIDATORS_FILENAME = "validators.json"
+
+// ProofOfAuthority takes turns between a fixed set of validators, the block
+// at height h is signed by validator h mod len(Validators)
+type ProofOfAuthority struct {
+	Chain      *Blockchain
+	Validators [][]byte // public keys
+}
+
+func NewProofOfAuthority(bl *Blockchain, validators [][]byte) (*ProofOfAuthority, error) {
+
+	if len(validators) == 0 {
+		return nil, errors.New("Proof of authority needs at least one validator")
+	}
+
+	return &ProofOfAuthority{Chain: bl, Validators: validators}, nil
+}
+
+func (c *ProofOfAuthority) Name() string { return CONSENSUS_POA }
+
+// Proposer is the validator that signs the block at height
+func (c *ProofOfAuthority) Proposer(height int) []byte {
+
+	return c.Validators[height%len(c.Validators)]
+}
+
+func (c *ProofOfAuthority) Propose(height int, assemble func() Block) (*Block, error) {
+
+	// Checked before assembling, that takes transactions out of the mempool
+	if !bytes.Equal(c.Proposer(height), Core.Keypair.Public) {
+		return nil, ErrNotProposer
+	}
+
+	b := assemble()
+	sig, err := Core.Keypair.Sign(b.Hash())
+	if err != nil {
+		return nil, err
+	}
+	b.Signature = sig
+
+	return &b, nil
+}
+
+func (c *ProofOfAuthority) Validate(b *Block, height int) error {
+
+	if !bytes.Equal(b.Origin, c.Proposer(height)) {
+		return fmt.Errorf("Block %d signed by %s, it's %s's turn", height, b.Origin, c.Proposer(height))
+	}
+	if !bytes.Equal(b.GenerateMerkelRoot(), b.MerkelRoot) {
+		return errors.New("Block merkle root doesn't match its transactions")
+	}
+	if !VerifySignature(b.BlockHeader.Scheme, b.Origin, b.Signature, b.Hash()) {
+		return errors.New("Invalid block signature")
+	}
+
+	return nil
+}
+
+func (c *ProofOfAuthority) Finalize(b *Block, height int) error {
+
+	c.Chain.CommitBlock(b)
+	return nil
+}
+
+// LoadValidators reads the public keys of the validator set from a data directory
+func LoadValidators(dir string) ([][]byte, error) {
+
+	data, err := os.ReadFile(path.Join(dir, BLOCKCHAIN_VALIDATORS_FILENAME))
+	if err != nil {
+		return nil, err
+	}
+
+	keys := []string{}
+	if err := json.Unmarshal(data, &keys); err != nil {
+		return nil, err
+	}
+
+	validators := make([][]byte, len(keys))
+	for i, k := range keys {
+		validators[i] = []byte(k)
+	}
+	return validators, nil
+}
+
+func SaveValidators(dir string, validators [][]byte) error {
+
+	keys := make([]string, len(validators))
+	for i, v := range validators {
+		keys[i] = string(v)
+	}
+
+	data, err := json.MarshalIndent(keys, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(path.Join(dir, BLOCKCHAIN_VALIDATORS_FILENAME), data, 0600)
+}
@@ -0,0 +1,297 @@
+package core
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// Messages from each peer are limited by token buckets, one for all its
+// frames and one for each message type, in messages and bytes per second.
+// Frames are charged as they come off the wire, before they're decompressed,
+// and messages by their type once they're decoded, at their inflated size.
+// A bucket holds a second's worth, so a quiet peer can burst up to the limit.
+// Messages over a limit are dropped, or with Delay the peer's reader waits
+// for the tokens, which slows the peer down through TCP. A frame bigger than
+// a second's worth of bytes gets through a full bucket and leaves it in debt.
+
+// RateLimit caps what a peer sends, 0 for no cap
+type RateLimit struct {
+	Messages float64 `json:"messages,omitempty"` // per second
+	Bytes    float64 `json:"bytes,omitempty"`    // per second
+}
+
+// RateLimits are read from a limits file or the setRateLimits RPC
+type RateLimits struct {
+	Peer  RateLimit            `json:"peer"`            // all the frames from a peer, in bytes on the wire
+	Types map[string]RateLimit `json:"types,omitempty"` // messages of a type from a peer, by name
+	Delay bool                 `json:"delay,omitempty"` // messages over a limit wait instead of being dropped
+}
+
+type RateLimitCounts struct {
+	Dropped      uint64        `json:"dropped"`
+	DroppedBytes uint64        `json:"droppedBytes"`
+	Delayed      uint64        `json:"delayed"`
+	DelayTime    time.Duration `json:"delayTime"`
+}
+
+type RateLimitsInfo struct {
+	Limits RateLimits `json:"limits"`
+	RateLimitCounts
+	Types map[string]RateLimitCounts `json:"types"` // by the type of the messages limited
+}
+
+type RateLimiter struct {
+	lock       sync.Mutex
+	limits     RateLimits
+	types      map[byte]RateLimit
+	counts     RateLimitCounts
+	typeCounts map[byte]RateLimitCounts
+}
+
+func NewRateLimiter() *RateLimiter {
+
+	return &RateLimiter{types: map[byte]RateLimit{}, typeCounts: map[byte]RateLimitCounts{}}
+}
+
+func LoadRateLimits(file string) (RateLimits, error) {
+
+	l := RateLimits{}
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return l, err
+	}
+	if err := json.Unmarshal(data, &l); err != nil {
+		return l, err
+	}
+	return l, l.Validate()
+}
+
+func (l RateLimits) Validate() error {
+
+	if _, err := l.typeLimits(); err != nil {
+		return err
+	}
+	limits := []RateLimit{l.Peer}
+	for _, r := range l.Types {
+		limits = append(limits, r)
+	}
+	for _, r := range limits {
+		if r.Messages < 0 || r.Bytes < 0 {
+			return errors.New("Rate limits can't be negative")
+		}
+	}
+	return nil
+}
+
+// typeLimits keys the type limits by message identifier
+func (l RateLimits) typeLimits() (map[byte]RateLimit, error) {
+
+	types := map[byte]RateLimit{}
+	for name, r := range l.Types {
+		id, ok := messageID(name)
+		if !ok {
+			return nil, fmt.Errorf("Unknown message %q", name)
+		}
+		types[id] = r
+	}
+	return types, nil
+}
+
+// messageID finds a message identifier by its name
+func messageID(name string) (byte, bool) {
+
+	for id, n := range messageNames {
+		if n == name {
+			return id, true
+		}
+	}
+	return 0, false
+}
+
+// Set replaces the limits, the buckets of the peers stay as they are
+func (r *RateLimiter) Set(l RateLimits) error {
+
+	types, err := l.typeLimits()
+	if err != nil {
+		return err
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.limits, r.types = l, types
+	return nil
+}
+
+func (r *RateLimiter) Info() RateLimitsInfo {
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	info := RateLimitsInfo{Limits: r.limits, RateLimitCounts: r.counts, Types: map[string]RateLimitCounts{}}
+	for id, c := range r.typeCounts {
+		info.Types[MessageName(id)] = c
+	}
+	return info
+}
+
+// AllowFrame applies the peer limit to a frame of size bytes from the node,
+// before it's decoded, false when it's dropped. Delayed frames return once
+// they're within the limit.
+func (r *RateLimiter) AllowFrame(node *Node, size int) bool {
+
+	r.lock.Lock()
+	peer, delay := r.limits.Peer, r.limits.Delay
+	r.lock.Unlock()
+
+	wait, ok := node.limits.reserve(&node.limits.frames, peer, size, delay, time.Now())
+	if wait == 0 && ok {
+		return true
+	}
+
+	r.lock.Lock()
+	r.counts.limited(wait, ok, size)
+	r.lock.Unlock()
+
+	time.Sleep(wait)
+	return ok
+}
+
+// Allow applies the limit of its type to a decoded message of size bytes
+// from the node, like AllowFrame
+func (r *RateLimiter) Allow(node *Node, id byte, size int) bool {
+
+	r.lock.Lock()
+	typed, delay := r.types[id], r.limits.Delay
+	r.lock.Unlock()
+
+	wait, ok := node.limits.reserve(node.limits.typeBuckets(id), typed, size, delay, time.Now())
+	if wait == 0 && ok {
+		return true
+	}
+
+	r.lock.Lock()
+	c := r.typeCounts[id]
+	c.limited(wait, ok, size)
+	r.typeCounts[id] = c
+	r.counts.limited(wait, ok, size)
+	r.lock.Unlock()
+
+	time.Sleep(wait)
+	return ok
+}
+
+func (c *RateLimitCounts) limited(wait time.Duration, ok bool, size int) {
+
+	if ok {
+		c.Delayed++
+		c.DelayTime += wait
+	} else {
+		c.Dropped++
+		c.DroppedBytes += uint64(size)
+	}
+}
+
+// tokenBucket refills at the rate it's used with, up to a second's worth
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// wait is how long until n tokens are there at rate, 0 when they are
+func (b *tokenBucket) wait(rate, n float64, now time.Time) time.Duration {
+
+	if rate == 0 {
+		return 0
+	}
+	if b.last.IsZero() {
+		b.tokens = rate
+	} else {
+		b.tokens = min(rate, b.tokens+now.Sub(b.last).Seconds()*rate)
+	}
+	b.last = now
+
+	// A full bucket lets more than it holds through
+	need := min(n, rate)
+	if b.tokens >= need {
+		return 0
+	}
+	return time.Duration((need - b.tokens) / rate * float64(time.Second))
+}
+
+// rateBuckets count the messages and bytes of one limit
+type rateBuckets struct {
+	messages, bytes tokenBucket
+}
+
+func (b *rateBuckets) wait(limit RateLimit, size int, now time.Time) time.Duration {
+
+	return max(b.messages.wait(limit.Messages, 1, now), b.bytes.wait(limit.Bytes, float64(size), now))
+}
+
+func (b *rateBuckets) take(limit RateLimit, size int) {
+
+	if limit.Messages > 0 {
+		b.messages.tokens--
+	}
+	if limit.Bytes > 0 {
+		b.bytes.tokens -= float64(size)
+	}
+}
+
+// peerLimits are the buckets of one peer, the zero value starts them full
+type peerLimits struct {
+	lock   sync.Mutex
+	frames rateBuckets
+	types  map[byte]*rateBuckets
+	counts RateLimitCounts
+}
+
+// typeBuckets are the buckets of the messages of a type
+func (p *peerLimits) typeBuckets(id byte) *rateBuckets {
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if p.types == nil {
+		p.types = map[byte]*rateBuckets{}
+	}
+	b := p.types[id]
+	if b == nil {
+		b = &rateBuckets{}
+		p.types[id] = b
+	}
+	return b
+}
+
+// reserve takes the tokens of one of the buckets when size is within its
+// limit or delay is set, with the time to wait for them
+func (p *peerLimits) reserve(b *rateBuckets, limit RateLimit, size int, delay bool, now time.Time) (time.Duration, bool) {
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	wait := b.wait(limit, size, now)
+	if wait > 0 && !delay {
+		p.counts.limited(0, false, size)
+		return 0, false
+	}
+	b.take(limit, size)
+	if wait > 0 {
+		p.counts.limited(wait, true, size)
+	}
+	return wait, true
+}
+
+// RateLimitCounts are the messages from the node limited
+func (node *Node) RateLimitCounts() RateLimitCounts {
+
+	node.limits.lock.Lock()
+	defer node.limits.lock.Unlock()
+
+	return node.limits.counts
+}
@@ -0,0 +1,155 @@
+package core
+
+import (
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+func TestTokenBucket(t *testing.T) {
+
+	var b tokenBucket
+	now := time.Now()
+	for i := 0; i < 10; i++ {
+		if b.wait(10, 1, now) != 0 {
+			t.Fatal("Burst of a second's worth limited at", i)
+		}
+		b.tokens--
+	}
+	if w := b.wait(10, 1, now); w != time.Millisecond*100 {
+		t.Error("Wrong wait for an empty bucket", w)
+	}
+	if w := b.wait(10, 1, now.Add(time.Millisecond*100)); w != 0 {
+		t.Error("Bucket not refilled", w)
+	}
+	if w := (&tokenBucket{}).wait(0, 1000, now); w != 0 {
+		t.Error("No rate limited", w)
+	}
+}
+
+func TestPeerLimitsDrop(t *testing.T) {
+
+	var p peerLimits
+	now := time.Now()
+	peer, inv := RateLimit{Messages: 5}, RateLimit{Messages: 2}
+
+	for i, id := range []byte{MESSAGE_INV, MESSAGE_INV, MESSAGE_INV, MESSAGE_PING, MESSAGE_PING} {
+		if _, ok := p.reserve(&p.frames, peer, 100, false, now); !ok {
+			t.Fatal("Frame", i, "dropped")
+		}
+		typed := RateLimit{}
+		if id == MESSAGE_INV {
+			typed = inv
+		}
+		// The third inventory is over its type
+		if _, ok := p.reserve(p.typeBuckets(id), typed, 100, false, now); ok != (i != 2) {
+			t.Error("Message", i, MessageName(id), "allowed", ok)
+		}
+	}
+	// The sixth frame is over the peer
+	if _, ok := p.reserve(&p.frames, peer, 100, false, now); ok {
+		t.Error("Frame over the peer limit allowed")
+	}
+	if p.counts.Dropped != 2 || p.counts.DroppedBytes != 200 || p.counts.Delayed != 0 {
+		t.Error("Wrong counts", p.counts)
+	}
+
+	// A frame over a second's worth gets through a full bucket, and leaves it in debt
+	var q peerLimits
+	bytes := RateLimit{Bytes: 1000}
+	if _, ok := q.reserve(&q.frames, bytes, 5000, false, now); !ok {
+		t.Error("Frame bigger than the bucket never fits")
+	}
+	if _, ok := q.reserve(&q.frames, bytes, 1, false, now.Add(time.Second*4)); ok {
+		t.Error("Bucket in debt let a message through")
+	}
+	if _, ok := q.reserve(&q.frames, bytes, 1, false, now.Add(time.Second*6)); !ok {
+		t.Error("Debt not paid back")
+	}
+}
+
+func TestRateLimiterCompressed(t *testing.T) {
+
+	r := NewRateLimiter()
+	limits := RateLimits{Peer: RateLimit{Bytes: 1000}, Types: map[string]RateLimit{"sendBlock": {Bytes: 10000}}}
+	if err := r.Set(limits); err != nil {
+		t.Fatal(err)
+	}
+
+	// Frames are charged on the wire, what they inflate to by their type
+	m := &Message{Identifier: MESSAGE_SEND_BLOCK, Data: make([]byte, 8000)}
+	payload, _ := m.MarshalBinary()
+	sender, receiver := &Node{compress: true}, &Node{}
+	for i := 0; i < 2; i++ {
+		b := sender.compressed(payload)
+		if !r.AllowFrame(receiver, len(b)) {
+			t.Fatal("Compressed frame dropped on the wire")
+		}
+		got := new(Message)
+		got.UnmarshalBinary(b)
+		size, err := receiver.decompress(got)
+		if err != nil || size != len(payload) {
+			t.Fatal("Not decompressed", size, err)
+		}
+		// The second one is over the type's bytes
+		if ok := r.Allow(receiver, got.Identifier, size); ok != (i == 0) {
+			t.Error("Inflated message", i, "allowed", ok)
+		}
+	}
+	if info := r.Info(); info.Dropped != 1 || info.DroppedBytes != uint64(len(payload)) || info.Types["sendBlock"].Dropped != 1 {
+		t.Error("Wrong counts", info)
+	}
+
+	// Frames drained the peer's bucket whatever they inflate to
+	if r.AllowFrame(receiver, 1000) {
+		t.Error("Frame over the peer limit allowed")
+	}
+}
+
+func TestRateLimiterDelay(t *testing.T) {
+
+	r := NewRateLimiter()
+	if err := r.Set(RateLimits{Types: map[string]RateLimit{"sendTransaction": {Messages: 20}}, Delay: true}); err != nil {
+		t.Fatal(err)
+	}
+
+	node := &Node{}
+	start := time.Now()
+	for i := 0; i < 22; i++ {
+		if !r.Allow(node, MESSAGE_SEND_TRANSACTION, 100) {
+			t.Fatal("Delayed message dropped")
+		}
+	}
+	if elapsed := time.Since(start); elapsed < time.Millisecond*80 {
+		t.Error("Messages over the limit not delayed", elapsed)
+	}
+	if !r.Allow(node, MESSAGE_SEND_BLOCK, 100) {
+		t.Error("Message of another type limited")
+	}
+
+	info := r.Info()
+	if info.Delayed != 2 || info.Types["sendTransaction"].Delayed != 2 || info.Dropped != 0 || node.RateLimitCounts().Delayed != 2 {
+		t.Error("Wrong counts", info, node.RateLimitCounts())
+	}
+}
+
+func TestRateLimitsValidate(t *testing.T) {
+
+	if err := (RateLimits{Types: map[string]RateLimit{"inv": {Messages: 10, Bytes: 1000}}}).Validate(); err != nil {
+		t.Error("Valid limits rejected", err)
+	}
+	if err := (RateLimits{Types: map[string]RateLimit{"nothing": {Messages: 10}}}).Validate(); err == nil {
+		t.Error("Unknown message accepted")
+	}
+	if err := (RateLimits{Peer: RateLimit{Bytes: -1}}).Validate(); err == nil {
+		t.Error("Negative limit accepted")
+	}
+
+	file := path.Join(t.TempDir(), "limits.json")
+	os.WriteFile(file, []byte(`{"peer": {"messages": 1000, "bytes": 1048576}, "types": {"sendTransactions": {"messages": 50}}, "delay": true}`), 0600)
+	l, err := LoadRateLimits(file)
+	if err != nil || l.Peer.Bytes != 1048576 || l.Types["sendTransactions"].Messages != 50 || !l.Delay {
+		t.Error("Limits not loaded", l, err)
+	}
+}
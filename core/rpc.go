@@ -0,0 +1,438 @@
+package core
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+// JSON-RPC 2.0 over HTTP POST, so load generators and tools can drive a running node
+
+const (
+	RPC_PARSE_ERROR      = -32700
+	RPC_INVALID_REQUEST  = -32600
+	RPC_METHOD_NOT_FOUND = -32601
+	RPC_INVALID_PARAMS   = -32602
+	RPC_INTERNAL_ERROR   = -32603
+	RPC_REJECTED         = -32000
+)
+
+// RPC_MAX_BODY_SIZE fits a transaction of MAX_PAYLOAD_SIZE, hex encoded, with room to spare
+const RPC_MAX_BODY_SIZE = 2*MAX_PAYLOAD_SIZE + 64*1024
+
+type RPCError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *RPCError) Error() string {
+
+	return fmt.Sprintf("rpc error %d: %s", e.Code, e.Message)
+}
+
+type RPCMethod func(params json.RawMessage) (interface{}, error)
+
+type rpcRequest struct {
+	JSONRPC string          `json:"jsonrpc"`
+	Method  string          `json:"method"`
+	Params  json.RawMessage `json:"params"`
+	ID      json.RawMessage `json:"id"`
+}
+
+type rpcResponse struct {
+	JSONRPC string          `json:"jsonrpc"`
+	Result  interface{}     `json:"result"`
+	Error   *RPCError       `json:"error,omitempty"`
+	ID      json.RawMessage `json:"id"`
+}
+
+type RPCServer struct {
+	*http.Server
+	methods map[string]RPCMethod
+}
+
+// NewRPCServer creates a server with the node methods registered
+func NewRPCServer(address string) *RPCServer {
+
+	s := &RPCServer{methods: map[string]RPCMethod{}}
+	s.Server = &http.Server{Addr: address, Handler: s}
+
+	s.Register("submitTransaction", rpcSubmitTransaction)
+	s.Register("getTransaction", rpcGetTransaction)
+	s.Register("getBlockByHash", rpcGetBlockByHash)
+	s.Register("getBlockByHeight", rpcGetBlockByHeight)
+	s.Register("getChainHead", rpcGetChainHead)
+	s.Register("getPeers", rpcGetPeers)
+	s.Register("getMempoolInfo", rpcGetMempoolInfo)
+	s.Register("getNetworkStats", rpcGetNetworkStats)
+	s.Register("getBans", rpcGetBans)
+	s.Register("getFaults", rpcGetFaults)
+	s.Register("setFaults", rpcSetFaults)
+	s.Register("getRateLimits", rpcGetRateLimits)
+	s.Register("setRateLimits", rpcSetRateLimits)
+
+	return s
+}
+
+func StartRPC(address string) *RPCServer {
+
+	s := NewRPCServer(address)
+	fmt.Println("RPC listening in", address)
+	go func() {
+		networkError(s.ListenAndServe())
+	}()
+
+	return s
+}
+
+func (s *RPCServer) Register(method string, m RPCMethod) {
+
+	s.methods[method] = m
+}
+
+func (s *RPCServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method != http.MethodPost {
+		http.Error(w, "JSON-RPC requests must be POSTed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var body json.RawMessage
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, RPC_MAX_BODY_SIZE)).Decode(&body); err != nil {
+		writeJSON(w, rpcResponse{JSONRPC: "2.0", Error: &RPCError{RPC_PARSE_ERROR, err.Error()}})
+		return
+	}
+
+	// Batches are arrays of requests answered with an array of responses
+	if trimmed := bytes.TrimSpace(body); len(trimmed) > 0 && trimmed[0] == '[' {
+
+		var reqs []rpcRequest
+		if err := json.Unmarshal(body, &reqs); err != nil {
+			writeJSON(w, rpcResponse{JSONRPC: "2.0", Error: &RPCError{RPC_INVALID_REQUEST, err.Error()}})
+			return
+		}
+		if len(reqs) == 0 {
+			writeJSON(w, rpcResponse{JSONRPC: "2.0", Error: &RPCError{RPC_INVALID_REQUEST, "Empty batch"}})
+			return
+		}
+
+		resps := make([]rpcResponse, len(reqs))
+		for i, req := range reqs {
+			resps[i] = s.call(req)
+		}
+		writeJSON(w, resps)
+		return
+	}
+
+	var req rpcRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		writeJSON(w, rpcResponse{JSONRPC: "2.0", Error: &RPCError{RPC_INVALID_REQUEST, err.Error()}})
+		return
+	}
+	writeJSON(w, s.call(req))
+}
+
+func (s *RPCServer) call(req rpcRequest) rpcResponse {
+
+	resp := rpcResponse{JSONRPC: "2.0", ID: req.ID}
+
+	m, ok := s.methods[req.Method]
+	if !ok {
+		resp.Error = &RPCError{RPC_METHOD_NOT_FOUND, "Method not found: " + req.Method}
+		return resp
+	}
+
+	result, err := m(req.Params)
+	if err != nil {
+		rpcErr, ok := err.(*RPCError)
+		if !ok {
+			rpcErr = &RPCError{RPC_REJECTED, err.Error()}
+		}
+		resp.Error = rpcErr
+		return resp
+	}
+
+	resp.Result = result
+	return resp
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+
+	w.Header().Set("Content-Type", "application/json")
+	logOnError(json.NewEncoder(w).Encode(v))
+}
+
+// ParseRPCParams decodes named params, a missing params object leaves v untouched
+func ParseRPCParams(params json.RawMessage, v interface{}) error {
+
+	if len(params) == 0 {
+		return nil
+	}
+	if err := json.Unmarshal(params, v); err != nil {
+		return &RPCError{RPC_INVALID_PARAMS, err.Error()}
+	}
+	return nil
+}
+
+func parseHashParam(h string) ([]byte, error) {
+
+	b, err := hex.DecodeString(h)
+	if err != nil || len(b) != HASH_SIZE {
+		return nil, &RPCError{RPC_INVALID_PARAMS, "hash must be 32 hex encoded bytes"}
+	}
+	return b, nil
+}
+
+// JSON views of chain objects
+
+type TransactionInfo struct {
+	Hash        string  `json:"hash"`
+	From        string  `json:"from"`
+	To          string  `json:"to"`
+	Timestamp   uint32  `json:"timestamp"`
+	PayloadHash string  `json:"payloadHash"`
+	PayloadSize uint32  `json:"payloadSize"`
+	Payload     string  `json:"payload"`
+	Nonce       uint32  `json:"nonce"`
+	Fee         uint64  `json:"fee"`
+	FeeRate     float64 `json:"feeRate"`
+	Scheme      string  `json:"scheme"`
+	Signature   string  `json:"signature"`
+	Size        int     `json:"size"`
+	BlockHeight int     `json:"blockHeight"` // -1 while in the mempool
+}
+
+type BlockInfo struct {
+	Hash              string            `json:"hash"`
+	Height            int               `json:"height"`
+	PrevBlock         string            `json:"prevBlock"`
+	MerkelRoot        string            `json:"merkelRoot"`
+	Origin            string            `json:"origin"`
+	Timestamp         uint32            `json:"timestamp"`
+	Nonce             uint32            `json:"nonce"`
+	Scheme            string            `json:"scheme"`
+	Signature         string            `json:"signature"`
+	TxCount           int               `json:"txCount"`
+	TransactionHashes []string          `json:"transactionHashes,omitempty"`
+	Transactions      []TransactionInfo `json:"transactions,omitempty"`
+}
+
+type MempoolInfo struct {
+	Size            int    `json:"size"`
+	Bytes           int    `json:"bytes"`
+	Capacity        int    `json:"capacity"`
+	MinRelayFeeRate uint64 `json:"minRelayFeeRate"`
+}
+
+func NewTransactionInfo(t *Transaction, height int) TransactionInfo {
+
+	return TransactionInfo{
+		Hash:        hex.EncodeToString(t.Hash()),
+		From:        string(t.Header.From),
+		To:          string(t.Header.To),
+		Timestamp:   t.Header.Timestamp,
+		PayloadHash: hex.EncodeToString(t.Header.PayloadHash),
+		PayloadSize: t.Header.PayloadLength,
+		Payload:     hex.EncodeToString(t.Payload),
+		Nonce:       t.Header.Nonce,
+		Fee:         t.Header.Fee,
+		FeeRate:     t.FeeRate(),
+		Scheme:      SignatureSchemeName(t.Header.Scheme),
+		Signature:   string(t.Signature),
+		Size:        t.Size(),
+		BlockHeight: height,
+	}
+}
+
+// NewBlockInfo lists transaction hashes, or whole transactions when full is set
+func NewBlockInfo(b *Block, height int, full bool) BlockInfo {
+
+	info := BlockInfo{
+		Hash:       hex.EncodeToString(b.Hash()),
+		Height:     height,
+		PrevBlock:  hex.EncodeToString(b.PrevBlock),
+		MerkelRoot: hex.EncodeToString(b.MerkelRoot),
+		Origin:     string(b.Origin),
+		Timestamp:  b.BlockHeader.Timestamp,
+		Nonce:      b.BlockHeader.Nonce,
+		Scheme:     SignatureSchemeName(b.BlockHeader.Scheme),
+		Signature:  string(b.Signature),
+		TxCount:    b.TransactionSlice.Len(),
+	}
+
+	for i := range *b.TransactionSlice {
+		t := &(*b.TransactionSlice)[i]
+		if full {
+			info.Transactions = append(info.Transactions, NewTransactionInfo(t, height))
+		} else {
+			info.TransactionHashes = append(info.TransactionHashes, hex.EncodeToString(t.Hash()))
+		}
+	}
+
+	return info
+}
+
+func rpcSubmitTransaction(params json.RawMessage) (interface{}, error) {
+
+	var p struct {
+		Transaction string `json:"transaction"` // hex of MarshalBinary
+	}
+	if err := ParseRPCParams(params, &p); err != nil {
+		return nil, err
+	}
+
+	data, err := hex.DecodeString(p.Transaction)
+	if err != nil {
+		return nil, &RPCError{RPC_INVALID_PARAMS, "transaction must be hex encoded"}
+	}
+
+	t := new(Transaction)
+	rem, err := t.UnmarshalBinary(data)
+	if err != nil {
+		return nil, &RPCError{RPC_INVALID_PARAMS, err.Error()}
+	}
+	if len(rem) > 0 {
+		return nil, &RPCError{RPC_INVALID_PARAMS, ErrTrailingData.Error()}
+	}
+
+	if err := Core.Blockchain.SubmitTransaction(t); err != nil {
+		return nil, err
+	}
+
+	return map[string]string{"hash": hex.EncodeToString(t.Hash())}, nil
+}
+
+func rpcGetTransaction(params json.RawMessage) (interface{}, error) {
+
+	var p struct {
+		Hash string `json:"hash"`
+	}
+	if err := ParseRPCParams(params, &p); err != nil {
+		return nil, err
+	}
+	hash, err := parseHashParam(p.Hash)
+	if err != nil {
+		return nil, err
+	}
+
+	t, height := Core.Blockchain.FindTransaction(hash)
+	if t == nil {
+		return nil, nil
+	}
+	return NewTransactionInfo(t, height), nil
+}
+
+func rpcGetBlockByHash(params json.RawMessage) (interface{}, error) {
+
+	var p struct {
+		Hash string `json:"hash"`
+		Full bool   `json:"full"`
+	}
+	if err := ParseRPCParams(params, &p); err != nil {
+		return nil, err
+	}
+	hash, err := parseHashParam(p.Hash)
+	if err != nil {
+		return nil, err
+	}
+
+	b, height := Core.Blockchain.BlockByHash(hash)
+	if b == nil {
+		return nil, nil
+	}
+	return NewBlockInfo(b, height, p.Full), nil
+}
+
+func rpcGetBlockByHeight(params json.RawMessage) (interface{}, error) {
+
+	var p struct {
+		Height int  `json:"height"`
+		Full   bool `json:"full"`
+	}
+	if err := ParseRPCParams(params, &p); err != nil {
+		return nil, err
+	}
+
+	b := Core.Blockchain.BlockByHeight(p.Height)
+	if b == nil {
+		return nil, nil
+	}
+	return NewBlockInfo(b, p.Height, p.Full), nil
+}
+
+func rpcGetChainHead(params json.RawMessage) (interface{}, error) {
+
+	b, height := Core.Blockchain.Head()
+	if b == nil {
+		return nil, nil
+	}
+	return NewBlockInfo(b, height, false), nil
+}
+
+func rpcGetPeers(params json.RawMessage) (interface{}, error) {
+
+	return Core.Network.Peers(), nil
+}
+
+func rpcGetMempoolInfo(params json.RawMessage) (interface{}, error) {
+
+	mp := Core.Blockchain.Mempool
+
+	return MempoolInfo{Size: mp.Len(), Bytes: mp.Bytes(), Capacity: mp.Capacity, MinRelayFeeRate: mp.MinRelayFeeRate}, nil
+}
+
+func rpcGetNetworkStats(params json.RawMessage) (interface{}, error) {
+
+	stats := Core.Network.Stats()
+	if Core.Blockchain != nil {
+		stats.Compact = Core.Blockchain.Relay.Stats()
+	}
+	return stats, nil
+}
+
+func rpcGetBans(params json.RawMessage) (interface{}, error) {
+
+	return Core.Network.Scores.Bans(), nil
+}
+
+func rpcGetFaults(params json.RawMessage) (interface{}, error) {
+
+	return Core.Network.Faults.Info(), nil
+}
+
+// rpcSetFaults starts a fault scenario over, no params clear the faults
+func rpcSetFaults(params json.RawMessage) (interface{}, error) {
+
+	var s FaultScenario
+	if err := ParseRPCParams(params, &s); err != nil {
+		return nil, err
+	}
+	if err := s.Validate(); err != nil {
+		return nil, &RPCError{RPC_INVALID_PARAMS, err.Error()}
+	}
+
+	Core.Network.Faults.Set(s)
+	return Core.Network.Faults.Info(), nil
+}
+
+func rpcGetRateLimits(params json.RawMessage) (interface{}, error) {
+
+	return Core.Network.Limits.Info(), nil
+}
+
+// rpcSetRateLimits replaces the limits on peers, no params lift them
+func rpcSetRateLimits(params json.RawMessage) (interface{}, error) {
+
+	var l RateLimits
+	if err := ParseRPCParams(params, &l); err != nil {
+		return nil, err
+	}
+	if err := l.Validate(); err != nil {
+		return nil, &RPCError{RPC_INVALID_PARAMS, err.Error()}
+	}
+
+	Core.Network.Limits.Set(l)
+	return Core.Network.Limits.Info(), nil
+}
@@ -0,0 +1,66 @@
+package core
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// RPCClient calls the JSON-RPC methods served by RPCServer
+type RPCClient struct {
+	URL string
+	*http.Client
+
+	id uint64
+}
+
+func NewRPCClient(url string) *RPCClient {
+
+	return &RPCClient{URL: url, Client: &http.Client{Timeout: 10 * time.Second}}
+}
+
+// Call decodes the result into result, a null result leaves it untouched and returns found false
+func (c *RPCClient) Call(method string, params interface{}, result interface{}) (found bool, err error) {
+
+	p, err := json.Marshal(params)
+	if err != nil {
+		return false, err
+	}
+	id, _ := json.Marshal(atomic.AddUint64(&c.id, 1))
+	req, err := json.Marshal(rpcRequest{JSONRPC: "2.0", Method: method, Params: p, ID: id})
+	if err != nil {
+		return false, err
+	}
+
+	resp, err := c.Post(c.URL, "application/json", bytes.NewReader(req))
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("%s: %s", c.URL, resp.Status)
+	}
+
+	var r struct {
+		Result json.RawMessage
+		Error  *RPCError
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&r); err != nil {
+		return false, err
+	}
+	if r.Error != nil {
+		return false, r.Error
+	}
+	if len(r.Result) == 0 || string(r.Result) == "null" {
+		return false, nil
+	}
+	if result == nil {
+		return true, nil
+	}
+
+	return true, json.Unmarshal(r.Result, result)
+}
@@ -0,0 +1,161 @@
+package core
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func setupRPCTest() *httptest.Server {
+
+	Core.Keypair = GenerateNewKeypair()
+	Core.Blockchain = SetupBlockchan()
+	Core.Network = SetupNetwork("127.0.0.1:0", BLOCKCHAIN_PORT)
+
+	return httptest.NewServer(NewRPCServer(""))
+}
+
+func rpcTestCall(t *testing.T, url, method string, params interface{}, result interface{}) *RPCError {
+
+	_, err := NewRPCClient(url).Call(method, params, result)
+	if err == nil {
+		return nil
+	}
+
+	rpcErr, ok := err.(*RPCError)
+	if !ok {
+		t.Fatal(err)
+	}
+	return rpcErr
+}
+
+func TestRPCSubmitAndQuery(t *testing.T) {
+
+	srv := setupRPCTest()
+	defer srv.Close()
+
+	tr := codecTestTransaction()
+	data, _ := tr.MarshalBinary()
+	hash := hex.EncodeToString(tr.Hash())
+
+	if err := rpcTestCall(t, srv.URL, "submitTransaction", map[string]string{"transaction": hex.EncodeToString(data)}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := rpcTestCall(t, srv.URL, "submitTransaction", map[string]string{"transaction": hex.EncodeToString(data)}, nil); err == nil || err.Code != RPC_REJECTED {
+		t.Error("Duplicate transaction wasn't rejected")
+	}
+
+	var mempool MempoolInfo
+	rpcTestCall(t, srv.URL, "getMempoolInfo", nil, &mempool)
+	if mempool.Size != 1 || mempool.Bytes != tr.Size() {
+		t.Error("Wrong mempool info", mempool)
+	}
+
+	var info TransactionInfo
+	rpcTestCall(t, srv.URL, "getTransaction", map[string]string{"hash": hash}, &info)
+	if info.Hash != hash || info.BlockHeight != -1 || info.Fee != tr.Header.Fee {
+		t.Error("Wrong mempool transaction", info)
+	}
+
+	Core.Blockchain.AddBlock(Core.Blockchain.AssembleBlock())
+
+	var block BlockInfo
+	rpcTestCall(t, srv.URL, "getBlockByHeight", map[string]interface{}{"height": 0, "full": true}, &block)
+	if block.TxCount != 1 || len(block.Transactions) != 1 || block.Transactions[0].Hash != hash {
+		t.Error("Wrong block by height", block)
+	}
+
+	var head BlockInfo
+	rpcTestCall(t, srv.URL, "getChainHead", nil, &head)
+	rpcTestCall(t, srv.URL, "getBlockByHash", map[string]string{"hash": head.Hash}, &block)
+	if head.Height != 0 || block.Hash != head.Hash || len(block.TransactionHashes) != 1 {
+		t.Error("Wrong chain head", head)
+	}
+
+	rpcTestCall(t, srv.URL, "getTransaction", map[string]string{"hash": hash}, &info)
+	if info.BlockHeight != 0 {
+		t.Error("Transaction not found in block")
+	}
+}
+
+func TestRPCErrors(t *testing.T) {
+
+	srv := setupRPCTest()
+	defer srv.Close()
+
+	if err := rpcTestCall(t, srv.URL, "noSuchMethod", nil, nil); err == nil || err.Code != RPC_METHOD_NOT_FOUND {
+		t.Error("Unknown method accepted")
+	}
+	if err := rpcTestCall(t, srv.URL, "getTransaction", map[string]string{"hash": "zz"}, nil); err == nil || err.Code != RPC_INVALID_PARAMS {
+		t.Error("Invalid hash accepted")
+	}
+
+	var peers []PeerInfo
+	if err := rpcTestCall(t, srv.URL, "getPeers", nil, &peers); err != nil || len(peers) != 0 {
+		t.Error("Wrong peers", peers)
+	}
+
+	var stats NetworkStats
+	if err := rpcTestCall(t, srv.URL, "getNetworkStats", nil, &stats); err != nil || stats.Peers != 0 || stats.TTL != GOSSIP_TTL {
+		t.Error("Wrong network stats", stats)
+	}
+}
+
+func TestRPCRequestLimits(t *testing.T) {
+
+	srv := setupRPCTest()
+	defer srv.Close()
+
+	post := func(body []byte) rpcResponse {
+		r, err := http.Post(srv.URL, "application/json", bytes.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer r.Body.Close()
+
+		var resp rpcResponse
+		if err := json.NewDecoder(r.Body).Decode(&resp); err != nil {
+			t.Fatal("Not a single response", err)
+		}
+		return resp
+	}
+
+	if resp := post([]byte("[]")); resp.Error == nil || resp.Error.Code != RPC_INVALID_REQUEST {
+		t.Error("Empty batch answered", resp)
+	}
+
+	huge := append([]byte(`{"jsonrpc": "2.0", "method": "submitTransaction", "params": {"transaction": "`), bytes.Repeat([]byte("00"), RPC_MAX_BODY_SIZE)...)
+	if resp := post(append(huge, `"}}`...)); resp.Error == nil || resp.Error.Code != RPC_PARSE_ERROR {
+		t.Error("Body over the limit read", resp)
+	}
+}
+
+func TestRPCReceivedTransactions(t *testing.T) {
+
+	srv := setupRPCTest()
+	defer srv.Close()
+
+	ours := CreateTransaction("ours")
+	beginTime.set(hex.EncodeToString(ours.Hash()), time.Now().Add(-time.Second))
+	before := receivedStats()
+
+	var wg sync.WaitGroup
+	for _, tr := range []*Transaction{ours, CreateTransaction("theirs"), CreateTransaction("more")} {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			receiveTransaction(tr, "peer")
+		}()
+	}
+	wg.Wait()
+
+	var stats NetworkStats
+	if err := rpcTestCall(t, srv.URL, "getNetworkStats", nil, &stats); err != nil || stats.Received.Transactions-before.Transactions != 3 || stats.Received.TotalTime-before.TotalTime < 1 {
+		t.Error("Wrong received transactions", stats.Received, err)
+	}
+}
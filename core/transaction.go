@@ -1,9 +1,7 @@
 package core
 
 import (
-	"bytes"
-	"encoding/binary"
-	"errors"
+	"fmt"
 	"reflect"
 	"time"
 
@@ -23,6 +21,8 @@ type TransactionHeader struct {
 	PayloadHash   []byte
 	PayloadLength uint32
 	Nonce         uint32
+	Fee           uint64
+	Scheme        byte
 }
 
 // Returns bytes to be sent to the network
@@ -43,9 +43,10 @@ func (t *Transaction) Hash() []byte {
 	return helpers.SHA256(headerBytes)
 }
 
-func (t *Transaction) Sign(keypair *Keypair) []byte {
+// Sign expects Header.Scheme to match the signer, set it before generating the nonce
+func (t *Transaction) Sign(signer Signer) []byte {
 
-	s, _ := keypair.Sign(t.Hash())
+	s, _ := signer.Sign(t.Hash())
 
 	return s
 }
@@ -55,7 +56,30 @@ func (t *Transaction) VerifyTransaction(pow []byte) bool {
 	headerHash := t.Hash()
 	payloadHash := helpers.SHA256(t.Payload)
 
-	return reflect.DeepEqual(payloadHash, t.Header.PayloadHash) && CheckProofOfWork(pow, headerHash) && SignatureVerify(t.Header.From, t.Signature, headerHash)
+	return reflect.DeepEqual(payloadHash, t.Header.PayloadHash) && CheckProofOfWork(pow, headerHash) && VerifySignature(t.Header.Scheme, t.Header.From, t.Signature, headerHash)
+}
+
+// Size of the marshalled transaction in bytes
+func (t *Transaction) Size() int {
+
+	th := &t.Header
+	header := bytesSize(th.From) + bytesSize(th.To) + 4 + HASH_SIZE + 4 + 4 + 8 + 1
+
+	return 1 + header + bytesSize(t.Signature) + bytesSize(t.Payload)
+}
+
+// Fee paid per byte of marshalled transaction
+func (t *Transaction) FeeRate() float64 {
+
+	return float64(t.Header.Fee) / float64(t.Size())
+}
+
+// Lowest fee the mempool accepts for this transaction, counting a full size
+// signature so it can be set before signing
+func (t *Transaction) MinRelayFee() uint64 {
+
+	size := t.Size() - bytesSize(t.Signature) + uvarintSize(NETWORK_KEY_SIZE) + NETWORK_KEY_SIZE
+	return uint64(size) * MIN_RELAY_FEE_RATE
 }
 
 func (t *Transaction) GenerateNonce(prefix []byte) uint32 {
@@ -75,64 +99,84 @@ func (t *Transaction) GenerateNonce(prefix []byte) uint32 {
 
 func (t *Transaction) MarshalBinary() ([]byte, error) {
 
-	headerBytes, _ := t.Header.MarshalBinary()
+	e := NewEncoder()
+	e.Byte(CODEC_VERSION)
+	t.encode(e)
 
-	//头部长度204字节
-	if len(headerBytes) != TRANSACTION_HEADER_SIZE {
-		return nil, errors.New("Header marshalling error")
-	}
-
-	return append(append(headerBytes, helpers.FitBytesInto(t.Signature, NETWORK_KEY_SIZE)...), t.Payload...), nil
+	return e.Result()
 }
 
+// UnmarshalBinary decodes one transaction and returns the bytes that follow it
 func (t *Transaction) UnmarshalBinary(d []byte) ([]byte, error) {
 
-	buf := bytes.NewBuffer(d)
+	dec := NewDecoder(d)
+	dec.Version("transaction version")
+	t.decode(dec)
 
-	if len(d) < TRANSACTION_HEADER_SIZE+NETWORK_KEY_SIZE {
-		return nil, errors.New("Insuficient bytes for unmarshalling transaction")
-	}
-
-	header := &TransactionHeader{}
-	if err := header.UnmarshalBinary(buf.Next(TRANSACTION_HEADER_SIZE)); err != nil {
+	if err := dec.Err(); err != nil {
 		return nil, err
 	}
+	return dec.Remaining(), nil
+}
 
-	t.Header = *header
+func (t *Transaction) encode(e *Encoder) {
+
+	t.Header.encode(e)
+	e.Bytes(t.Signature)
+	e.Bytes(t.Payload)
+}
 
-	t.Signature = helpers.StripByte(buf.Next(NETWORK_KEY_SIZE), 0)
-	t.Payload = buf.Next(int(t.Header.PayloadLength))
+func (t *Transaction) decode(d *Decoder) {
 
-	return buf.Next(helpers.MaxInt), nil
+	t.Header.decode(d)
+	t.Signature = d.Bytes("transaction signature", NETWORK_KEY_SIZE)
 
+	start := d.Offset()
+	t.Payload = d.Bytes("transaction payload", MAX_PAYLOAD_SIZE)
+	if d.Err() == nil && len(t.Payload) != int(t.Header.PayloadLength) {
+		d.off = start
+		d.fail("transaction payload", fmt.Errorf("Payload of %d bytes, header says %d", len(t.Payload), t.Header.PayloadLength))
+	}
 }
 
 func (th *TransactionHeader) MarshalBinary() ([]byte, error) {
 
-	buf := new(bytes.Buffer)
+	e := NewEncoder()
+	th.encode(e)
 
-	buf.Write(helpers.FitBytesInto(th.From, NETWORK_KEY_SIZE))
-	buf.Write(helpers.FitBytesInto(th.To, NETWORK_KEY_SIZE))
-	binary.Write(buf, binary.LittleEndian, th.Timestamp)
-	buf.Write(helpers.FitBytesInto(th.PayloadHash, 32))
-	binary.Write(buf, binary.LittleEndian, th.PayloadLength)
-	binary.Write(buf, binary.LittleEndian, th.Nonce)
+	return e.Result()
+}
 
-	return buf.Bytes(), nil
+func (th *TransactionHeader) UnmarshalBinary(d []byte) error {
 
+	dec := NewDecoder(d)
+	th.decode(dec)
+
+	return dec.Finish("transaction header")
 }
 
-func (th *TransactionHeader) UnmarshalBinary(d []byte) error {
+func (th *TransactionHeader) encode(e *Encoder) {
 
-	buf := bytes.NewBuffer(d)
-	th.From = helpers.StripByte(buf.Next(NETWORK_KEY_SIZE), 0)
-	th.To = helpers.StripByte(buf.Next(NETWORK_KEY_SIZE), 0)
-	binary.Read(bytes.NewBuffer(buf.Next(4)), binary.LittleEndian, &th.Timestamp)
-	th.PayloadHash = buf.Next(32)
-	binary.Read(bytes.NewBuffer(buf.Next(4)), binary.LittleEndian, &th.PayloadLength)
-	binary.Read(bytes.NewBuffer(buf.Next(4)), binary.LittleEndian, &th.Nonce)
+	e.Bytes(th.From)
+	e.Bytes(th.To)
+	e.Uint32(th.Timestamp)
+	e.Fixed("payload hash", th.PayloadHash, HASH_SIZE)
+	e.Uint32(th.PayloadLength)
+	e.Uint32(th.Nonce)
+	e.Uint64(th.Fee)
+	e.Byte(th.Scheme)
+}
+
+func (th *TransactionHeader) decode(d *Decoder) {
 
-	return nil
+	th.From = d.Bytes("transaction from", NETWORK_KEY_SIZE)
+	th.To = d.Bytes("transaction to", NETWORK_KEY_SIZE)
+	th.Timestamp = d.Uint32("transaction timestamp")
+	th.PayloadHash = d.Fixed("transaction payload hash", HASH_SIZE)
+	th.PayloadLength = d.Uint32("transaction payload length")
+	th.Nonce = d.Uint32("transaction nonce")
+	th.Fee = d.Uint64("transaction fee")
+	th.Scheme = d.Byte("transaction scheme")
 }
 
 type TransactionSlice []Transaction
@@ -167,35 +211,51 @@ func (slice TransactionSlice) AddTransaction(t Transaction) TransactionSlice {
 
 func (slice *TransactionSlice) MarshalBinary() ([]byte, error) {
 
-	buf := new(bytes.Buffer)
+	e := NewEncoder()
+	e.Byte(CODEC_VERSION)
+	slice.encode(e)
 
-	for _, t := range *slice {
+	return e.Result()
+}
 
-		bs, err := t.MarshalBinary()
+func (slice *TransactionSlice) UnmarshalBinary(d []byte) error {
 
-		if err != nil {
-			return nil, err
-		}
+	dec := NewDecoder(d)
+	dec.Version("transactions version")
+	slice.decode(dec)
+
+	return dec.Finish("transactions")
+}
+
+func (slice *TransactionSlice) encode(e *Encoder) {
 
-		buf.Write(bs)
+	if slice == nil {
+		e.Uvarint(0)
+		return
 	}
 
-	return buf.Bytes(), nil
+	e.Uvarint(uint64(len(*slice)))
+	for i := range *slice {
+		(*slice)[i].encode(e)
+	}
 }
 
-func (slice *TransactionSlice) UnmarshalBinary(d []byte) error {
+func (slice *TransactionSlice) decode(d *Decoder) {
 
-	remaining := d
+	start := d.Offset()
+	n := d.Uvarint("transaction count")
+	// Every transaction takes more than one byte, don't trust the count for allocation
+	if n > uint64(len(d.Remaining())) {
+		d.off = start
+		d.fail("transaction count", ErrShortBuffer)
+		return
+	}
 
-	for len(remaining) > TRANSACTION_HEADER_SIZE+NETWORK_KEY_SIZE {
-		t := new(Transaction)
-		rem, err := t.UnmarshalBinary(remaining)
+	*slice = make(TransactionSlice, 0, n)
+	for i := uint64(0); i < n && d.Err() == nil; i++ {
 
-		if err != nil {
-			return err
-		}
-		(*slice) = append((*slice), *t)
-		remaining = rem
+		t := Transaction{}
+		t.decode(d)
+		*slice = append(*slice, t)
 	}
-	return nil
 }
@@ -0,0 +1,138 @@
+package core
+
+import (
+	"sync"
+	"time"
+)
+
+// Transactions go to peers many to a message. A batch is sent once it holds
+// TX_BATCH_SIZE bytes of transactions, or TX_BATCH_INTERVAL after its first
+// one. Single sends every transaction in a message of its own.
+
+const (
+	TX_BATCH_SIZE     = 256 * 1024 // bytes of transactions a batch is sent at
+	TX_BATCH_INTERVAL = 50         // milliseconds a transaction waits for its batch
+)
+
+type TxBatcher struct {
+	Single bool // every transaction is sent alone, to compare the overhead
+
+	lock    sync.Mutex
+	sending sync.Mutex // keeps batches in order once they're out of the lock
+	txs     TransactionSlice
+	bytes   int
+	timer   *time.Timer
+	send    func(TransactionSlice)
+	stats   TxBatchStats
+}
+
+type TxBatchStats struct {
+	Batches      int `json:"batches"`
+	Transactions int `json:"transactions"`
+}
+
+// NewTxBatcher calls send with every batch, one at a time
+func NewTxBatcher(send func(TransactionSlice)) *TxBatcher {
+
+	return &TxBatcher{send: send}
+}
+
+func (b *TxBatcher) Add(t *Transaction) {
+
+	b.lock.Lock()
+
+	b.txs = append(b.txs, *t)
+	b.bytes += t.Size()
+	if b.Single || b.bytes >= TX_BATCH_SIZE {
+		b.flush()
+		return
+	}
+	if b.timer == nil {
+		b.timer = time.AfterFunc(time.Millisecond*TX_BATCH_INTERVAL, b.Flush)
+	}
+	b.lock.Unlock()
+}
+
+// Flush sends the waiting transactions now
+func (b *TxBatcher) Flush() {
+
+	b.lock.Lock()
+	b.flush()
+}
+
+// flush takes the waiting transactions and releases the lock before sending
+// them, so adding to the next batch doesn't wait for the network
+func (b *TxBatcher) flush() {
+
+	if b.timer != nil {
+		b.timer.Stop()
+		b.timer = nil
+	}
+	txs := b.txs
+	b.txs, b.bytes = nil, 0
+	if len(txs) == 0 {
+		b.lock.Unlock()
+		return
+	}
+	b.stats.Batches++
+	b.stats.Transactions += len(txs)
+
+	b.sending.Lock()
+	defer b.sending.Unlock()
+	b.lock.Unlock()
+
+	b.send(txs)
+}
+
+func (b *TxBatcher) Stats() TxBatchStats {
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	return b.stats
+}
+
+// transactionsMessage carries txs, alone in a send transaction message when
+// there's just one
+func transactionsMessage(txs TransactionSlice) *Message {
+
+	if len(txs) == 1 {
+		m := NewMessage(MESSAGE_SEND_TRANSACTION)
+		m.Data, _ = txs[0].MarshalBinary()
+		return m
+	}
+	m := NewMessage(MESSAGE_SEND_TRANSACTIONS)
+	m.Data, _ = txs.MarshalBinary()
+	return m
+}
+
+// broadcastTransactions gossips a batch of our transactions
+func (n *Network) broadcastTransactions(txs TransactionSlice) {
+
+	n.BroadcastQueue <- *transactionsMessage(txs)
+}
+
+// ReplyTransactions sends txs to the peer that asked for them, batched
+// unless it doesn't handle batches or Single is set
+func (n *Network) ReplyTransactions(peer string, txs TransactionSlice) {
+
+	nodesLock.RLock()
+	node := n.Nodes[peer]
+	nodesLock.RUnlock()
+	if node == nil {
+		return
+	}
+
+	single := n.TxBatch.Single || !node.Supports(MESSAGE_SEND_TRANSACTIONS)
+	for len(txs) > 0 {
+		end, size := 1, txs[0].Size()
+		for !single && end < len(txs) && size+txs[end].Size() <= TX_BATCH_SIZE {
+			size += txs[end].Size()
+			end++
+		}
+		if node.Send(*transactionsMessage(txs[:end]), QUEUE_DROP) != nil {
+			return
+		}
+		txs = txs[end:]
+	}
+}
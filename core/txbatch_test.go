@@ -0,0 +1,147 @@
+package core
+
+import (
+	"bufio"
+	"sync"
+	"testing"
+	"time"
+)
+
+// txBatchTestSink collects the batches a TxBatcher sends
+type txBatchTestSink struct {
+	lock    sync.Mutex
+	batches []TransactionSlice
+}
+
+func (s *txBatchTestSink) send(txs TransactionSlice) {
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.batches = append(s.batches, txs)
+}
+
+func (s *txBatchTestSink) sizes() []int {
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	sizes := []int{}
+	for _, b := range s.batches {
+		sizes = append(sizes, len(b))
+	}
+	return sizes
+}
+
+func TestTxBatcherFlushesBySize(t *testing.T) {
+
+	sink := &txBatchTestSink{}
+	b := NewTxBatcher(sink.send)
+
+	tr := mempoolTestTransaction(10000, 1)
+	n := TX_BATCH_SIZE/tr.Size() + 1
+	for i := 0; i < n; i++ {
+		b.Add(tr)
+	}
+	if sizes := sink.sizes(); len(sizes) != 1 || sizes[0] != n {
+		t.Error("Full batch not sent", sizes)
+	}
+	if s := b.Stats(); s.Batches != 1 || s.Transactions != n {
+		t.Error("Wrong stats", s)
+	}
+}
+
+func TestTxBatcherFlushesByDeadline(t *testing.T) {
+
+	sink := &txBatchTestSink{}
+	b := NewTxBatcher(sink.send)
+
+	b.Add(mempoolTestTransaction(100, 1))
+	b.Add(mempoolTestTransaction(100, 1))
+	if sizes := sink.sizes(); len(sizes) != 0 {
+		t.Fatal("Batch sent before its deadline", sizes)
+	}
+	netTestWait(t, "batch", func() bool { return len(sink.sizes()) == 1 })
+	if sizes := sink.sizes(); sizes[0] != 2 {
+		t.Error("Transactions not sent together", sizes)
+	}
+
+	b.Single = true
+	b.Add(mempoolTestTransaction(100, 1))
+	b.Add(mempoolTestTransaction(100, 1))
+	if sizes := sink.sizes(); len(sizes) != 3 || sizes[1] != 1 || sizes[2] != 1 {
+		t.Error("Transactions not sent alone", sizes)
+	}
+}
+
+func TestTransactionsMessage(t *testing.T) {
+
+	a, b := codecTestTransaction(), codecTestTransaction()
+	if m := transactionsMessage(TransactionSlice{*a}); m.Identifier != MESSAGE_SEND_TRANSACTION {
+		t.Error("Single transaction batched", MessageName(m.Identifier))
+	}
+
+	m := transactionsMessage(TransactionSlice{*a, *b})
+	var txs TransactionSlice
+	if err := txs.UnmarshalBinary(m.Data); err != nil || m.Identifier != MESSAGE_SEND_TRANSACTIONS || len(txs) != 2 || string(txs[1].Hash()) != string(b.Hash()) {
+		t.Error("Transactions not batched", MessageName(m.Identifier), err)
+	}
+}
+
+func TestReplyTransactions(t *testing.T) {
+
+	Core.Network = SetupNetwork("127.0.0.1:0", BLOCKCHAIN_PORT)
+	l := netTestListener(t)
+	client, server := netTestPair(t, l)
+	defer client.Close()
+	old, oldServer := netTestPair(t, l)
+	defer old.Close()
+
+	Core.Nodes.AddNode(&Node{TCPConn: server, lastSeen: int(time.Now().Unix()), inbound: true})
+	oldNode := &Node{TCPConn: oldServer, lastSeen: int(time.Now().Unix()), inbound: true, version: &PeerVersion{Capabilities: requiredMessages}}
+	Core.Nodes.AddNode(oldNode)
+
+	txs := TransactionSlice{*codecTestTransaction(), *codecTestTransaction()}
+	Core.Network.ReplyTransactions(client.LocalAddr().String(), txs)
+	Core.Network.ReplyTransactions(oldNode.Key(), txs)
+
+	client.SetReadDeadline(time.Now().Add(time.Second * 5))
+	if m, err := ReadMessage(bufio.NewReader(client)); err != nil || m.Identifier != MESSAGE_SEND_TRANSACTIONS {
+		t.Error("Transactions not batched", m, err)
+	}
+	r := bufio.NewReader(old)
+	old.SetReadDeadline(time.Now().Add(time.Second * 5))
+	for range txs {
+		if m, err := ReadMessage(r); err != nil || m.Identifier != MESSAGE_SEND_TRANSACTION {
+			t.Error("Batch sent to a peer without batches", m, err)
+		}
+	}
+}
+
+func TestTxBatcherSendsOutsideLock(t *testing.T) {
+
+	release := make(chan struct{})
+	sink := &txBatchTestSink{}
+	b := NewTxBatcher(func(txs TransactionSlice) {
+		<-release
+		sink.send(txs)
+	})
+	b.Single = true
+	go b.Add(mempoolTestTransaction(100, 1))
+	netTestWait(t, "send", func() bool { return b.Stats().Batches == 1 })
+
+	// Adding to the next batch doesn't wait for the blocked send
+	b.Single = false
+	added := make(chan struct{})
+	go func() {
+		b.Add(mempoolTestTransaction(100, 1))
+		close(added)
+	}()
+	select {
+	case <-added:
+	case <-time.After(time.Second):
+		t.Fatal("Add waited for the network")
+	}
+	close(release)
+	netTestWait(t, "batches", func() bool { return len(sink.sizes()) == 2 })
+}
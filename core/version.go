@@ -0,0 +1,156 @@
+package core
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+	"time"
+)
+
+// After the key handshake both ends send a version message, then check the
+// other's. A peer on another protocol, chain, genesis or consensus is sent a
+// reject with the reason and disconnected. Messages go only to peers that
+// listed their identifier, so new ones can be added without breaking older
+// peers.
+
+const (
+	VERSION_CONSENSUS_SIZE    = 32  // max length of the consensus name
+	VERSION_CAPABILITIES_SIZE = 256 // one byte per message identifier
+)
+
+var (
+	ErrIncompatiblePeer = errors.New("Incompatible peer")
+	ErrPeerRejected     = errors.New("Rejected by peer")
+)
+
+// requiredMessages are handled by every peer we accept
+var requiredMessages = []byte{MESSAGE_SEND_TRANSACTION, MESSAGE_SEND_BLOCK}
+
+type PeerVersion struct {
+	Protocol     uint32
+	ChainID      uint32
+	Genesis      []byte // hash of the block at height 0, nil while the chain is empty
+	Consensus    string
+	Capabilities []byte // identifiers of the messages it handles
+}
+
+// LocalVersion describes this node
+func LocalVersion() *PeerVersion {
+
+	v := &PeerVersion{Protocol: PROTOCOL_VERSION, ChainID: Core.Network.ChainID}
+	for id := range messageNames {
+		// Peers only compress to nodes listing compressed messages
+		if id != MESSAGE_COMPRESSED || Core.Network.Compress {
+			v.Capabilities = append(v.Capabilities, id)
+		}
+	}
+	slices.Sort(v.Capabilities)
+
+	if Core.Blockchain != nil {
+		if b := Core.Blockchain.BlockByHeight(0); b != nil {
+			v.Genesis = b.Hash()
+		}
+		v.Consensus = Core.Blockchain.Consensus.Name()
+	}
+	return v
+}
+
+func (v *PeerVersion) MarshalBinary() ([]byte, error) {
+
+	e := NewEncoder()
+	e.Byte(CODEC_VERSION)
+	e.Uint32(v.Protocol)
+	e.Uint32(v.ChainID)
+	e.Fixed("genesis", v.Genesis, HASH_SIZE)
+	e.Bytes([]byte(v.Consensus))
+	e.Bytes(v.Capabilities)
+
+	return e.Result()
+}
+
+// UnmarshalBinary leaves fields newer protocols append unread
+func (v *PeerVersion) UnmarshalBinary(b []byte) error {
+
+	d := NewDecoder(b)
+	d.Version("version codec")
+	v.Protocol = d.Uint32("version protocol")
+	v.ChainID = d.Uint32("version chain id")
+	v.Genesis = d.Fixed("version genesis", HASH_SIZE)
+	v.Consensus = string(d.Bytes("version consensus", VERSION_CONSENSUS_SIZE))
+	v.Capabilities = d.Bytes("version capabilities", VERSION_CAPABILITIES_SIZE)
+
+	if bytes.Equal(v.Genesis, make([]byte, HASH_SIZE)) {
+		v.Genesis = nil
+	}
+	if v.Protocol > PROTOCOL_VERSION {
+		return d.Err()
+	}
+	return d.Finish("version")
+}
+
+// Compatible tells why a peer running v can't join us, nil when it can
+func (v *PeerVersion) Compatible(ours *PeerVersion) error {
+
+	switch {
+	case v.Protocol < MIN_PROTOCOL_VERSION:
+		return fmt.Errorf("%w: protocol %d, oldest accepted is %d", ErrIncompatiblePeer, v.Protocol, MIN_PROTOCOL_VERSION)
+	case v.ChainID != ours.ChainID:
+		return fmt.Errorf("%w: chain %d, ours is %d", ErrIncompatiblePeer, v.ChainID, ours.ChainID)
+	case v.Genesis != nil && ours.Genesis != nil && !bytes.Equal(v.Genesis, ours.Genesis):
+		return fmt.Errorf("%w: genesis %x, ours is %x", ErrIncompatiblePeer, v.Genesis, ours.Genesis)
+	case v.Consensus != ours.Consensus:
+		return fmt.Errorf("%w: consensus %q, ours is %q", ErrIncompatiblePeer, v.Consensus, ours.Consensus)
+	}
+	for _, id := range requiredMessages {
+		if !v.Supports(id) {
+			return fmt.Errorf("%w: doesn't handle %s", ErrIncompatiblePeer, MessageName(id))
+		}
+	}
+	return nil
+}
+
+func (v *PeerVersion) Supports(id byte) bool {
+
+	return bytes.IndexByte(v.Capabilities, id) >= 0
+}
+
+// ExchangeVersions sends ours and checks the peer's, the first message read
+// from r. Incompatible peers are sent a reject with the reason.
+func ExchangeVersions(conn net.Conn, r *bufio.Reader, ours *PeerVersion) (*PeerVersion, error) {
+
+	conn.SetDeadline(time.Now().Add(time.Second * PEER_HANDSHAKE_TIMEOUT))
+	defer conn.SetDeadline(time.Time{})
+
+	b, err := ours.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	if err := WriteMessage(conn, Message{Identifier: MESSAGE_VERSION, Data: b}); err != nil {
+		return nil, err
+	}
+
+	m, err := ReadMessage(r)
+	if err != nil {
+		return nil, err
+	}
+	switch m.Identifier {
+	case MESSAGE_VERSION:
+	case MESSAGE_REJECT:
+		return nil, fmt.Errorf("%w: %s", ErrPeerRejected, m.Data)
+	default:
+		return nil, fmt.Errorf("%w: sent %s before its version", ErrIncompatiblePeer, MessageName(m.Identifier))
+	}
+
+	v := new(PeerVersion)
+	if err = v.UnmarshalBinary(m.Data); err == nil {
+		err = v.Compatible(ours)
+	}
+	if err != nil {
+		WriteMessage(conn, Message{Identifier: MESSAGE_REJECT, Data: []byte(err.Error())})
+		return nil, err
+	}
+	return v, nil
+}
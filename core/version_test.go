@@ -0,0 +1,128 @@
+package core
+
+import (
+	"bufio"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPeerVersionRoundTrip(t *testing.T) {
+
+	v := &PeerVersion{Protocol: PROTOCOL_VERSION, ChainID: 7, Genesis: make([]byte, HASH_SIZE), Consensus: CONSENSUS_PBFT, Capabilities: []byte{MESSAGE_SEND_TRANSACTION, MESSAGE_SEND_BLOCK}}
+	v.Genesis[0] = 1
+
+	b, err := v.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded := new(PeerVersion)
+	if err := decoded.UnmarshalBinary(b); err != nil || !reflect.DeepEqual(v, decoded) {
+		t.Error("Version changed in a round trip", decoded, err)
+	}
+
+	// Newer peers may append fields, ours may not
+	if err := decoded.UnmarshalBinary(append(b, 0)); err == nil {
+		t.Error("Trailing data accepted at our protocol")
+	}
+	v.Protocol = PROTOCOL_VERSION + 1
+	b, _ = v.MarshalBinary()
+	if err := decoded.UnmarshalBinary(append(b, 0)); err != nil {
+		t.Error("Field of a newer protocol rejected", err)
+	}
+}
+
+func TestPeerVersionCompatible(t *testing.T) {
+
+	ours := &PeerVersion{Protocol: PROTOCOL_VERSION, ChainID: 1, Consensus: CONSENSUS_POW, Capabilities: requiredMessages}
+
+	for reason, v := range map[string]PeerVersion{
+		"":          {Protocol: PROTOCOL_VERSION, ChainID: 1, Genesis: make([]byte, HASH_SIZE), Consensus: CONSENSUS_POW, Capabilities: requiredMessages},
+		"protocol":  {Protocol: MIN_PROTOCOL_VERSION - 1, ChainID: 1, Consensus: CONSENSUS_POW, Capabilities: requiredMessages},
+		"chain":     {Protocol: PROTOCOL_VERSION, ChainID: 2, Consensus: CONSENSUS_POW, Capabilities: requiredMessages},
+		"consensus": {Protocol: PROTOCOL_VERSION, ChainID: 1, Consensus: CONSENSUS_POA, Capabilities: requiredMessages},
+		"sendBlock": {Protocol: PROTOCOL_VERSION, ChainID: 1, Consensus: CONSENSUS_POW, Capabilities: []byte{MESSAGE_SEND_TRANSACTION}},
+	} {
+		err := v.Compatible(ours)
+		if reason == "" && err != nil || reason != "" && (err == nil || !strings.Contains(err.Error(), reason)) {
+			t.Errorf("Wrong check for %q: %v", reason, err)
+		}
+	}
+
+	// Chains that haven't started yet go together, different genesis don't
+	ours.Genesis = make([]byte, HASH_SIZE)
+	ours.Genesis[0] = 1
+	v := PeerVersion{Protocol: PROTOCOL_VERSION, ChainID: 1, Genesis: make([]byte, HASH_SIZE), Consensus: CONSENSUS_POW, Capabilities: requiredMessages}
+	if err := v.Compatible(ours); err == nil || !strings.Contains(err.Error(), "genesis") {
+		t.Error("Different genesis accepted", err)
+	}
+}
+
+func TestExchangeVersions(t *testing.T) {
+
+	l := netTestListener(t)
+	client, server := netTestPair(t, l)
+	defer client.Close()
+	defer server.Close()
+
+	ours := &PeerVersion{Protocol: PROTOCOL_VERSION, ChainID: 1, Consensus: CONSENSUS_POW, Capabilities: requiredMessages}
+	theirs := &PeerVersion{Protocol: PROTOCOL_VERSION, ChainID: 1, Consensus: CONSENSUS_POW, Capabilities: []byte{MESSAGE_SEND_TRANSACTION, MESSAGE_SEND_BLOCK, MESSAGE_PING}}
+	old := &PeerVersion{Protocol: PROTOCOL_VERSION, ChainID: 1, Consensus: CONSENSUS_POW, Capabilities: []byte{MESSAGE_SEND_TRANSACTION}}
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := ExchangeVersions(server, bufio.NewReader(server), theirs)
+		done <- err
+	}()
+	v, err := ExchangeVersions(client, bufio.NewReader(client), ours)
+	if err != nil || <-done != nil {
+		t.Fatal("Compatible peers rejected", err)
+	}
+	if !v.Supports(MESSAGE_PING) || v.Supports(MESSAGE_PBFT_COMMIT) {
+		t.Error("Wrong capabilities", v.Capabilities)
+	}
+
+	// Only one end finds the other incompatible, the other reads the reason
+	client, server = netTestPair(t, l)
+	defer client.Close()
+	defer server.Close()
+
+	go func() {
+		_, err := ExchangeVersions(server, bufio.NewReader(server), ours)
+		done <- err
+	}()
+	r := bufio.NewReader(client)
+	if _, err := ExchangeVersions(client, r, old); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-done; !errors.Is(err, ErrIncompatiblePeer) {
+		t.Error("Peer without a required message accepted", err)
+	}
+	client.SetReadDeadline(time.Now().Add(time.Second * 5))
+	if m, err := ReadMessage(r); err != nil || m.Identifier != MESSAGE_REJECT || !strings.Contains(string(m.Data), "sendBlock") {
+		t.Error("No reason given", m, err)
+	}
+}
+
+func TestCapabilitiesLimitMessages(t *testing.T) {
+
+	Core.Network = SetupNetwork("127.0.0.1:0", BLOCKCHAIN_PORT)
+	l := netTestListener(t)
+	client, server := netTestPair(t, l)
+	defer client.Close()
+
+	node := &Node{TCPConn: server, lastSeen: int(time.Now().Unix()), inbound: true, version: &PeerVersion{Capabilities: requiredMessages}}
+	Core.Nodes.AddNode(node)
+
+	Core.Network.heartbeat()
+	Core.Network.send(Message{Identifier: MESSAGE_PBFT_COMMIT}, "")
+	Core.Network.send(Message{Identifier: MESSAGE_SEND_BLOCK}, "")
+
+	client.SetReadDeadline(time.Now().Add(time.Second * 5))
+	m, err := ReadMessage(bufio.NewReader(client))
+	if err != nil || m.Identifier != MESSAGE_SEND_BLOCK {
+		t.Error("Peer sent a message it doesn't handle", m, err)
+	}
+}
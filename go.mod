@@ -1,6 +1,6 @@
 module tps-testing
 
-go 1.18
+go 1.24
 
 require (
 	github.com/izqui/functional v0.0.0-20160607200733-33eb58a9d05d
@@ -0,0 +1,43 @@
+#!/usr/bin/env bash
+# Runs N nodes on this machine, each with its own keys, blocks, peers and report
+# usage: [CONSENSUS=pow|poa|pbft] [FANOUT=n] [TTL=n] [FAULTS=scenario.json] [RATE_LIMITS=limits.json] [PLAINTEXT=true] [CHAIN_ID=n] [FULL_BLOCKS=true] [PUSH_TXS=true] [SINGLE_TXS=true] [COMPRESS=true] scripts/start-cluster.sh [nodes] [datadir]
+set -euo pipefail
+SCRIPT_DIR="$(cd "$(dirname "$0")" && pwd)"
+ROOT_DIR="$(cd "$SCRIPT_DIR/.." && pwd)"
+
+NODES="${1:-4}"
+DATADIR="${2:-$ROOT_DIR/cluster}"
+P2P_PORT=19920
+RPC_PORT=19930
+CONSENSUS="${CONSENSUS:-pow}"
+FANOUT="${FANOUT:-0}"
+TTL="${TTL:-1}"
+FAULTS="${FAULTS:-}"
+RATE_LIMITS="${RATE_LIMITS:-}"
+PLAINTEXT="${PLAINTEXT:-false}"
+CHAIN_ID="${CHAIN_ID:-1}"
+FULL_BLOCKS="${FULL_BLOCKS:-false}"
+PUSH_TXS="${PUSH_TXS:-false}"
+SINGLE_TXS="${SINGLE_TXS:-false}"
+COMPRESS="${COMPRESS:-false}"
+
+# Nodes can't prompt for the passphrase in the background
+: "${BLOCKCHAIN_KEYSTORE_PASSPHRASE:?set BLOCKCHAIN_KEYSTORE_PASSPHRASE to encrypt the node keys}"
+export BLOCKCHAIN_KEYSTORE_PASSPHRASE
+
+cd "$ROOT_DIR"
+go build -o "$DATADIR/node" ./cli
+
+if [ ! -d "$DATADIR/node0" ]; then
+  echo "Creating $NODES identities in $DATADIR..."
+  "$DATADIR/node" keygen -n "$NODES" -datadir "$DATADIR" -ip "127.0.0.1:$P2P_PORT"
+fi
+
+for ((i = 0; i < NODES; i++)); do
+  dir="$DATADIR/node$i"
+  nohup "$DATADIR/node" node -consensus "$CONSENSUS" -fanout "$FANOUT" -ttl "$TTL" -faults "$FAULTS" -ratelimits "$RATE_LIMITS" -plaintext="$PLAINTEXT" -chainid "$CHAIN_ID" -fullblocks="$FULL_BLOCKS" -pushtxs="$PUSH_TXS" -singletxs="$SINGLE_TXS" -compress="$COMPRESS" -datadir "$dir" -ip "127.0.0.1:$((P2P_PORT + i))" -rpc "127.0.0.1:$((RPC_PORT + i))" \
+    < /dev/null > "$dir/node.log" 2>&1 &
+  echo "node$i running (pid=$!, rpc=127.0.0.1:$((RPC_PORT + i)), log=$dir/node.log)"
+done
+
+echo "Generate load with: $DATADIR/node loadgen -target http://127.0.0.1:$RPC_PORT"
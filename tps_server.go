@@ -2,21 +2,35 @@ package main
 
 import (
 	"encoding/json"
+	"flag"
 	"fmt"
+	"html/template"
 	"io/ioutil"
 	"log"
 	"net/http"
 	"os"
+	"path/filepath"
 	"regexp"
 	"strconv"
 	"strings"
+	"time"
+
+	"tps-testing/core"
 )
 
+var nodeRPC = flag.String("node", fmt.Sprintf("http://127.0.0.1:%s", core.RPC_PORT), "JSON-RPC endpoint of the node backing the block explorer")
+
+var dataDir = flag.String("datadir", "", "data directory of the node whose TPS report is served (default ~/.blockchain)")
+
+var node *core.RPCClient
+
 type BlockEntry struct {
 	Timestamp   string  `json:"timestamp"`
 	Block       int     `json:"block"`
 	Tx          int     `json:"tx"`
 	PerBlockTPS float64 `json:"per_block_tps"`
+	Hash        string  `json:"hash,omitempty"`
+	ExplorerURL string  `json:"explorer_url,omitempty"`
 }
 
 type Metrics struct {
@@ -27,6 +41,10 @@ type Metrics struct {
 	LastBlocks  []BlockEntry `json:"last_blocks"`
 }
 
+func reportFile() string {
+	return filepath.Join(core.DataDirectory(*dataDir), core.BLOCKCHAIN_REPORT_FILENAME)
+}
+
 func parseReport(path string) (*Metrics, error) {
 	b, err := ioutil.ReadFile(path)
 	if err != nil {
@@ -43,7 +61,7 @@ func parseReport(path string) (*Metrics, error) {
 
 	m := &Metrics{}
 	// Simple parse: look for Dump line or block lines
-	reBlock := regexp.MustCompile(`\[(.+)\] Block (\d+): tx=(\d+):?, per_block_tps=([0-9.]+), total_tx=(\d+), avg_tps=([0-9.]+)`)
+	reBlock := regexp.MustCompile(`\[(.+)\] Block (\d+): tx=(\d+):?, per_block_tps=([0-9.]+), total_tx=(\d+), avg_tps=([0-9.]+)(?:, hash=([0-9a-f]+))?`)
 	reDump := regexp.MustCompile(`--- Dump at (.+): total_blocks=(\d+) total_txs=(\d+) total_time=([0-9.]+) avg_tps=([0-9.]+) ---`)
 
 	for _, l := range last {
@@ -51,7 +69,11 @@ func parseReport(path string) (*Metrics, error) {
 			blockNum, _ := strconv.Atoi(m2[2])
 			txNum, _ := strconv.Atoi(m2[3])
 			per, _ := strconv.ParseFloat(m2[4], 64)
-			m.LastBlocks = append(m.LastBlocks, BlockEntry{Timestamp: m2[1], Block: blockNum, Tx: txNum, PerBlockTPS: per})
+			entry := BlockEntry{Timestamp: m2[1], Block: blockNum, Tx: txNum, PerBlockTPS: per, Hash: m2[7]}
+			if entry.Hash != "" {
+				entry.ExplorerURL = "/explorer/block/" + entry.Hash
+			}
+			m.LastBlocks = append(m.LastBlocks, entry)
 		}
 		if m3 := reDump.FindStringSubmatch(l); m3 != nil {
 			m.TotalBlocks, _ = strconv.Atoi(m3[2])
@@ -79,7 +101,7 @@ func parseReport(path string) (*Metrics, error) {
 }
 
 func metricsHandler(w http.ResponseWriter, r *http.Request) {
-	m, err := parseReport("tps_report.log")
+	m, err := parseReport(reportFile())
 	if err != nil {
 		http.Error(w, fmt.Sprintf("error reading report: %v", err), http.StatusInternalServerError)
 		return
@@ -88,8 +110,190 @@ func metricsHandler(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(m)
 }
 
+// Block explorer, backed by the node JSON-RPC API
+
+const explorerBlocksPerPage = 25
+
+var explorerTemplates = template.Must(template.New("layout").Funcs(template.FuncMap{
+	"time": func(ts uint32) string { return time.Unix(int64(ts), 0).Format(time.RFC3339) },
+}).Parse(`{{define "header"}}<!DOCTYPE html>
+<html><head><meta charset="utf-8"><title>{{.}}</title>
+<style>body{font-family:monospace;margin:2em}table{border-collapse:collapse}td,th{padding:2px 10px;text-align:left}tr:nth-child(even){background:#f4f4f4}.err{color:#b00}</style>
+</head><body><a href="/">Dashboard</a> | <a href="/explorer/">Blocks</a><h2>{{.}}</h2>{{end}}
+{{define "footer"}}</body></html>{{end}}
+
+{{define "blocks"}}{{template "header" "Blocks"}}
+<table><tr><th>Height</th><th>Hash</th><th>Transactions</th><th>Time</th></tr>
+{{range .Blocks}}<tr><td>{{.Height}}</td><td><a href="/explorer/block/{{.Hash}}">{{.Hash}}</a></td><td>{{.TxCount}}</td><td>{{time .Timestamp}}</td></tr>
+{{else}}<tr><td colspan="4">No blocks yet</td></tr>{{end}}</table>
+{{if ge .Older 0}}<p><a href="/explorer/?before={{.Older}}">Older blocks</a></p>{{end}}
+{{template "footer"}}{{end}}
+
+{{define "block"}}{{template "header" "Block"}}
+<table>
+<tr><td>Height</td><td>{{.Height}}</td></tr>
+<tr><td>Hash</td><td>{{.Hash}}</td></tr>
+<tr><td>Previous</td><td><a href="/explorer/block/{{.PrevBlock}}">{{.PrevBlock}}</a></td></tr>
+<tr><td>Merkel root</td><td>{{.MerkelRoot}}</td></tr>
+<tr><td>Origin</td><td>{{.Origin}}</td></tr>
+<tr><td>Time</td><td>{{time .Timestamp}}</td></tr>
+<tr><td>Nonce</td><td>{{.Nonce}}</td></tr>
+<tr><td>Signature</td><td>{{.Scheme}} {{.Signature}}</td></tr>
+<tr><td>Transactions</td><td>{{.TxCount}}</td></tr>
+</table>
+<h3>Transactions</h3>
+<table><tr><th>Hash</th><th>From</th><th>To</th><th>Payload</th><th>Fee rate</th></tr>
+{{range .Transactions}}<tr><td><a href="/explorer/tx/{{.Hash}}">{{.Hash}}</a></td><td>{{.From}}</td><td>{{.To}}</td><td>{{.PayloadSize}} B</td><td>{{printf "%.2f" .FeeRate}}</td></tr>
+{{end}}</table>
+{{template "footer"}}{{end}}
+
+{{define "tx"}}{{template "header" "Transaction"}}
+<table>
+<tr><td>Hash</td><td>{{.Hash}}</td></tr>
+<tr><td>Block</td><td>{{if ge .BlockHeight 0}}<a href="/explorer/block/{{.BlockHeight}}">{{.BlockHeight}}</a>{{else}}mempool{{end}}</td></tr>
+<tr><td>From</td><td>{{.From}}</td></tr>
+<tr><td>To</td><td>{{.To}}</td></tr>
+<tr><td>Time</td><td>{{time .Timestamp}}</td></tr>
+<tr><td>Payload size</td><td>{{.PayloadSize}} B</td></tr>
+<tr><td>Payload hash</td><td>{{.PayloadHash}}</td></tr>
+<tr><td>Nonce</td><td>{{.Nonce}}</td></tr>
+<tr><td>Fee</td><td>{{.Fee}} ({{printf "%.2f" .FeeRate}}/B)</td></tr>
+<tr><td>Signature</td><td>{{.Scheme}} {{.Signature}}</td></tr>
+<tr><td>Size</td><td>{{.Size}} B</td></tr>
+</table>
+{{template "footer"}}{{end}}
+
+{{define "error"}}{{template "header" "Explorer"}}<p class="err">{{.}}</p>{{template "footer"}}{{end}}
+
+{{define "dashboard"}}{{template "header" "TPS"}}
+<p>Average TPS: {{printf "%.2f" .AvgTPS}}, blocks: {{.TotalBlocks}}, transactions: {{.TotalTxs}}</p>
+<table><tr><th>Time</th><th>Block</th><th>Transactions</th><th>Per block TPS</th></tr>
+{{range .LastBlocks}}<tr><td>{{.Timestamp}}</td><td>{{if .ExplorerURL}}<a href="{{.ExplorerURL}}">{{.Block}}</a>{{else}}{{.Block}}{{end}}</td><td>{{.Tx}}</td><td>{{printf "%.2f" .PerBlockTPS}}</td></tr>
+{{end}}</table>
+{{template "footer"}}{{end}}
+`))
+
+func renderExplorer(w http.ResponseWriter, name string, data interface{}) {
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := explorerTemplates.ExecuteTemplate(w, name, data); err != nil {
+		log.Println("explorer:", err)
+	}
+}
+
+func explorerError(w http.ResponseWriter, status int, err error) {
+
+	w.WriteHeader(status)
+	renderExplorer(w, "error", err.Error())
+}
+
+func explorerBlocksHandler(w http.ResponseWriter, r *http.Request) {
+
+	var head core.BlockInfo
+	found, err := node.Call("getChainHead", nil, &head)
+	if err != nil {
+		explorerError(w, http.StatusBadGateway, err)
+		return
+	}
+
+	top := head.Height
+	if before, err := strconv.Atoi(r.URL.Query().Get("before")); err == nil && before <= top {
+		top = before - 1
+	}
+	if !found {
+		top = -1
+	}
+
+	page := struct {
+		Blocks []core.BlockInfo
+		Older  int
+	}{Older: -1}
+
+	for h := top; h >= 0 && h > top-explorerBlocksPerPage; h-- {
+		var b core.BlockInfo
+		if _, err := node.Call("getBlockByHeight", map[string]int{"height": h}, &b); err != nil {
+			explorerError(w, http.StatusBadGateway, err)
+			return
+		}
+		page.Blocks = append(page.Blocks, b)
+	}
+	if top-explorerBlocksPerPage >= 0 {
+		page.Older = top - explorerBlocksPerPage + 1
+	}
+
+	renderExplorer(w, "blocks", page)
+}
+
+// explorerBlockHandler serves /explorer/block/<hash or height>
+func explorerBlockHandler(w http.ResponseWriter, r *http.Request) {
+
+	id := strings.TrimPrefix(r.URL.Path, "/explorer/block/")
+
+	var b core.BlockInfo
+	var found bool
+	var err error
+	if height, errAtoi := strconv.Atoi(id); errAtoi == nil && len(id) < 64 {
+		found, err = node.Call("getBlockByHeight", map[string]interface{}{"height": height, "full": true}, &b)
+	} else {
+		found, err = node.Call("getBlockByHash", map[string]interface{}{"hash": id, "full": true}, &b)
+	}
+
+	if err != nil {
+		explorerError(w, http.StatusBadGateway, err)
+		return
+	}
+	if !found {
+		explorerError(w, http.StatusNotFound, fmt.Errorf("Block %s not found", id))
+		return
+	}
+
+	renderExplorer(w, "block", b)
+}
+
+// explorerTxHandler serves /explorer/tx/<hash>
+func explorerTxHandler(w http.ResponseWriter, r *http.Request) {
+
+	hash := strings.TrimPrefix(r.URL.Path, "/explorer/tx/")
+
+	var t core.TransactionInfo
+	found, err := node.Call("getTransaction", map[string]string{"hash": hash}, &t)
+	if err != nil {
+		explorerError(w, http.StatusBadGateway, err)
+		return
+	}
+	if !found {
+		explorerError(w, http.StatusNotFound, fmt.Errorf("Transaction %s not found", hash))
+		return
+	}
+
+	renderExplorer(w, "tx", t)
+}
+
+// dashboardHandler is a plain page used when the txps UI hasn't been built
+func dashboardHandler(w http.ResponseWriter, r *http.Request) {
+
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+
+	m, err := parseReport(reportFile())
+	if err != nil {
+		explorerError(w, http.StatusInternalServerError, fmt.Errorf("error reading report: %v", err))
+		return
+	}
+
+	renderExplorer(w, "dashboard", m)
+}
+
 func main() {
+	flag.Parse()
+	node = core.NewRPCClient(*nodeRPC)
+
 	http.HandleFunc("/metrics", metricsHandler)
+	http.HandleFunc("/explorer/", explorerBlocksHandler)
+	http.HandleFunc("/explorer/block/", explorerBlockHandler)
+	http.HandleFunc("/explorer/tx/", explorerTxHandler)
 
 	// Serve static files from txps/dist (after build)
 	dist := "txps/dist"
@@ -100,8 +304,13 @@ func main() {
 		}
 	}
 
-	fs := http.FileServer(http.Dir(dist))
-	http.Handle("/", fs)
+	if _, err := os.Stat(dist); err == nil {
+		fs := http.FileServer(http.Dir(dist))
+		http.Handle("/", fs)
+	} else {
+		dist = "builtin dashboard"
+		http.HandleFunc("/", dashboardHandler)
+	}
 
 	port := "8081"
 	log.Printf("Starting TPS server on http://localhost:%s (static=%s)", port, dist)